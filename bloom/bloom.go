@@ -0,0 +1,254 @@
+// Package bloom implements a scalable Bloom filter.
+//
+// The filter grows by adding partitions of increasing capacity and tighter
+// error rates as items are added, keeping the overall false positive rate
+// bounded without knowing the final number of items up front.
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// Growth of each new partition's capacity
+	growth = 2
+	// Tightening ratio of each new partition's error rate
+	tightening = 0.8
+	// Magic number for snapshots
+	magic   = 0x626c6d66
+	version = 1
+)
+
+// Filter is a scalable Bloom filter safe for concurrent use
+type Filter struct {
+	capacity   uint64
+	rate       float64
+	partitions []*partition
+	lock       sync.RWMutex
+}
+
+// partition is a fixed size Bloom filter
+type partition struct {
+	capacity uint64
+	count    uint64
+	k        uint64
+	m        uint64
+	bits     []uint64
+}
+
+// New creates a filter with an initial capacity and target false positive
+// rate
+func New(capacity uint64, rate float64) *Filter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	if rate <= 0 || rate >= 1 {
+		rate = 0.001
+	}
+	f := &Filter{capacity: capacity, rate: rate}
+	f.grow()
+	return f
+}
+
+func newPartition(capacity uint64, rate float64) *partition {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(math.Ln2 * float64(m) / float64(capacity)))
+	if k == 0 {
+		k = 1
+	}
+	return &partition{
+		capacity: capacity,
+		k:        k,
+		m:        m,
+		bits:     make([]uint64, (m+63)/64),
+	}
+}
+
+// grow adds a new partition, the caller must hold the lock
+func (f *Filter) grow() {
+	n := len(f.partitions)
+	capacity := f.capacity
+	rate := f.rate * (1 - tightening)
+	for i := 0; i < n; i++ {
+		capacity *= growth
+		rate *= tightening
+	}
+	f.partitions = append(f.partitions, newPartition(capacity, rate))
+}
+
+// Add inserts an item into the filter
+func (f *Filter) Add(b []byte) {
+	h1, h2 := hashes(b)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, p := range f.partitions {
+		if p.test(h1, h2) {
+			return
+		}
+	}
+	p := f.partitions[len(f.partitions)-1]
+	if p.count >= p.capacity {
+		f.grow()
+		p = f.partitions[len(f.partitions)-1]
+	}
+	p.add(h1, h2)
+}
+
+// Test reports whether an item may be in the filter
+func (f *Filter) Test(b []byte) bool {
+	h1, h2 := hashes(b)
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, p := range f.partitions {
+		if p.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns the approximate number of items added
+func (f *Filter) Count() (n uint64) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, p := range f.partitions {
+		n += p.count
+	}
+	return n
+}
+
+func (p *partition) add(h1, h2 uint64) {
+	for i := uint64(0); i < p.k; i++ {
+		bit := (h1 + i*h2) % p.m
+		p.bits[bit/64] |= 1 << (bit % 64)
+	}
+	p.count++
+}
+
+func (p *partition) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < p.k; i++ {
+		bit := (h1 + i*h2) % p.m
+		if p.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashes returns the two base hashes used to derive the k bit positions
+func hashes(b []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write(b)
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+	// Ensure the second hash is odd so all bits can be reached
+	return h1, h2 | 1
+}
+
+// WriteTo implements io.WriterTo, writing a snapshot of the filter
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	cw := &countWriter{w: w}
+	header := []interface{}{
+		uint32(magic), uint32(version),
+		f.capacity, math.Float64bits(f.rate), uint64(len(f.partitions)),
+	}
+	for _, v := range header {
+		if err := binary.Write(cw, binary.BigEndian, v); err != nil {
+			return cw.n, err
+		}
+	}
+	for _, p := range f.partitions {
+		for _, v := range []uint64{p.capacity, p.count, p.k, p.m} {
+			if err := binary.Write(cw, binary.BigEndian, v); err != nil {
+				return cw.n, err
+			}
+		}
+		if err := binary.Write(cw, binary.BigEndian, p.bits); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom implements io.ReaderFrom, replacing the filter with a snapshot
+func (f *Filter) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countReader{r: r}
+
+	var m, ver uint32
+	var capacity, rate, n uint64
+	for _, v := range []interface{}{&m, &ver, &capacity, &rate, &n} {
+		if err := binary.Read(cr, binary.BigEndian, v); err != nil {
+			return cr.n, err
+		}
+	}
+	if m != magic {
+		return cr.n, errors.New("bloom: invalid snapshot")
+	}
+	if ver != version {
+		return cr.n, errors.New("bloom: unsupported snapshot version")
+	}
+
+	partitions := make([]*partition, n)
+	for i := range partitions {
+		p := &partition{}
+		for _, v := range []*uint64{&p.capacity, &p.count, &p.k, &p.m} {
+			if err := binary.Read(cr, binary.BigEndian, v); err != nil {
+				return cr.n, err
+			}
+		}
+		if p.m == 0 || p.k == 0 {
+			return cr.n, errors.New("bloom: invalid partition")
+		}
+		p.bits = make([]uint64, (p.m+63)/64)
+		if err := binary.Read(cr, binary.BigEndian, p.bits); err != nil {
+			return cr.n, err
+		}
+		partitions[i] = p
+	}
+	if len(partitions) == 0 {
+		return cr.n, errors.New("bloom: no partitions")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.capacity = capacity
+	f.rate = math.Float64frombits(rate)
+	f.partitions = partitions
+	return cr.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
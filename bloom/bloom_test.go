@@ -0,0 +1,69 @@
+package bloom
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFilterAddTest(t *testing.T) {
+	f := New(100, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Errorf("expected item-%d to be in filter", i)
+		}
+	}
+
+	if len(f.partitions) < 2 {
+		t.Errorf("expected filter to grow, got %d partitions", len(f.partitions))
+	}
+
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if f.Test([]byte(fmt.Sprintf("other-%d", i))) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 10000; rate > 0.02 {
+		t.Errorf("false positive rate %f too high", rate)
+	}
+}
+
+func TestFilterSnapshot(t *testing.T) {
+	f := New(10, 0.01)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	var buf bytes.Buffer
+	wn, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed with %s", err)
+	}
+
+	f2 := New(1, 0.5)
+	rn, err := f2.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed with %s", err)
+	}
+	if wn != rn {
+		t.Errorf("wrote %d bytes, read %d", wn, rn)
+	}
+	if f.Count() != f2.Count() {
+		t.Errorf("Count() => %d, expected %d", f2.Count(), f.Count())
+	}
+	for i := 0; i < 100; i++ {
+		if !f2.Test([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Errorf("expected item-%d to be in restored filter", i)
+		}
+	}
+
+	if _, err := f2.ReadFrom(bytes.NewReader([]byte("garbage data here"))); err == nil {
+		t.Errorf("ReadFrom should have failed for invalid data")
+	}
+}
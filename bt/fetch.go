@@ -0,0 +1,340 @@
+package bt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+const (
+	// MaxFetchPeers is the number of peers metadata is fetched from at once
+	MaxFetchPeers = 5
+	// utMetadataID is our extended message ID for ut_metadata
+	utMetadataID = 1
+	// maxMessages without receiving the one we are waiting for
+	maxMessages = 100
+)
+
+// protocolError marks peers that misbehave rather than just fail
+type protocolError struct {
+	msg string
+}
+
+func (e protocolError) Error() string {
+	return e.msg
+}
+
+// connect dials a peer over each transport in turn until the handshakes
+// complete
+func (bt *Worker) connect(p models.Peer) (s *Session, err error) {
+	for _, network := range bt.transport.networks() {
+		if s, err = bt.connectOver(network, p); err == nil {
+			return s, nil
+		}
+		bt.log.Debug("failed to connect", "network", network, "peer", p, "error", err)
+	}
+	return nil, err
+}
+
+// connectOver connects according to the encryption policy
+func (bt *Worker) connectOver(network string, p models.Peer) (*Session, error) {
+	switch bt.encryption {
+	case EncryptionDisabled:
+		return bt.dial(network, p, 0)
+	case EncryptionRequired:
+		return bt.dial(network, p, cryptoRC4)
+	}
+
+	s, err := bt.dial(network, p, cryptoRC4|cryptoPlaintext)
+	if err == nil {
+		return s, nil
+	}
+	// Only retry if the peer was reachable
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return nil, err
+	}
+	bt.log.Debug("encrypted handshake failed, trying plaintext", "peer", p, "error", err)
+	return bt.dial(network, p, 0)
+}
+
+// dial connects to a peer, negotiating encryption if any crypto methods are
+// provided
+func (bt *Worker) dial(network string, p models.Peer, provide uint32) (*Session, error) {
+	stats := bt.metrics.stats(network)
+	atomic.AddUint64(&stats.Attempts, 1)
+
+	conn, err := dialNetwork(network, p.Addr.String(), time.Second*15)
+	if err != nil {
+		return nil, err
+	}
+
+	if provide != 0 {
+		ec, err := mseHandshake(conn, p.Infohash, provide)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = ec
+	}
+
+	s := NewSession(conn, p)
+	if err = s.Handshake(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	atomic.AddUint64(&stats.Successes, 1)
+	return s, nil
+}
+
+// identify adds the client fingerprint from the handshakes to the peer
+func identify(p models.Peer, s *Session) models.Peer {
+	p.ID = s.RemoteID
+	p.Agent = s.Client
+	if c, ok := models.ParsePeerID(s.RemoteID); ok {
+		p.Client = c
+	} else if s.Client != "" {
+		p.Client = models.ClientFromAgent(s.Client)
+	}
+	return p
+}
+
+// metadataFetch assembles metadata pieces requested from multiple peers
+type metadataFetch struct {
+	ih        models.Infohash
+	size      int
+	pieces    [][]byte
+	remaining int
+	queue     chan int
+	done      chan struct{}
+	result    []byte
+	err       error
+	once      sync.Once
+	lock      sync.Mutex
+}
+
+// fetchMetadata requests different metadata pieces in parallel from each of
+// the peers, which must all be for the same infohash
+func (bt *Worker) fetchMetadata(peers []models.Peer) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers")
+	}
+
+	f := &metadataFetch{
+		ih:   peers[0].Infohash,
+		done: make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(peers))
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p models.Peer) {
+			defer wg.Done()
+			errs[i] = f.fetchFrom(bt, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		bt.log.Debug("peer fetch failed", "peer", peers[i], "error", err)
+		var pe protocolError
+		if errors.As(err, &pe) && bt.OnBadPeer != nil {
+			bt.OnBadPeer(peers[i])
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.result != nil {
+		return f.result, nil
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("metadata incomplete")
+}
+
+// fetchFrom takes pieces from the queue until the fetch is finished or the
+// peer fails, returning failed pieces to the queue for other peers
+func (f *metadataFetch) fetchFrom(bt *Worker, p models.Peer) error {
+	s, err := bt.connect(p)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	p = identify(p, s)
+	if bt.OnPeerClient != nil {
+		bt.OnPeerClient(p)
+	}
+	if models.MatchClient(p.Client, p.Agent, bt.blockedClients) {
+		return protocolError{fmt.Sprintf("blocked client %s", p.Client)}
+	}
+
+	// Abort blocking reads once other peers have finished
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-f.done:
+			s.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if err = f.init(s.MetadataSize); err != nil {
+		return err
+	}
+
+	pending := make(map[int]bool)
+	requeue := func() {
+		for piece := range pending {
+			f.queue <- piece
+		}
+	}
+
+	for {
+		// Keep as many requests outstanding as the peer allows
+		for len(pending) < s.MaxOutstanding() {
+			piece, ok := f.next(len(pending) == 0)
+			if !ok {
+				break
+			}
+			if piece < 0 {
+				requeue()
+				return nil
+			}
+			pending[piece] = true
+			if err = s.RequestMetadata(piece); err != nil {
+				requeue()
+				return err
+			}
+		}
+
+		msg, err := s.readMetadata()
+		if err != nil {
+			requeue()
+			if f.finished() {
+				return nil
+			}
+			return err
+		}
+		if !pending[msg.piece] {
+			continue
+		}
+
+		switch msg.msgType {
+		case MsgReject:
+			// They do not have it, try another peer
+			requeue()
+			return fmt.Errorf("piece %d rejected", msg.piece)
+		case MsgData:
+			if len(msg.data) != f.pieceSize(msg.piece) {
+				requeue()
+				return protocolError{fmt.Sprintf("incorrect piece %d length", msg.piece)}
+			}
+			delete(pending, msg.piece)
+			f.add(msg.piece, msg.data)
+		}
+	}
+}
+
+// next takes a piece from the queue, blocking if wait is set. A negative
+// piece is returned when the fetch is finished.
+func (f *metadataFetch) next(wait bool) (int, bool) {
+	if wait {
+		select {
+		case <-f.done:
+			return -1, true
+		case piece := <-f.queue:
+			return piece, true
+		}
+	}
+	select {
+	case <-f.done:
+		return -1, true
+	case piece := <-f.queue:
+		return piece, true
+	default:
+		return 0, false
+	}
+}
+
+func (f *metadataFetch) finished() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// init sets the metadata size from the first peer's handshake
+func (f *metadataFetch) init(size int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.pieces != nil {
+		if size != f.size {
+			return protocolError{"metadata size mismatch"}
+		}
+		return nil
+	}
+	if size <= 0 {
+		return protocolError{"invalid metadata size"}
+	}
+
+	f.size = size
+	f.remaining = (size + BlockSize - 1) / BlockSize
+	f.pieces = make([][]byte, f.remaining)
+	f.queue = make(chan int, f.remaining)
+	for i := range f.pieces {
+		f.queue <- i
+	}
+	return nil
+}
+
+func (f *metadataFetch) pieceSize(piece int) int {
+	if piece == len(f.pieces)-1 {
+		return f.size - piece*BlockSize
+	}
+	return BlockSize
+}
+
+// add stores a piece, verifying the metadata once complete
+func (f *metadataFetch) add(piece int, data []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.pieces[piece] != nil {
+		return
+	}
+	f.pieces[piece] = data
+	f.remaining--
+	if f.remaining > 0 {
+		return
+	}
+
+	md := bytes.Join(f.pieces, nil)
+	if models.InfohashMatchesMetadata(f.ih, md) {
+		f.result = md
+	} else {
+		f.err = errors.New("metadata does not match infohash")
+	}
+	f.once.Do(func() { close(f.done) })
+}
@@ -0,0 +1,286 @@
+package bt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/dhtsearch/models"
+	"src.userspace.com.au/dhtsearch/utp"
+	"src.userspace.com.au/go-bencode"
+	"src.userspace.com.au/logger"
+)
+
+// fakePeer serves metadata over ut_metadata, rejecting pieces reject
+// returns true for
+type fakePeer struct {
+	network  string
+	ln       net.Listener
+	metadata []byte
+	reject   func(piece int) bool
+	// Messages sent before the extended handshake
+	preamble [][]byte
+	// Our extended handshake as received
+	extHandshake chan map[string]interface{}
+	// Reply with this infohash rather than echo ours
+	infohash models.Infohash
+	// Crypto methods accepted, none for plaintext only
+	crypto uint32
+}
+
+func newFakePeer(t *testing.T, md []byte, reject func(int) bool, opts ...func(*fakePeer)) *fakePeer {
+	fp := &fakePeer{
+		network:      "tcp",
+		metadata:     md,
+		reject:       reject,
+		extHandshake: make(chan map[string]interface{}, 10),
+	}
+	for _, opt := range opts {
+		opt(fp)
+	}
+
+	var err error
+	if fp.network == "utp" {
+		fp.ln, err = utp.Listen("127.0.0.1:0")
+	} else {
+		fp.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go fp.serve()
+	return fp
+}
+
+func (fp *fakePeer) peer(ih models.Infohash) models.Peer {
+	addr, _ := net.ResolveUDPAddr("udp", fp.ln.Addr().String())
+	return models.Peer{Addr: addr, Infohash: ih}
+}
+
+func (fp *fakePeer) serve() {
+	for {
+		conn, err := fp.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fp.handle(conn)
+	}
+}
+
+func (fp *fakePeer) handle(conn net.Conn) {
+	defer conn.Close()
+	data := bytes.NewBuffer(nil)
+
+	if fp.crypto != 0 {
+		var err error
+		sum := sha1.Sum(fp.metadata)
+		if conn, err = mseAccept(conn, sum[:], fp.crypto); err != nil {
+			return
+		}
+	}
+
+	if err := read(conn, 68, data); err != nil {
+		return
+	}
+	hs := data.Next(68)
+	if !bytes.Equal(hs[:20], handshakePrefix[:20]) {
+		return
+	}
+	reply := make([]byte, 68)
+	copy(reply, handshakePrefix)
+	copy(reply[28:48], hs[28:48])
+	if fp.infohash != nil {
+		copy(reply[28:48], fp.infohash)
+	}
+	copy(reply[48:], models.GenInfohash())
+	conn.Write(reply)
+
+	for _, msg := range fp.preamble {
+		sendMessage(conn, msg)
+	}
+
+	m, _ := bencode.EncodeDict(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3},
+		"metadata_size": len(fp.metadata),
+		"v":             "Fake 1.0",
+		"reqq":          2,
+	})
+	sendMessage(conn, append([]byte{MsgExtended, HandshakeBit}, m...))
+
+	for {
+		length, err := readMessage(conn, data)
+		if err != nil {
+			return
+		}
+		msg := data.Next(length)
+		if length >= 2 && msg[0] == MsgExtended && msg[1] == HandshakeBit {
+			hs, _, err := bencode.DecodeDict(msg[2:], 0)
+			if err == nil {
+				fp.extHandshake <- hs
+			}
+			continue
+		}
+		if length < 2 || msg[0] != MsgExtended || msg[1] != 3 {
+			continue
+		}
+		dict, _, err := bencode.DecodeDict(msg[2:], 0)
+		if err != nil {
+			return
+		}
+		piece, _ := krpc.GetInt(dict, "piece")
+
+		if fp.reject(piece) {
+			r, _ := bencode.EncodeDict(map[string]interface{}{
+				"msg_type": MsgReject,
+				"piece":    piece,
+			})
+			sendMessage(conn, append([]byte{MsgExtended, utMetadataID}, r...))
+			continue
+		}
+
+		end := (piece + 1) * BlockSize
+		if end > len(fp.metadata) {
+			end = len(fp.metadata)
+		}
+		r, _ := bencode.EncodeDict(map[string]interface{}{
+			"msg_type":   MsgData,
+			"piece":      piece,
+			"total_size": len(fp.metadata),
+		})
+		r = append(r, fp.metadata[piece*BlockSize:end]...)
+		sendMessage(conn, append([]byte{MsgExtended, utMetadataID}, r...))
+	}
+}
+
+func TestFetchMetadataMultiplePeers(t *testing.T) {
+	// Several pieces worth of metadata
+	md := bytes.Repeat([]byte("0123456789abcdef"), BlockSize/4)
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	// One peer rejects every other piece
+	fp1 := newFakePeer(t, md, func(p int) bool { return p%2 == 0 })
+	defer fp1.ln.Close()
+	fp2 := newFakePeer(t, md, func(int) bool { return false })
+	defer fp2.ln.Close()
+
+	w, err := NewWorker(nil, SetLogger(logger.New(&logger.Options{Name: "test"})))
+	if err != nil {
+		t.Fatalf("failed to create worker: %s", err)
+	}
+
+	out, err := w.fetchMetadata([]models.Peer{fp1.peer(ih), fp2.peer(ih)})
+	if err != nil {
+		t.Fatalf("fetchMetadata failed with %s", err)
+	}
+	if !bytes.Equal(out, md) {
+		t.Errorf("fetched metadata does not match")
+	}
+}
+
+func TestFetchMetadataAllRejected(t *testing.T) {
+	md := bytes.Repeat([]byte("x"), BlockSize+10)
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	fp := newFakePeer(t, md, func(p int) bool { return p == 1 })
+	defer fp.ln.Close()
+
+	w, err := NewWorker(nil, SetLogger(logger.New(&logger.Options{Name: "test"})))
+	if err != nil {
+		t.Fatalf("failed to create worker: %s", err)
+	}
+
+	if _, err = w.fetchMetadata([]models.Peer{fp.peer(ih)}); err == nil {
+		t.Errorf("fetchMetadata should have failed")
+	}
+}
+
+func TestFetchMetadataTransports(t *testing.T) {
+	md := bytes.Repeat([]byte("x"), BlockSize+10)
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	tests := []struct {
+		strategy TransportStrategy
+		network  string
+		tcp      TransportStats
+		utp      TransportStats
+	}{
+		{TransportTCPFirst, "tcp", TransportStats{1, 1}, TransportStats{}},
+		{TransportUTPFirst, "utp", TransportStats{}, TransportStats{1, 1}},
+		{TransportUTP, "utp", TransportStats{}, TransportStats{1, 1}},
+		// Nothing listens for TCP on the uTP port
+		{TransportTCPFirst, "utp", TransportStats{1, 0}, TransportStats{1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy.String()+"/"+tt.network, func(t *testing.T) {
+			fp := newFakePeer(t, md, func(int) bool { return false }, func(fp *fakePeer) {
+				fp.network = tt.network
+			})
+			defer fp.ln.Close()
+
+			m := new(Metrics)
+			w, err := NewWorker(
+				nil,
+				SetLogger(logger.New(&logger.Options{Name: "test"})),
+				SetEncryption(EncryptionDisabled),
+				SetTransport(tt.strategy),
+				SetMetrics(m),
+			)
+			if err != nil {
+				t.Fatalf("failed to create worker: %s", err)
+			}
+
+			out, err := w.fetchMetadata([]models.Peer{fp.peer(ih)})
+			if err != nil {
+				t.Fatalf("fetchMetadata failed with %s", err)
+			}
+			if !bytes.Equal(out, md) {
+				t.Errorf("fetched metadata does not match")
+			}
+			got := m.Snapshot()
+			if got.TCP != tt.tcp || got.UTP != tt.utp {
+				t.Errorf("metrics => %+v, expected tcp %+v utp %+v", got, tt.tcp, tt.utp)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataClients(t *testing.T) {
+	md := bytes.Repeat([]byte("x"), 100)
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	fp := newFakePeer(t, md, func(int) bool { return false })
+	defer fp.ln.Close()
+
+	var seen, bad []models.Peer
+	w, err := NewWorker(
+		nil,
+		SetLogger(logger.New(&logger.Options{Name: "test"})),
+		SetTransport(TransportTCP),
+		SetOnPeerClient(func(p models.Peer) { seen = append(seen, p) }),
+		SetOnBadPeer(func(p models.Peer) { bad = append(bad, p) }),
+		SetBlockedClients([]string{"fake"}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create worker: %s", err)
+	}
+
+	if _, err = w.fetchMetadata([]models.Peer{fp.peer(ih)}); err == nil {
+		t.Errorf("fetchMetadata should fail for blocked clients")
+	}
+	if len(seen) != 1 || seen[0].Agent != "Fake 1.0" || seen[0].Client != (models.Client{Name: "Fake", Version: "1.0"}) {
+		t.Errorf("OnPeerClient => %+v", seen)
+	}
+	if len(seen) == 1 && len(seen[0].ID) != 20 {
+		t.Errorf("peer ID not recorded")
+	}
+	if len(bad) != 1 {
+		t.Errorf("blocked client should be reported as a bad peer")
+	}
+}
@@ -0,0 +1,261 @@
+package bt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// EncryptionPolicy determines whether connections use Message Stream
+// Encryption
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisabled only makes plaintext connections
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPreferred tries encryption first, falling back to plaintext
+	EncryptionPreferred
+	// EncryptionRequired only makes encrypted connections
+	EncryptionRequired
+)
+
+var encryptionNames = map[EncryptionPolicy]string{
+	EncryptionDisabled:  "plaintext",
+	EncryptionPreferred: "prefer",
+	EncryptionRequired:  "require",
+}
+
+// String implements fmt.Stringer
+func (p EncryptionPolicy) String() string {
+	return encryptionNames[p]
+}
+
+// ParseEncryptionPolicy converts a name to an EncryptionPolicy
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	for p, name := range encryptionNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return EncryptionDisabled, fmt.Errorf("invalid encryption policy %q", s)
+}
+
+// Crypto methods offered in the handshake
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const (
+	// Length of the Diffie-Hellman public keys
+	dhKeyLen = 96
+	// Maximum length of random padding
+	maxPadLen = 512
+)
+
+var (
+	// 768 bit prime from the MSE specification
+	dhPrime, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+	// Verification constant
+	mseVC = make([]byte, 8)
+)
+
+// mseConn encrypts and decrypts a connection after the MSE handshake
+type mseConn struct {
+	net.Conn
+	r   io.Reader
+	enc *rc4.Cipher
+	dec *rc4.Cipher
+}
+
+// Read implements io.Reader
+func (c *mseConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write implements io.Writer
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	out := make([]byte, len(b))
+	c.enc.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// mseHandshake performs the initiating side of the Message Stream Encryption
+// handshake, offering the provided crypto methods. The infohash is the shared
+// secret key.
+func mseHandshake(conn net.Conn, skey []byte, provide uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * time.Duration(TCPTimeout)))
+	defer conn.SetDeadline(time.Time{})
+
+	xa, ya, err := dhKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. A->B: Diffie Hellman Ya, PadA
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(ya, pad...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Diffie Hellman Yb, PadB
+	br := bufio.NewReader(conn)
+	yb := make([]byte, dhKeyLen)
+	if _, err = io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+	secret := dhSecret(xa, yb)
+
+	enc := newRC4(mseHash("keyA", secret, skey))
+	dec := newRC4(mseHash("keyB", secret, skey))
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	var msg bytes.Buffer
+	msg.Write(mseHash("req1", secret))
+	req2 := mseHash("req2", skey)
+	req3 := mseHash("req3", secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	msg.Write(req2)
+
+	plain := make([]byte, 16)
+	copy(plain, mseVC)
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	// No PadC or initial payload
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err = conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// Synchronise on the encrypted VC following PadB
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err = syncOn(br, vc, maxPadLen+len(vc)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err = io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[:4])
+	padLen := int(binary.BigEndian.Uint16(header[4:]))
+	if padLen > maxPadLen {
+		return nil, protocolError{"invalid padD length"}
+	}
+	padD := make([]byte, padLen)
+	if _, err = io.ReadFull(br, padD); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	if selected&provide == 0 || (selected != cryptoRC4 && selected != cryptoPlaintext) {
+		return nil, protocolError{fmt.Sprintf("invalid crypto_select %d", selected)}
+	}
+	if selected == cryptoPlaintext {
+		return &mseConn{Conn: conn, r: br}, nil
+	}
+	return &mseConn{Conn: conn, r: br, enc: enc, dec: dec}, nil
+}
+
+// dhKeys generates a private key and the public key to send
+func dhKeys() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(dhGenerator, x, dhPrime)
+	return x, padKey(y.Bytes()), nil
+}
+
+// dhSecret computes the shared secret from our private and their public key
+func dhSecret(x *big.Int, y []byte) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(y), x, dhPrime)
+	return padKey(s.Bytes())
+}
+
+// padKey left pads big endian keys to the full length
+func padKey(b []byte) []byte {
+	if len(b) >= dhKeyLen {
+		return b
+	}
+	out := make([]byte, dhKeyLen)
+	copy(out[dhKeyLen-len(b):], b)
+	return out
+}
+
+func randomPad() ([]byte, error) {
+	n := make([]byte, 2)
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n))%(maxPadLen+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+func mseHash(parts ...interface{}) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		switch v := p.(type) {
+		case string:
+			io.WriteString(h, v)
+		case []byte:
+			h.Write(v)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// newRC4 creates a cipher discarding the first 1024 bytes of keystream
+func newRC4(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// syncOn reads until pattern is found within max bytes
+func syncOn(r io.ByteReader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) >= len(pattern) && bytes.Equal(window[len(window)-len(pattern):], pattern) {
+			return nil
+		}
+	}
+	return errors.New("failed to synchronise encrypted stream")
+}
@@ -0,0 +1,160 @@
+package bt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"src.userspace.com.au/dhtsearch/models"
+	"src.userspace.com.au/logger"
+)
+
+// mseAccept performs the receiving side of the MSE handshake for skey,
+// selecting from the accepted crypto methods
+func mseAccept(conn net.Conn, skey []byte, accept uint32) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	ya := make([]byte, dhKeyLen)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, err
+	}
+	xb, yb, err := dhKeys()
+	if err != nil {
+		return nil, err
+	}
+	pad, _ := randomPad()
+	if _, err = conn.Write(append(yb, pad...)); err != nil {
+		return nil, err
+	}
+	secret := dhSecret(xb, ya)
+
+	if err = syncOn(br, mseHash("req1", secret), maxPadLen+sha1.Size); err != nil {
+		return nil, err
+	}
+	req := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(br, req); err != nil {
+		return nil, err
+	}
+	req2 := mseHash("req2", skey)
+	req3 := mseHash("req3", secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	if !bytes.Equal(req, req2) {
+		return nil, errors.New("unknown skey")
+	}
+
+	dec := newRC4(mseHash("keyA", secret, skey))
+	enc := newRC4(mseHash("keyB", secret, skey))
+
+	// VC, crypto_provide, len(PadC)
+	header := make([]byte, 14)
+	if _, err = io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, errors.New("invalid VC")
+	}
+	provide := binary.BigEndian.Uint32(header[8:])
+	padC := make([]byte, int(binary.BigEndian.Uint16(header[12:]))+2)
+	if _, err = io.ReadFull(br, padC); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	ia := make([]byte, binary.BigEndian.Uint16(padC[len(padC)-2:]))
+	if _, err = io.ReadFull(br, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	selected := cryptoRC4
+	if provide&accept&cryptoRC4 == 0 {
+		selected = cryptoPlaintext
+	}
+	if provide&accept&selected == 0 {
+		return nil, errors.New("no common crypto method")
+	}
+
+	reply := make([]byte, 14)
+	copy(reply, mseVC)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err = conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if selected == cryptoPlaintext {
+		return &mseConn{Conn: conn, r: br}, nil
+	}
+	return &mseConn{Conn: conn, r: br, enc: enc, dec: dec}, nil
+}
+
+func TestFetchMetadataEncryption(t *testing.T) {
+	md := bytes.Repeat([]byte("x"), BlockSize+10)
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	tests := []struct {
+		name   string
+		policy EncryptionPolicy
+		crypto uint32
+		ok     bool
+	}{
+		{"rc4 required", EncryptionRequired, cryptoRC4, true},
+		{"rc4 preferred", EncryptionPreferred, cryptoRC4, true},
+		{"plaintext selected", EncryptionPreferred, cryptoPlaintext, true},
+		{"fallback to plaintext", EncryptionPreferred, 0, true},
+		{"encrypted only peer", EncryptionDisabled, cryptoRC4, false},
+		{"plaintext only peer", EncryptionRequired, 0, false},
+		{"plaintext refused", EncryptionRequired, cryptoPlaintext, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := newFakePeer(t, md, func(int) bool { return false }, func(fp *fakePeer) {
+				fp.crypto = tt.crypto
+			})
+			defer fp.ln.Close()
+
+			w, err := NewWorker(
+				nil,
+				SetLogger(logger.New(&logger.Options{Name: "test"})),
+				SetEncryption(tt.policy),
+				SetTransport(TransportTCP),
+			)
+			if err != nil {
+				t.Fatalf("failed to create worker: %s", err)
+			}
+
+			out, err := w.fetchMetadata([]models.Peer{fp.peer(ih)})
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("fetchMetadata should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchMetadata failed with %s", err)
+			}
+			if !bytes.Equal(out, md) {
+				t.Errorf("fetched metadata does not match")
+			}
+		})
+	}
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for _, p := range []EncryptionPolicy{EncryptionDisabled, EncryptionPreferred, EncryptionRequired} {
+		got, err := ParseEncryptionPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParseEncryptionPolicy(%q) => %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("rot13"); err == nil {
+		t.Errorf("ParseEncryptionPolicy should fail for unknown policies")
+	}
+}
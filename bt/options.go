@@ -23,6 +23,63 @@ func SetOnBadPeer(f func(models.Peer)) Option {
 	}
 }
 
+// SetOnFetchFailed sets the callback
+func SetOnFetchFailed(f func(models.Peer, error)) Option {
+	return func(w *Worker) error {
+		w.OnFetchFailed = f
+		return nil
+	}
+}
+
+// SetOnPeerClient sets the callback
+func SetOnPeerClient(f func(models.Peer)) Option {
+	return func(w *Worker) error {
+		w.OnPeerClient = f
+		return nil
+	}
+}
+
+// SetBlockedClients sets the client names to refuse, matched case
+// insensitively against the start of the client name or agent
+func SetBlockedClients(names []string) Option {
+	return func(w *Worker) error {
+		w.blockedClients = names
+		return nil
+	}
+}
+
+// SetPeerLookup sets the function used to find other peers for an infohash
+func SetPeerLookup(f func(models.Infohash) ([]models.Peer, error)) Option {
+	return func(w *Worker) error {
+		w.PeerLookup = f
+		return nil
+	}
+}
+
+// SetEncryption sets the encryption policy for peer connections
+func SetEncryption(p EncryptionPolicy) Option {
+	return func(w *Worker) error {
+		w.encryption = p
+		return nil
+	}
+}
+
+// SetTransport sets the transport strategy for peer connections
+func SetTransport(t TransportStrategy) Option {
+	return func(w *Worker) error {
+		w.transport = t
+		return nil
+	}
+}
+
+// SetMetrics sets the connection metrics to update
+func SetMetrics(m *Metrics) Option {
+	return func(w *Worker) error {
+		w.metrics = m
+		return nil
+	}
+}
+
 // SetPort sets the port to listen on
 func SetPort(p int) Option {
 	return func(w *Worker) error {
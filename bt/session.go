@@ -0,0 +1,402 @@
+package bt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/dhtsearch/models"
+	"src.userspace.com.au/go-bencode"
+)
+
+// BEP 3 peer wire message types
+const (
+	msgChoke = iota
+	msgUnchoke
+	msgInterested
+	msgNotInterested
+	msgHave
+	msgBitfield
+)
+
+const (
+	// ClientName is sent as 'v' in the extension handshake
+	ClientName = "dhtsearch"
+	// MaxRequests is the most metadata requests outstanding to one peer
+	MaxRequests = 16
+	// KeepaliveInterval between messages we send
+	KeepaliveInterval = 2 * time.Minute
+	// defaultReqq is assumed when a peer does not send 'reqq'
+	defaultReqq = 250
+	// maxBitfieldPieces are tracked from have and bitfield messages, only
+	// metadata is fetched so later pieces are ignored
+	maxBitfieldPieces = 1 << 16
+)
+
+type sessionState int
+
+const (
+	stateNew sessionState = iota
+	stateHandshakeSent
+	stateConnected
+	stateExtended
+	stateClosed
+)
+
+var stateNames = map[sessionState]string{
+	stateNew:           "new",
+	stateHandshakeSent: "handshake sent",
+	stateConnected:     "connected",
+	stateExtended:      "extended",
+	stateClosed:        "closed",
+}
+
+// String implements fmt.Stringer
+func (s sessionState) String() string {
+	return stateNames[s]
+}
+
+// Session is a peer wire connection used to fetch metadata
+type Session struct {
+	peer  models.Peer
+	conn  net.Conn
+	data  *bytes.Buffer
+	state sessionState
+	// Our peer ID
+	id models.Infohash
+
+	// Known metadata size, sent in our extended handshake
+	metadataSize int
+
+	// Sent by the remote peer
+	RemoteID   []byte
+	Extensions map[string]int
+	Client     string
+	Reqq       int
+	YourIP     net.IP
+	ListenPort int
+	Bitfield   []byte
+	Choked     bool
+	// MetadataSize advertised by the remote peer
+	MetadataSize int
+
+	outstanding int
+	lastWrite   time.Time
+}
+
+// metadataMsg is a ut_metadata data or reject message
+type metadataMsg struct {
+	msgType int
+	piece   int
+	data    []byte
+}
+
+// NewSession wraps an established connection to a peer
+func NewSession(conn net.Conn, p models.Peer) *Session {
+	s := &Session{
+		peer:   p,
+		conn:   conn,
+		data:   bytes.NewBuffer(nil),
+		state:  stateNew,
+		id:     models.GenInfohash(),
+		Choked: true,
+		Reqq:   defaultReqq,
+	}
+	s.data.Grow(BlockSize)
+	return s
+}
+
+// Close the session
+func (s *Session) Close() error {
+	s.state = stateClosed
+	return s.conn.Close()
+}
+
+// Handshake performs the BEP 3 and BEP 10 handshakes
+func (s *Session) Handshake() error {
+	if s.state != stateNew {
+		return fmt.Errorf("handshake in state %s", s.state)
+	}
+	if err := s.sendHandshake(); err != nil {
+		return err
+	}
+	s.state = stateHandshakeSent
+
+	if err := s.readHandshake(); err != nil {
+		return err
+	}
+	s.state = stateConnected
+
+	if err := s.sendExtHandshake(); err != nil {
+		return err
+	}
+
+	// Wait for their extended handshake
+	for i := 0; i < maxMessages; i++ {
+		extID, payload, err := s.readExtended()
+		if err != nil {
+			return err
+		}
+		if extID != HandshakeBit {
+			continue
+		}
+		if err = s.onExtHandshake(payload); err != nil {
+			return err
+		}
+		s.state = stateExtended
+		return nil
+	}
+	return errors.New("no extended handshake")
+}
+
+func (s *Session) sendHandshake() error {
+	data := make([]byte, 68)
+	copy(data[:28], handshakePrefix)
+	copy(data[28:48], []byte(s.peer.Infohash))
+	copy(data[48:], []byte(s.id))
+
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(TCPTimeout)))
+	_, err := s.conn.Write(data)
+	s.lastWrite = time.Now()
+	return err
+}
+
+// readHandshake checks the response is for our infohash and supports the
+// extension protocol
+func (s *Session) readHandshake() error {
+	if err := read(s.conn, 68, s.data); err != nil {
+		return err
+	}
+	data := s.data.Next(68)
+	if !bytes.Equal(handshakePrefix[:20], data[:20]) {
+		return protocolError{"invalid handshake response"}
+	}
+	if data[25]&0x10 == 0 {
+		return protocolError{"extension protocol not supported"}
+	}
+	if !bytes.Equal(data[28:48], s.peer.Infohash) {
+		return protocolError{"handshake infohash mismatch"}
+	}
+	s.RemoteID = append([]byte(nil), data[48:68]...)
+	return nil
+}
+
+// sendExtHandshake advertises ut_metadata and what we know about the peer
+func (s *Session) sendExtHandshake() error {
+	hs := map[string]interface{}{
+		"m":    map[string]interface{}{"ut_metadata": utMetadataID},
+		"v":    ClientName,
+		"reqq": MaxRequests,
+	}
+	if s.metadataSize > 0 {
+		hs["metadata_size"] = s.metadataSize
+	}
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			hs["yourip"] = string(ip4)
+		} else {
+			hs["yourip"] = string(addr.IP)
+		}
+	}
+	m, err := bencode.EncodeDict(hs)
+	if err != nil {
+		return err
+	}
+	return s.send(append([]byte{MsgExtended, HandshakeBit}, m...))
+}
+
+func (s *Session) onExtHandshake(payload []byte) error {
+	dict, _, err := bencode.DecodeDict(payload, 0)
+	if err != nil {
+		return protocolError{err.Error()}
+	}
+
+	m, err := krpc.GetMap(dict, "m")
+	if err != nil {
+		return protocolError{err.Error()}
+	}
+	s.Extensions = make(map[string]int, len(m))
+	for k, v := range m {
+		if id, ok := v.(int64); ok && id > 0 && id < 256 {
+			s.Extensions[k] = int(id)
+		}
+	}
+
+	if v, err := krpc.GetString(dict, "v"); err == nil {
+		s.Client = v
+	}
+	if reqq, err := krpc.GetInt(dict, "reqq"); err == nil && reqq > 0 {
+		s.Reqq = reqq
+	}
+	if ip, err := krpc.GetString(dict, "yourip"); err == nil && (len(ip) == 4 || len(ip) == 16) {
+		s.YourIP = net.IP(ip)
+	}
+	if port, err := krpc.GetInt(dict, "p"); err == nil && port > 0 && port < 65536 {
+		s.ListenPort = port
+	}
+
+	if _, ok := s.Extensions["ut_metadata"]; !ok {
+		return protocolError{"ut_metadata not supported"}
+	}
+	size, err := krpc.GetInt(dict, "metadata_size")
+	if err != nil {
+		return protocolError{err.Error()}
+	}
+	if size <= 0 || size > MaxMetadataSize {
+		return protocolError{fmt.Sprintf("invalid metadata_size %d", size)}
+	}
+	s.MetadataSize = size
+	return nil
+}
+
+// send writes a message, recording the time for keepalives
+func (s *Session) send(data []byte) error {
+	_, err := sendMessage(s.conn, data)
+	s.lastWrite = time.Now()
+	return err
+}
+
+// keepalive sends a keepalive if nothing has been sent recently
+func (s *Session) keepalive() error {
+	if time.Since(s.lastWrite) < KeepaliveInterval {
+		return nil
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(TCPTimeout)))
+	_, err := s.conn.Write([]byte{0, 0, 0, 0})
+	s.lastWrite = time.Now()
+	return err
+}
+
+// readExtended reads messages, handling core protocol messages, until an
+// extended message arrives
+func (s *Session) readExtended() (extID byte, payload []byte, err error) {
+	for i := 0; i < maxMessages; i++ {
+		if err = s.keepalive(); err != nil {
+			return 0, nil, err
+		}
+		length, err := readMessage(s.conn, s.data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if length == 0 {
+			// Keepalive
+			continue
+		}
+		msg := s.data.Next(length)
+
+		switch msg[0] {
+		case msgChoke:
+			s.Choked = true
+		case msgUnchoke:
+			s.Choked = false
+		case msgHave:
+			if len(msg) != 5 {
+				return 0, nil, protocolError{"invalid have message"}
+			}
+			s.onHave(int(msg[1])<<24 | int(msg[2])<<16 | int(msg[3])<<8 | int(msg[4]))
+		case msgBitfield:
+			bits := msg[1:]
+			if len(bits) > maxBitfieldPieces/8 {
+				bits = bits[:maxBitfieldPieces/8]
+			}
+			s.Bitfield = append([]byte(nil), bits...)
+		case MsgExtended:
+			if len(msg) < 2 {
+				return 0, nil, protocolError{"short extended message"}
+			}
+			return msg[1], msg[2:], nil
+		}
+	}
+	return 0, nil, errors.New("too many messages")
+}
+
+// onHave updates the bitfield with a piece the peer has
+func (s *Session) onHave(piece int) {
+	if piece < 0 || piece >= maxBitfieldPieces {
+		return
+	}
+	if n := piece/8 + 1; n > len(s.Bitfield) {
+		s.Bitfield = append(s.Bitfield, make([]byte, n-len(s.Bitfield))...)
+	}
+	s.Bitfield[piece/8] |= 0x80 >> uint(piece%8)
+}
+
+// HasPiece reports whether the peer has advertised a piece
+func (s *Session) HasPiece(piece int) bool {
+	if piece < 0 || piece/8 >= len(s.Bitfield) {
+		return false
+	}
+	return s.Bitfield[piece/8]&(0x80>>uint(piece%8)) != 0
+}
+
+// MaxOutstanding is the number of metadata requests that may be pending
+func (s *Session) MaxOutstanding() int {
+	if s.Reqq < MaxRequests {
+		return s.Reqq
+	}
+	return MaxRequests
+}
+
+// RequestMetadata sends a ut_metadata request for a piece
+func (s *Session) RequestMetadata(piece int) error {
+	if s.state != stateExtended {
+		return fmt.Errorf("request in state %s", s.state)
+	}
+	if s.outstanding >= s.MaxOutstanding() {
+		return errors.New("too many outstanding requests")
+	}
+	msg, err := bencode.EncodeDict(map[string]interface{}{
+		"msg_type": MsgRequest,
+		"piece":    piece,
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.send(append([]byte{MsgExtended, byte(s.Extensions["ut_metadata"])}, msg...)); err != nil {
+		return err
+	}
+	s.outstanding++
+	return nil
+}
+
+// readMetadata waits for the next ut_metadata data or reject message
+func (s *Session) readMetadata() (*metadataMsg, error) {
+	for i := 0; i < maxMessages; i++ {
+		extID, payload, err := s.readExtended()
+		if err != nil {
+			return nil, err
+		}
+		if extID != utMetadataID {
+			continue
+		}
+
+		dict, index, err := bencode.DecodeDict(payload, 0)
+		if err != nil {
+			return nil, protocolError{err.Error()}
+		}
+		mt, err := krpc.GetInt(dict, "msg_type")
+		if err != nil {
+			return nil, protocolError{err.Error()}
+		}
+		piece, err := krpc.GetInt(dict, "piece")
+		if err != nil {
+			return nil, protocolError{err.Error()}
+		}
+
+		switch mt {
+		case MsgData, MsgReject:
+			if s.outstanding > 0 {
+				s.outstanding--
+			}
+			return &metadataMsg{
+				msgType: mt,
+				piece:   piece,
+				data:    append([]byte(nil), payload[index:]...),
+			}, nil
+		}
+	}
+	return nil, errors.New("too many messages")
+}
@@ -0,0 +1,116 @@
+package bt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+func TestSessionHandshake(t *testing.T) {
+	md := []byte("d4:name4:testee")
+	sum := sha1.Sum(md)
+	ih := models.Infohash(sum[:])
+
+	fp := newFakePeer(t, md, func(int) bool { return false })
+	defer fp.ln.Close()
+	fp.preamble = [][]byte{
+		{msgBitfield, 0x80},
+		{msgHave, 0, 0, 0, 9},
+		{msgHave, 0xff, 0xff, 0xff, 0xff},
+		{msgUnchoke},
+	}
+
+	conn, err := net.DialTimeout("tcp", fp.ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	s := NewSession(conn, fp.peer(ih))
+	defer s.Close()
+
+	if err = s.Handshake(); err != nil {
+		t.Fatalf("Handshake() failed with %s", err)
+	}
+	if s.state != stateExtended {
+		t.Errorf("state => %s, expected %s", s.state, stateExtended)
+	}
+	if s.Client != "Fake 1.0" {
+		t.Errorf("Client => %q, expected %q", s.Client, "Fake 1.0")
+	}
+	if s.MetadataSize != len(md) {
+		t.Errorf("MetadataSize => %d, expected %d", s.MetadataSize, len(md))
+	}
+	if s.MaxOutstanding() != 2 {
+		t.Errorf("MaxOutstanding() => %d, expected 2", s.MaxOutstanding())
+	}
+	if s.Choked {
+		t.Errorf("expected session to be unchoked")
+	}
+	for _, piece := range []int{0, 9} {
+		if !s.HasPiece(piece) {
+			t.Errorf("expected peer to have piece %d", piece)
+		}
+	}
+	if s.HasPiece(1) {
+		t.Errorf("expected peer not to have piece 1")
+	}
+	if len(s.Bitfield) > maxBitfieldPieces/8 {
+		t.Errorf("Bitfield grew to %d bytes", len(s.Bitfield))
+	}
+
+	hs := <-fp.extHandshake
+	if v, _ := krpc.GetString(hs, "v"); v != ClientName {
+		t.Errorf("sent v => %q, expected %q", v, ClientName)
+	}
+	if reqq, _ := krpc.GetInt(hs, "reqq"); reqq != MaxRequests {
+		t.Errorf("sent reqq => %d, expected %d", reqq, MaxRequests)
+	}
+	if ip, _ := krpc.GetString(hs, "yourip"); !net.IP(ip).Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("sent yourip => %v, expected 127.0.0.1", net.IP(ip))
+	}
+
+	// Bounded by the peer's reqq
+	for i := 0; i < 2; i++ {
+		if err = s.RequestMetadata(0); err != nil {
+			t.Fatalf("RequestMetadata() failed with %s", err)
+		}
+	}
+	if err = s.RequestMetadata(0); err == nil {
+		t.Errorf("RequestMetadata() should fail beyond reqq")
+	}
+}
+
+func TestSessionHandshakeWrongInfohash(t *testing.T) {
+	fp := newFakePeer(t, []byte("x"), func(int) bool { return false }, func(fp *fakePeer) {
+		fp.infohash = models.GenInfohash()
+	})
+	defer fp.ln.Close()
+
+	conn, err := net.DialTimeout("tcp", fp.ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	ih := append(models.Infohash(nil), fp.infohash...)
+	ih[0] ^= 0xff
+	s := NewSession(conn, fp.peer(ih))
+	defer s.Close()
+
+	if err = s.Handshake(); err == nil {
+		t.Errorf("Handshake() should fail for mismatched infohash")
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	if _, err := readMessage(client, bytes.NewBuffer(nil)); err == nil {
+		t.Errorf("readMessage() should fail for a message over %d bytes", maxMessageLength)
+	}
+}
@@ -0,0 +1,111 @@
+package bt
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/utp"
+)
+
+// TransportStrategy determines which transports are used to reach peers and
+// in what order
+type TransportStrategy int
+
+const (
+	// TransportTCP only connects over TCP
+	TransportTCP TransportStrategy = iota
+	// TransportTCPFirst tries TCP, then uTP
+	TransportTCPFirst
+	// TransportUTPFirst tries uTP, then TCP
+	TransportUTPFirst
+	// TransportUTP only connects over uTP
+	TransportUTP
+)
+
+var transportNames = map[TransportStrategy]string{
+	TransportTCP:      "tcp",
+	TransportTCPFirst: "tcp-first",
+	TransportUTPFirst: "utp-first",
+	TransportUTP:      "utp",
+}
+
+// String implements fmt.Stringer
+func (t TransportStrategy) String() string {
+	return transportNames[t]
+}
+
+// ParseTransportStrategy converts a name to a TransportStrategy
+func ParseTransportStrategy(s string) (TransportStrategy, error) {
+	for t, name := range transportNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	return TransportTCP, fmt.Errorf("invalid transport strategy %q", s)
+}
+
+// networks lists the transports to try in order
+func (t TransportStrategy) networks() []string {
+	switch t {
+	case TransportTCPFirst:
+		return []string{"tcp", "utp"}
+	case TransportUTPFirst:
+		return []string{"utp", "tcp"}
+	case TransportUTP:
+		return []string{"utp"}
+	}
+	return []string{"tcp"}
+}
+
+// TransportStats counts connections made over a transport
+type TransportStats struct {
+	// Dial attempts
+	Attempts uint64 `json:"attempts"`
+	// Attempts completing the BitTorrent handshake
+	Successes uint64 `json:"successes"`
+}
+
+// Metrics counts connections by transport, it is safe to share between
+// workers
+type Metrics struct {
+	TCP TransportStats `json:"tcp"`
+	UTP TransportStats `json:"utp"`
+}
+
+// Snapshot returns a copy of the current counts
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		TCP: TransportStats{
+			Attempts:  atomic.LoadUint64(&m.TCP.Attempts),
+			Successes: atomic.LoadUint64(&m.TCP.Successes),
+		},
+		UTP: TransportStats{
+			Attempts:  atomic.LoadUint64(&m.UTP.Attempts),
+			Successes: atomic.LoadUint64(&m.UTP.Successes),
+		},
+	}
+}
+
+func (m *Metrics) stats(network string) *TransportStats {
+	if network == "utp" {
+		return &m.UTP
+	}
+	return &m.TCP
+}
+
+// dialNetwork opens a connection to addr over the network
+func dialNetwork(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if network == "utp" {
+		return utp.DialTimeout(addr, timeout)
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	return conn, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/bloom"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+const (
+	bloomCapacity = 100000
+	bloomRate     = 0.001
+)
+
+// loadBloomFilter populates the filter from the store, on top of the
+// snapshot file if there is one. A snapshot with infohashes not in the store
+// is from another database and is discarded.
+func loadBloomFilter(s models.InfohashStore) (*bloom.Filter, error) {
+	ctx := context.Background()
+	f := readBloomFilter()
+	snapshot := f != nil
+	if !snapshot {
+		f = bloom.New(bloomCapacity, bloomRate)
+	}
+
+	var stored, missing uint64
+	err := s.IndexedInfohashes(ctx, func(ih models.Infohash) error {
+		stored++
+		if !f.Test(ih) {
+			missing++
+			f.Add(ih)
+		}
+		return nil
+	})
+	if err != nil || !snapshot {
+		return f, err
+	}
+	if missing > 0 {
+		log.Warn("bloom filter snapshot was stale", "file", bloomFile, "missing", missing)
+	}
+	if f.Count() > stored {
+		log.Warn("bloom filter snapshot does not match the store, rebuilding", "file", bloomFile)
+		f = bloom.New(bloomCapacity, bloomRate)
+		err = s.IndexedInfohashes(ctx, func(ih models.Infohash) error {
+			f.Add(ih)
+			return nil
+		})
+	}
+	return f, err
+}
+
+// readBloomFilter reads the snapshot file, returning nil without one
+func readBloomFilter() *bloom.Filter {
+	if bloomFile == "" {
+		return nil
+	}
+	fh, err := os.Open(bloomFile)
+	if err != nil {
+		return nil
+	}
+	defer fh.Close()
+	f := bloom.New(bloomCapacity, bloomRate)
+	if _, err = f.ReadFrom(fh); err != nil {
+		log.Warn("failed to load bloom filter", "file", bloomFile, "error", err)
+		return nil
+	}
+	log.Debug("bloom filter loaded", "file", bloomFile)
+	return f
+}
+
+// snapshotBloomFilter periodically writes the filter to the snapshot file
+func snapshotBloomFilter() {
+	for range time.Tick(bloomInterval) {
+		if err := writeBloomFilter(); err != nil {
+			log.Error("failed to snapshot bloom filter", "error", err)
+			continue
+		}
+		log.Debug("bloom filter saved", "file", bloomFile, "count", indexed.Count())
+	}
+}
+
+// writeBloomFilter writes to a temporary file first so a crash does not
+// leave a truncated snapshot
+func writeBloomFilter() error {
+	tmp := bloomFile + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = indexed.WriteTo(fh); err != nil {
+		fh.Close()
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bloomFile)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// HTTP vars
+var (
+	httpAddress string
+	noHTTP      bool
+	started     = time.Now()
+)
+
+// Default number of clients in the distribution report
+const clientsLimit = 50
+
+// similarLimit is the default number of similar torrents
+const similarLimit = 10
+
+// httpStore is used by the HTTP handlers
+type httpStore interface {
+	models.ClientStore
+	models.MetadataStore
+	models.SearchStore
+}
+
+// torrentResult is a torrent in JSON responses
+type torrentResult struct {
+	*models.Torrent
+	Magnet string `json:"magnet"`
+}
+
+// similarResult is a torrent with its similarity to another
+type similarResult struct {
+	torrentResult
+	Similarity float64 `json:"similarity"`
+}
+
+// searchResults are a page of torrents, with the facets of every match when
+// requested
+type searchResults struct {
+	Torrents  []torrentResult `json:"torrents"`
+	Next      string          `json:"next,omitempty"`
+	Total     int             `json:"total"`
+	Estimated bool            `json:"total_estimated,omitempty"`
+	Facets    *models.Facets  `json:"facets,omitempty"`
+}
+
+// newTorrentResults adds magnet URIs with the trackers to torrents
+func newTorrentResults(torrents []*models.Torrent, trs []string) []torrentResult {
+	out := make([]torrentResult, len(torrents))
+	for i, t := range torrents {
+		out[i] = torrentResult{Torrent: t, Magnet: t.Magnet(trs)}
+	}
+	return out
+}
+
+// requestTrackers returns the 'tr' parameters, or the configured trackers
+func requestTrackers(r *http.Request) []string {
+	if trs := r.URL.Query()["tr"]; len(trs) > 0 {
+		return trs
+	}
+	return splitTrackers(trackers)
+}
+
+func startHTTP(s httpStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/clients", clientsHandler(s))
+	mux.HandleFunc("/search", searchHandler(s))
+	mux.HandleFunc("/torrents/", torrentHandler(s))
+
+	log.Info("HTTP listening", "address", httpAddress)
+	if err := http.ListenAndServe(httpAddress, mux); err != nil {
+		log.Error("HTTP server failed", "error", err)
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"version":     version,
+		"uptime":      time.Since(started).String(),
+		"indexed":     indexed.Count(),
+		"maintenance": &maintenance,
+		"transports":  btMetrics.Snapshot(),
+	})
+}
+
+// clientsHandler reports the distribution of peer clients
+func clientsHandler(cs models.ClientStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := clientsLimit
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= models.MaxPageSize {
+			limit = l
+		}
+		counts, err := cs.ClientCounts(r.Context(), limit)
+		if err != nil {
+			log.Error("failed to count clients", "error", err)
+			http.Error(w, "failed to count clients", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, counts)
+	}
+}
+
+// searchHandler searches torrents with the query language in 'q' or by
+// 'tag', results include magnet URIs with any 'tr' parameters as trackers.
+// Queries are ordered by relevance by default, and 'mode=fuzzy' matches
+// words approximately. Pages have up to 'limit' torrents and the next is
+// requested with the 'cursor' from the 'next' of the last. With 'collapse'
+// set duplicates are returned once with their number of variants. With
+// 'facets' set the facets of all the matches are counted.
+func searchHandler(s models.SearchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		order, err := models.ParseOrdering(params.Get("order"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if params.Get("order") == "" && params.Get("q") != "" {
+			order = models.OrderRelevance
+		}
+		switch mode := params.Get("mode"); mode {
+		case "":
+		case "exact", "fuzzy":
+			if params.Get("q") != "" {
+				params.Set("q", params.Get("q")+" mode:"+mode)
+			}
+		default:
+			http.Error(w, "mode must be exact or fuzzy", http.StatusBadRequest)
+			return
+		}
+		if _, err = models.ParseQuery(params.Get("q")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page := models.Page{
+			Order:    order,
+			Cursor:   params.Get("cursor"),
+			Collapse: params.Get("collapse") != "",
+		}
+		if l := params.Get("limit"); l != "" {
+			page.Size, err = strconv.Atoi(l)
+			if err != nil || page.Size < 1 || page.Size > models.MaxPageSize {
+				http.Error(w, fmt.Sprintf("limit must be from 1 to %d", models.MaxPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var results *models.Results
+		switch {
+		case params.Get("q") != "":
+			results, err = s.TorrentsByName(r.Context(), params.Get("q"), page)
+		case params.Get("tag") != "":
+			results, err = s.TorrentsByTag(r.Context(), params.Get("tag"), page)
+		default:
+			http.Error(w, "missing q or tag", http.StatusBadRequest)
+			return
+		}
+		if err == models.ErrInvalidCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Error("failed to search torrents", "error", err)
+			http.Error(w, "failed to search torrents", http.StatusInternalServerError)
+			return
+		}
+		out := searchResults{
+			Torrents:  newTorrentResults(results.Torrents, requestTrackers(r)),
+			Next:      results.Next,
+			Total:     results.Total,
+			Estimated: results.Estimated,
+		}
+		if params.Get("facets") == "" {
+			writeJSON(w, out)
+			return
+		}
+
+		query := params.Get("q")
+		if query == "" {
+			query = `tag:"` + params.Get("tag") + `"`
+		}
+		if out.Facets, err = s.TorrentFacets(r.Context(), query); err != nil {
+			log.Error("failed to count facets", "error", err)
+			http.Error(w, "failed to count facets", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, out)
+	}
+}
+
+// torrentHandler serves /torrents/<infohash> as JSON,
+// /torrents/<infohash>.torrent as a torrent file and similar torrents from
+// /torrents/<infohash>/similar
+func torrentHandler(s httpStore) http.HandlerFunc {
+	fileHandler := torrentFileHandler(s)
+	similar := similarHandler(s)
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/torrents/")
+		if strings.HasSuffix(name, ".torrent") {
+			fileHandler(w, r)
+			return
+		}
+		if strings.HasSuffix(name, "/similar") {
+			similar(w, r)
+			return
+		}
+		ih, err := models.InfohashFromString(name)
+		if err != nil {
+			http.Error(w, "invalid infohash", http.StatusBadRequest)
+			return
+		}
+		t, err := s.TorrentByHash(r.Context(), *ih)
+		if err == models.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get torrent", "infohash", ih, "error", err)
+			http.Error(w, "failed to get torrent", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, torrentResult{Torrent: t, Magnet: t.Magnet(requestTrackers(r))})
+	}
+}
+
+// similarHandler serves /torrents/<infohash>/similar, with up to 'limit'
+// torrents
+func similarHandler(s models.SearchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/torrents/")
+		ih, err := models.InfohashFromString(strings.TrimSuffix(name, "/similar"))
+		if err != nil {
+			http.Error(w, "invalid infohash", http.StatusBadRequest)
+			return
+		}
+		limit := similarLimit
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= models.MaxPageSize {
+			limit = l
+		}
+		similar, err := s.SimilarTorrents(r.Context(), *ih, limit)
+		if err == models.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Error("failed to find similar torrents", "infohash", ih, "error", err)
+			http.Error(w, "failed to find similar torrents", http.StatusInternalServerError)
+			return
+		}
+		trs := requestTrackers(r)
+		out := make([]similarResult, len(similar))
+		for i, t := range similar {
+			out[i] = similarResult{
+				torrentResult: torrentResult{Torrent: t.Torrent, Magnet: t.Magnet(trs)},
+				Similarity:    t.Similarity,
+			}
+		}
+		writeJSON(w, out)
+	}
+}
+
+// torrentFileHandler serves /torrents/<infohash>.torrent, trackers may be
+// given with 'tr' parameters
+func torrentFileHandler(s models.MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/torrents/")
+		if !strings.HasSuffix(name, ".torrent") {
+			http.NotFound(w, r)
+			return
+		}
+		ih, err := models.InfohashFromString(strings.TrimSuffix(name, ".torrent"))
+		if err != nil {
+			http.Error(w, "invalid infohash", http.StatusBadRequest)
+			return
+		}
+
+		t, b, err := loadTorrentFile(r.Context(), s, *ih, requestTrackers(r))
+		if err == models.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Error("failed to build torrent file", "infohash", ih, "error", err)
+			http.Error(w, "failed to build torrent file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": t.TorrentFileName(),
+		}))
+		w.Write(b)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("failed to encode JSON", "error", err)
+	}
+}
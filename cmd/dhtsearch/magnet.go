@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/dht"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// magnetStore is used to queue magnets for fetching
+type magnetStore interface {
+	models.PeerStore
+	models.MetadataStore
+}
+
+// queueMagnet implements the magnet command, finding peers for a magnet's
+// infohash on the DHT and saving them so the metadata is fetched by the next
+// crawler run on the same store
+func queueMagnet(s magnetStore, args []string) error {
+	fs := flag.NewFlagSet("magnet", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "time spent looking for peers")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s -dsn <dsn> [options] magnet [-timeout duration] <uri>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("missing magnet URI")
+	}
+
+	ctx := context.Background()
+	m, err := models.ParseMagnet(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if t, err := s.TorrentByHash(ctx, m.Infohash); err == nil {
+		fmt.Printf("%s already indexed as %q\n", m.Infohash, t.Name)
+		return nil
+	}
+
+	var peers []models.Peer
+	for _, pe := range m.Peers {
+		addr, err := net.ResolveUDPAddr("udp", pe)
+		if err != nil {
+			log.Warn("invalid magnet peer", "peer", pe, "error", err)
+			continue
+		}
+		peers = append(peers, models.Peer{Addr: addr, Infohash: m.Infohash})
+	}
+
+	node, err := dht.NewNode(
+		dht.SetLogger(log.Named("dht")),
+		dht.SetPort(port),
+		dht.SetIPv6(ipv6),
+	)
+	if err != nil {
+		return err
+	}
+	go node.Run()
+	defer node.Close()
+
+	found, err := node.GetPeers(m.Infohash, *timeout)
+	if err != nil {
+		return err
+	}
+	peers = append(peers, found...)
+
+	saved := 0
+	for _, p := range peers {
+		if err = s.SavePeer(ctx, &p); err != nil {
+			log.Error("failed to save peer", "peer", p, "error", err)
+			continue
+		}
+		saved++
+	}
+	if saved == 0 {
+		return fmt.Errorf("no peers found for %s", m.Infohash)
+	}
+	fmt.Printf("%s queued with %d peers\n", m.Infohash, saved)
+	return nil
+}
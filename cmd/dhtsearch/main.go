@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 	"unicode"
 
 	"github.com/hashicorp/golang-lru"
+	"src.userspace.com.au/dhtsearch/bloom"
 	"src.userspace.com.au/dhtsearch/bt"
 	"src.userspace.com.au/dhtsearch/db"
 	"src.userspace.com.au/dhtsearch/dht"
@@ -39,13 +43,28 @@ var (
 	btNodes  int
 	tagREs   map[string]*regexp.Regexp
 	skipTags string
+	// Peer connection encryption policy
+	encryption string
+	// Peer connection transport strategy
+	transport string
+	btMetrics = new(bt.Metrics)
+	// Peer clients to refuse
+	blockClients string
 )
 
+// Torrent fetch retries
+var fetchBackoff models.Backoff
+
 // Store vars
 var (
 	dsn           string
 	ihBlacklist   *lru.ARCCache
 	peerBlacklist *lru.ARCCache
+	indexed       *bloom.Filter
+	bloomFile     string
+	bloomInterval time.Duration
+	writeBatch    int
+	writeInterval time.Duration
 )
 
 func main() {
@@ -57,8 +76,26 @@ func main() {
 
 	flag.IntVar(&btNodes, "bt-nodes", 3, "number of BT nodes to start")
 	flag.StringVar(&skipTags, "skip-tags", "xxx", "tags of torrents to skip")
+	flag.StringVar(&encryption, "encryption", "prefer", "peer connection encryption: plaintext, prefer or require")
+	flag.StringVar(&blockClients, "block-clients", "", "comma separated peer clients to refuse metadata from")
+	flag.StringVar(&transport, "transport", "tcp-first", "peer connection transports: tcp, tcp-first, utp-first or utp")
+
+	flag.StringVar(&dsn, "dsn", "memory:", "database DSN")
+	flag.StringVar(&bloomFile, "bloom-file", "", "snapshot file for the indexed infohash filter")
+	flag.DurationVar(&bloomInterval, "bloom-interval", 10*time.Minute, "interval between filter snapshots")
+	flag.IntVar(&writeBatch, "write-batch", 256, "most peer and torrent writes per transaction")
+	flag.DurationVar(&writeInterval, "write-interval", time.Second, "longest delay before queued writes are flushed")
+
+	flag.DurationVar(&maintenanceInterval, "maintenance-interval", time.Hour, "interval between store maintenance runs")
+	flag.DurationVar(&peerMaxAge, "peer-max-age", 7*24*time.Hour, "remove peers not seen within this period")
+	flag.IntVar(&fetchBackoff.MaxAttempts, "max-fetch-attempts", 5, "give up on infohashes after this many failed metadata fetches")
+	flag.DurationVar(&fetchBackoff.Base, "fetch-backoff", time.Minute, "delay before retrying a failed metadata fetch")
+	flag.DurationVar(&fetchBackoff.Max, "fetch-backoff-max", 6*time.Hour, "maximum delay between metadata fetch retries")
+
+	flag.StringVar(&trackers, "trackers", "", "comma separated trackers added to exported torrent files")
 
-	flag.StringVar(&dsn, "dsn", "file:dhtsearch.db?cache=shared&mode=memory", "database DSN")
+	flag.StringVar(&httpAddress, "http-address", "localhost:6880", "HTTP listen address:port")
+	flag.BoolVar(&noHTTP, "no-http", false, "no HTTP service")
 
 	flag.BoolVar(&showVersion, "v", false, "show version")
 
@@ -81,13 +118,59 @@ func main() {
 	log.Info("version", version)
 	log.Debug("debugging")
 
-	store, err := db.NewStore(dsn)
+	// Opening the store would apply migrations
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			log.Error("failed to migrate", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	store, err := db.Open(dsn)
 	if err != nil {
 		log.Error("failed to connect store", "error", err)
 		os.Exit(1)
 	}
 	defer store.Close()
 
+	switch flag.Arg(0) {
+	case "torrent":
+		if err = exportTorrent(store, flag.Args()[1:]); err != nil {
+			log.Error("failed to export torrent", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "magnet":
+		if err = queueMagnet(store, flag.Args()[1:]); err != nil {
+			log.Error("failed to queue magnet", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "":
+	default:
+		log.Error("unknown command", "command", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	// Batch the peer and announce writes of the crawler, flushing them on
+	// shutdown. Torrents are saved directly so a failed save is seen before
+	// the infohash is marked as indexed.
+	queue, err := db.NewWriteQueue(
+		store,
+		db.SetBatchSize(writeBatch),
+		db.SetFlushInterval(writeInterval),
+		db.SetOnWriteError(func(err error) {
+			log.Error("failed to write", "error", err)
+		}),
+	)
+	if err != nil {
+		log.Error("failed to create write queue", "error", err)
+		os.Exit(1)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
 	createTagRegexps()
 
 	ihBlacklist, err = lru.NewARC(1000)
@@ -101,18 +184,46 @@ func main() {
 		os.Exit(1)
 	}
 	// TODO read in existing blacklist
-	// TODO populate bloom filter
 
-	go startDHTNodes(store)
+	indexed, err = loadBloomFilter(store)
+	if err != nil {
+		log.Error("failed to populate bloom filter", "error", err)
+		os.Exit(1)
+	}
+	log.Info("bloom filter populated", "count", indexed.Count())
+	if bloomFile != "" {
+		go snapshotBloomFilter()
+	}
 
-	go startBTWorkers(store)
+	go startDHTNodes(queue)
+
+	go startBTWorkers(store, queue, store)
 
 	go processPendingPeers(store)
 
+	go runMaintenance(store)
+
+	if !noHTTP {
+		go startHTTP(store)
+	}
+
 	for {
 		select {
 		case <-time.After(300 * time.Second):
 			log.Info("---- mark ----")
+		case sig := <-sigs:
+			log.Info("shutting down", "signal", sig)
+			if err = queue.Close(); err != nil {
+				log.Error("failed to flush writes", "error", err)
+				os.Exit(1)
+			}
+			if bloomFile != "" {
+				if err = writeBloomFilter(); err != nil {
+					log.Error("failed to snapshot bloom filter", "error", err)
+					os.Exit(1)
+				}
+			}
+			os.Exit(0)
 		}
 	}
 }
@@ -132,14 +243,21 @@ func startDHTNodes(s models.PeerStore) {
 					log.Debug("ignoring blacklisted infohash", "peer", p)
 					return
 				}
+				if indexed.Test(p.Infohash) {
+					// Only count the announce
+					if err := s.SaveAnnounce(context.Background(), &p); err != nil {
+						log.Error("failed to save announce", "error", err)
+					}
+					return
+				}
 				//log.Debug("peer announce", "peer", p)
-				err := s.SavePeer(&p)
+				err := s.SavePeer(context.Background(), &p)
 				if err != nil {
 					log.Error("failed to save peer", "error", err)
 				}
 			}),
 			dht.SetOnBadPeer(func(p models.Peer) {
-				err := s.RemovePeer(&p)
+				err := s.RemovePeer(context.Background(), &p)
 				if err != nil {
 					log.Error("failed to remove peer", "error", err)
 				}
@@ -156,13 +274,26 @@ func startDHTNodes(s models.PeerStore) {
 
 func processPendingPeers(s models.InfohashStore) {
 	log.Debug("processing pending peers")
+	// Wait longer each time nothing is pending, up to the fetch backoff
+	idle := time.Second
 	for {
-		peers, err := s.PendingInfohashes(10)
+		peers, err := s.PendingInfohashes(context.Background(), 10)
 		if err != nil {
 			log.Warn("failed to get pending peer", "error", err)
 			time.Sleep(time.Second * 1)
 			continue
 		}
+		if len(peers) == 0 {
+			time.Sleep(idle)
+			if idle *= 2; idle > fetchBackoff.Base {
+				idle = fetchBackoff.Base
+			}
+			if idle < time.Second {
+				idle = time.Second
+			}
+			continue
+		}
+		idle = time.Second
 		for _, p := range peers {
 			log.Debug("pending peer retrieved", "peer", *p)
 			select {
@@ -174,7 +305,8 @@ func processPendingPeers(s models.InfohashStore) {
 	}
 }
 
-func startBTWorkers(s models.TorrentStore) {
+func startBTWorkers(s models.TorrentStore, ps models.PeerStore, is models.InfohashStore) {
+	ctx := context.Background()
 	log.Debug("starting bittorrent workers")
 	pool = make(chan chan models.Peer)
 	torrents = make(chan models.Torrent)
@@ -187,31 +319,73 @@ func startBTWorkers(s models.TorrentStore) {
 				if skipTag == tg {
 					log.Debug("skipping torrent", "infohash", t.Infohash, "tags", tags)
 					ihBlacklist.Add(t.Infohash.String(), true)
-					s.RemoveTorrent(&t)
+					s.RemoveTorrent(ctx, &t)
 					return
 				}
 			}
 		}
 		t.Tags = tags
 		log.Debug("torrent tagged", "infohash", t.Infohash, "tags", tags)
-		err := s.SaveTorrent(&t)
+		err := s.SaveTorrent(ctx, &t)
 		if err != nil {
 			log.Error("failed to save torrent", "error", err)
 			ihBlacklist.Add(t.Infohash.String(), true)
-			s.RemoveTorrent(&t)
+			s.RemoveTorrent(ctx, &t)
+			return
+		}
+		indexed.Add(t.Infohash)
+		if t.Hybrid {
+			// Also announced by the truncated v2 infohash
+			indexed.Add(t.InfohashV2.Truncated())
 		}
 		log.Info("torrent added", "name", t.Name, "size", t.Size, "tags", t.Tags)
 	}
 
+	onFetchFailed := func(p models.Peer, reason error) {
+		err := s.FetchFailed(ctx, &p, reason, fetchBackoff)
+		if err != nil {
+			log.Error("failed to record fetch attempt", "peer", p, "error", err)
+		}
+	}
+
+	onPeerClient := func(p models.Peer) {
+		if err := ps.SavePeerClient(ctx, &p); err != nil {
+			log.Error("failed to save peer client", "peer", p, "error", err)
+		}
+	}
+
 	onBadPeer := func(p models.Peer) {
 		log.Debug("removing peer", "peer", p)
-		err := s.RemovePeer(&p)
+		err := ps.RemovePeer(ctx, &p)
 		if err != nil {
 			log.Error("failed to remove peer", "peer", p, "error", err)
 		}
 		peerBlacklist.Add(p.Addr.String(), true)
 	}
 
+	peerLookup := func(ih models.Infohash) ([]models.Peer, error) {
+		peers, err := is.PeersByInfohash(ctx, ih, bt.MaxFetchPeers)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]models.Peer, len(peers))
+		for i, p := range peers {
+			out[i] = *p
+		}
+		return out, nil
+	}
+
+	policy, err := bt.ParseEncryptionPolicy(encryption)
+	if err != nil {
+		log.Error("failed to create bt workers", "error", err)
+		return
+	}
+	strategy, err := bt.ParseTransportStrategy(transport)
+	if err != nil {
+		log.Error("failed to create bt workers", "error", err)
+		return
+	}
+
 	for i := 0; i < btNodes; i++ {
 		w, err := bt.NewWorker(
 			pool,
@@ -220,6 +394,13 @@ func startBTWorkers(s models.TorrentStore) {
 			bt.SetIPv6(ipv6),
 			bt.SetOnNewTorrent(onNewTorrent),
 			bt.SetOnBadPeer(onBadPeer),
+			bt.SetOnFetchFailed(onFetchFailed),
+			bt.SetOnPeerClient(onPeerClient),
+			bt.SetBlockedClients(strings.Split(blockClients, ",")),
+			bt.SetPeerLookup(peerLookup),
+			bt.SetEncryption(policy),
+			bt.SetTransport(strategy),
+			bt.SetMetrics(btMetrics),
 		)
 		if err != nil {
 			log.Error("failed to create bt worker", "error", err)
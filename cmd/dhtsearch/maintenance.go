@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// How long hourly announce counters are kept
+const announceBucketAge = 7 * 24 * time.Hour
+
+// How long the IPs announcing a torrent are kept, seen_ips counts those
+// announcing within this age
+const announceIPAge = 30 * 24 * time.Hour
+
+// How many torrents saved before clustering are clustered each run
+const clusterBatchSize = 1000
+
+// Maintenance vars
+var (
+	maintenanceInterval time.Duration
+	peerMaxAge          time.Duration
+	maintenance         maintenanceStats
+)
+
+type maintenanceStats struct {
+	Runs           int       `json:"runs"`
+	LastRun        time.Time `json:"last_run"`
+	LastDuration   string    `json:"last_duration"`
+	PeersRemoved   int64     `json:"peers_removed"`
+	OrphansRemoved int64     `json:"orphans_removed"`
+	BucketsRemoved int64     `json:"buckets_removed"`
+	IPsRemoved     int64     `json:"ips_removed"`
+	Clustered      int64     `json:"clustered"`
+	LastError      string    `json:"last_error,omitempty"`
+	sync.Mutex
+}
+
+// runMaintenance periodically prunes the store
+func runMaintenance(s models.MaintenanceStore) {
+	for range time.Tick(maintenanceInterval) {
+		maintain(s)
+	}
+}
+
+func maintain(s models.MaintenanceStore) {
+	ctx := context.Background()
+	start := time.Now()
+	log.Debug("starting maintenance")
+
+	var peers, orphans, buckets, ips, clustered int64
+	var err, lastErr error
+
+	// Each step is independent, keep going on errors
+	fail := func(step string, err error) {
+		log.Error("maintenance failed", "step", step, "error", err)
+		lastErr = err
+	}
+
+	if peers, err = s.RemoveStalePeers(ctx, start.Add(-peerMaxAge)); err != nil {
+		fail("peers", err)
+	}
+	if orphans, err = s.RemoveOrphans(ctx, start.Add(-peerMaxAge)); err != nil {
+		fail("orphans", err)
+	}
+	if buckets, err = s.RemoveAnnounceBuckets(ctx, "hour", start.Add(-announceBucketAge)); err != nil {
+		fail("buckets", err)
+	}
+	if ips, err = s.RemoveAnnounceIPs(ctx, start.Add(-announceIPAge)); err != nil {
+		fail("ips", err)
+	}
+	if clustered, err = s.ClusterTorrents(ctx, clusterBatchSize); err != nil {
+		fail("clusters", err)
+	}
+	if err = s.Optimize(ctx); err != nil {
+		fail("optimize", err)
+	}
+
+	duration := time.Since(start)
+	log.Info("maintenance complete",
+		"peers", peers,
+		"orphans", orphans,
+		"buckets", buckets,
+		"ips", ips,
+		"clustered", clustered,
+		"duration", duration,
+	)
+
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.Runs++
+	maintenance.LastRun = start
+	maintenance.LastDuration = duration.String()
+	maintenance.PeersRemoved += peers
+	maintenance.OrphansRemoved += orphans
+	maintenance.BucketsRemoved += buckets
+	maintenance.IPsRemoved += ips
+	maintenance.Clustered += clustered
+	maintenance.LastError = ""
+	if lastErr != nil {
+		maintenance.LastError = lastErr.Error()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"src.userspace.com.au/dhtsearch/db"
+)
+
+// runMigrate implements the migrate command, applying pending schema
+// migrations or listing them with -dry-run
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s -dsn <dsn> [options] migrate [-dry-run]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	migrations, err := db.Migrate(context.Background(), dsn, *dryRun)
+	action := "applied"
+	if *dryRun {
+		action = "pending"
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %d %s\n", action, m.Version, m.Name)
+	}
+	if err == nil && len(migrations) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	return err
+}
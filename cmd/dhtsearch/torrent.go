@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// Trackers added to exported torrent files
+var trackers string
+
+// splitTrackers parses a comma separated tracker list
+func splitTrackers(s string) []string {
+	var out []string
+	for _, tr := range strings.Split(s, ",") {
+		if tr = strings.TrimSpace(tr); tr != "" {
+			out = append(out, tr)
+		}
+	}
+	return out
+}
+
+// loadTorrentFile builds the .torrent file for an infohash
+func loadTorrentFile(ctx context.Context, s models.MetadataStore, ih models.Infohash, trs []string) (*models.Torrent, []byte, error) {
+	t, err := s.TorrentByHash(ctx, ih)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Metadata, err = s.TorrentMetadata(ctx, ih); err != nil {
+		return nil, nil, err
+	}
+	b, err := t.TorrentFile(trs)
+	return t, b, err
+}
+
+// exportTorrent implements the torrent command, writing a .torrent file
+func exportTorrent(s models.MetadataStore, args []string) error {
+	fs := flag.NewFlagSet("torrent", flag.ExitOnError)
+	out := fs.String("o", "", "output file, '-' for stdout (default <name>.torrent)")
+	trs := fs.String("trackers", trackers, "comma separated trackers to include")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options] torrent [-o file] [-trackers list] <infohash>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("missing infohash")
+	}
+
+	ih, err := models.InfohashFromString(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	t, b, err := loadTorrentFile(context.Background(), s, *ih, splitTrackers(*trs))
+	if err != nil {
+		return err
+	}
+
+	switch *out {
+	case "-":
+		_, err = os.Stdout.Write(b)
+		return err
+	case "":
+		*out = t.TorrentFileName()
+	}
+	if err = ioutil.WriteFile(*out, b, 0644); err != nil {
+		return err
+	}
+	fmt.Println(*out)
+	return nil
+}
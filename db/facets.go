@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// facetsStatement counts the facets of the torrents selected by matched,
+// which must select id, name, size and first_seen. Each row is a facet, a
+// value and a count, for models.Facets.Add. like is a case insensitive LIKE
+// operator and month formats a time as YYYY-MM.
+func facetsStatement(matched, like string, month func(string) string) string {
+	return `with matched as (
+		` + matched + `
+	)
+	select 'total', '', count(*) from matched
+	union all
+	select * from (
+		select 'tag', ta.name, count(*) as n from matched m
+		inner join tags_torrents tt on tt.torrent_id = m.id
+		inner join tags ta on tt.tag_id = ta.id
+		group by ta.name
+		order by n desc, ta.name
+		limit ` + fmt.Sprint(models.FacetTagsLimit) + `
+	) tags
+	union all
+	select 'size', ` + sizeBucketCase("m.size") + `, count(*)
+	from matched m group by 2
+	union all
+	select 'extension', category, count(distinct id) from (
+		select m.id, ` + extensionCategoryCase("f.path", like) + ` as category
+		from matched m inner join files f on f.torrent_id = m.id
+		union all
+		select m.id, ` + extensionCategoryCase("m.name", like) + `
+		from matched m
+		where not exists (select 1 from files f where f.torrent_id = m.id)
+	) paths
+	where category is not null group by category
+	union all
+	select 'first_seen', ` + month("m.first_seen") + `, count(*)
+	from matched m where m.first_seen is not null group by 2`
+}
+
+// sizeBucketCase names the models.SizeBuckets of a column
+func sizeBucketCase(col string) string {
+	var b strings.Builder
+	b.WriteString("case")
+	last := len(models.SizeBuckets) - 1
+	for _, sb := range models.SizeBuckets[:last] {
+		fmt.Fprintf(&b, " when %s < %d then '%s'", col, sb.Max, sb.Name)
+	}
+	fmt.Fprintf(&b, " else '%s' end", models.SizeBuckets[last].Name)
+	return b.String()
+}
+
+// extensionCategoryCase names the models.ExtensionCategories of a column,
+// or is NULL
+func extensionCategoryCase(col, like string) string {
+	var b strings.Builder
+	b.WriteString("case")
+	for _, c := range models.ExtensionCategories {
+		conds := make([]string, len(c.Exts))
+		for i, ext := range c.Exts {
+			conds[i] = fmt.Sprintf("%s %s '%%.%s'", col, like, ext)
+		}
+		fmt.Fprintf(&b, " when %s then '%s'", strings.Join(conds, " or "), c.Name)
+	}
+	b.WriteString(" end")
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"strings"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// Highlight markers, torrents with control characters in their names are
+// never saved
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+// maxHighlights is the most files highlighted for each torrent
+const maxHighlights = 5
+
+// parseHighlight removes the markers from text, returning it with the
+// offsets of the marked words
+func parseHighlight(marked string) (models.Highlight, bool) {
+	var h models.Highlight
+	var b strings.Builder
+	start := -1
+	for len(marked) > 0 {
+		i := strings.IndexAny(marked, highlightStart+highlightEnd)
+		if i < 0 {
+			b.WriteString(marked)
+			break
+		}
+		b.WriteString(marked[:i])
+		if marked[i:i+1] == highlightStart {
+			start = b.Len()
+		} else if start >= 0 {
+			h.Matches = append(h.Matches, [2]int{start, b.Len()})
+			start = -1
+		}
+		marked = marked[i+1:]
+	}
+	h.Path = b.String()
+	return h, len(h.Matches) > 0
+}
+
+// fileHighlights returns the marked paths from newline separated text
+func fileHighlights(marked string) []models.Highlight {
+	var out []models.Highlight
+	for _, line := range strings.Split(marked, "\n") {
+		if h, ok := parseHighlight(line); ok {
+			out = append(out, h)
+			if len(out) == maxHighlights {
+				break
+			}
+		}
+	}
+	return out
+}
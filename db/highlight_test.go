@@ -0,0 +1,22 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+func TestFileHighlights(t *testing.T) {
+	marked := "a/\x02beach\x03.jpg\nb/city.jpg\n\x02Beach\x03 \x02day\x03/x"
+	expected := []models.Highlight{
+		{Path: "a/beach.jpg", Matches: [][2]int{{2, 7}}},
+		{Path: "Beach day/x", Matches: [][2]int{{0, 5}, {6, 9}}},
+	}
+	if h := fileHighlights(marked); !reflect.DeepEqual(h, expected) {
+		t.Errorf("fileHighlights => %v, expected %v", h, expected)
+	}
+	if h := fileHighlights(""); h != nil {
+		t.Errorf("fileHighlights => %v, expected none", h)
+	}
+}
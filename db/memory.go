@@ -0,0 +1,1093 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// MemoryStore keeps everything in memory. It needs neither cgo nor a
+// database server and is lost on exit.
+type MemoryStore struct {
+	lock sync.RWMutex
+	// torrents are keyed by infohash, aliases by full and truncated v2
+	// infohashes of indexed torrents
+	torrents map[string]*memoryTorrent
+	aliases  map[string]*memoryTorrent
+	peers    map[string]*memoryPeer
+	tags     map[string]int
+	clusters map[string]int
+	lastID   int
+}
+
+type memoryTorrent struct {
+	models.Torrent
+	metadata []byte
+	// ips are the announcing IPs and when each last announced
+	ips           map[string]time.Time
+	peers         map[string]int
+	fetchAttempts int
+	fetchError    string
+	fetchNext     time.Time
+	unfetchable   bool
+	// buckets are announce counts by period and start of bucket
+	buckets map[string]map[time.Time]int
+}
+
+type memoryPeer struct {
+	models.Peer
+	id        int
+	hasClient bool
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		torrents: make(map[string]*memoryTorrent),
+		aliases:  make(map[string]*memoryTorrent),
+		peers:    make(map[string]*memoryPeer),
+		tags:     make(map[string]int),
+		clusters: make(map[string]int),
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// lookup finds a torrent by infohash, including indexed v2 infohashes
+func (s *MemoryStore) lookup(ih models.Infohash) *memoryTorrent {
+	if t, ok := s.torrents[string(ih)]; ok {
+		return t
+	}
+	return s.aliases[string(ih)]
+}
+
+// PendingInfohashes gets the next pending infohashes from the store, each
+// with the least attempted peer. The infohashes are leased so they are not
+// returned again while being fetched.
+func (s *MemoryStore) PendingInfohashes(ctx context.Context, n int) ([]*models.Peer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var pending []*memoryTorrent
+	for _, t := range s.torrents {
+		if t.Name != "" || t.unfetchable || len(t.peers) == 0 {
+			continue
+		}
+		if !t.fetchNext.IsZero() && t.fetchNext.After(now) {
+			continue
+		}
+		pending = append(pending, t)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.fetchAttempts != b.fetchAttempts {
+			return a.fetchAttempts < b.fetchAttempts
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	if len(pending) > n {
+		pending = pending[:n]
+	}
+
+	peers := make([]*models.Peer, 0, len(pending))
+	for _, t := range pending {
+		best := s.sortedPeers(t)[0]
+		peers = append(peers, &models.Peer{Addr: best.Addr, Infohash: t.Infohash})
+		t.fetchNext = now.Add(fetchLease)
+	}
+	return peers, nil
+}
+
+// sortedPeers returns the peers of a torrent, least attempted and most
+// recent first
+func (s *MemoryStore) sortedPeers(t *memoryTorrent) []*memoryPeer {
+	out := make([]*memoryPeer, 0, len(t.peers))
+	for addr := range t.peers {
+		out = append(out, s.peers[addr])
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if t.peers[a.Addr.String()] != t.peers[b.Addr.String()] {
+			return t.peers[a.Addr.String()] < t.peers[b.Addr.String()]
+		}
+		return a.id > b.id
+	})
+	return out
+}
+
+// PeersByInfohash returns up to n peers for an infohash, least attempted
+// first
+func (s *MemoryStore) PeersByInfohash(ctx context.Context, ih models.Infohash, n int) ([]*models.Peer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t, ok := s.torrents[string(ih)]
+	if !ok {
+		return nil, nil
+	}
+	var peers []*models.Peer
+	for _, p := range s.sortedPeers(t) {
+		if len(peers) == n {
+			break
+		}
+		peers = append(peers, &models.Peer{Addr: p.Addr, Infohash: ih})
+	}
+	return peers, nil
+}
+
+// SaveTorrent implements torrentStore
+func (s *MemoryStore) SaveTorrent(ctx context.Context, t *models.Torrent) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("saveTorrent: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	mt, ok := s.torrents[string(t.Infohash)]
+	if !ok {
+		mt = newMemoryTorrent(s.nextID(), t.Infohash, now)
+		s.torrents[string(t.Infohash)] = mt
+	}
+
+	if t.InfohashV2 != nil {
+		alias := t.InfohashV2.Truncated()
+		// Hybrids may also have been announced by their truncated v2 infohash
+		if at, ok := s.torrents[string(alias)]; ok && at != mt && t.Hybrid {
+			for addr, attempts := range at.peers {
+				if _, ok := mt.peers[addr]; !ok {
+					mt.peers[addr] = attempts
+				}
+			}
+			mt.Announces += at.Announces
+			delete(s.torrents, string(alias))
+		}
+		s.aliases[string(t.InfohashV2)] = mt
+		s.aliases[string(alias)] = mt
+	}
+
+	mt.Name = t.Name
+	mt.Size = t.Size
+	mt.PieceLength = t.PieceLength
+	mt.Pieces = t.Pieces
+	mt.Private = t.Private
+	mt.Source = t.Source
+	mt.MetaVersion = t.MetaVersion
+	mt.Hybrid = t.Hybrid
+	mt.InfohashV2 = append(models.Infohash(nil), t.InfohashV2...)
+	mt.Repaired = t.Repaired
+	mt.Updated = now
+
+	for _, tag := range t.Tags {
+		if _, ok := s.tags[tag]; !ok {
+			s.tags[tag] = s.nextID()
+		}
+		if !hasString(mt.Tags, tag) {
+			mt.Tags = append(mt.Tags, tag)
+		}
+	}
+
+	// Files are replaced
+	mt.Files = make([]models.File, len(t.Files))
+	for i, f := range t.Files {
+		f.ID = s.nextID()
+		f.TorrentID = mt.ID
+		mt.Files[i] = f
+	}
+	sort.Slice(mt.Files, func(i, j int) bool {
+		return mt.Files[i].Path < mt.Files[j].Path
+	})
+
+	fp := models.Fingerprint(t)
+	if _, ok := s.clusters[fp]; !ok {
+		s.clusters[fp] = s.nextID()
+	}
+	mt.ClusterID = s.clusters[fp]
+	t.ClusterID = mt.ClusterID
+
+	if len(t.Metadata) > 0 {
+		mt.metadata = append([]byte(nil), t.Metadata...)
+	}
+	return nil
+}
+
+func newMemoryTorrent(id int, ih models.Infohash, now time.Time) *memoryTorrent {
+	t := &memoryTorrent{
+		ips:     make(map[string]time.Time),
+		peers:   make(map[string]int),
+		buckets: make(map[string]map[time.Time]int),
+	}
+	t.ID = id
+	t.Infohash = append(models.Infohash(nil), ih...)
+	t.Created = now
+	t.Updated = now
+	t.MetaVersion = 1
+	return t
+}
+
+// TorrentMetadata returns the raw info dictionary for an infohash
+func (s *MemoryStore) TorrentMetadata(ctx context.Context, ih models.Infohash) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t := s.lookup(ih)
+	if t == nil || t.metadata == nil {
+		return nil, models.ErrNotFound
+	}
+	return append([]byte(nil), t.metadata...), nil
+}
+
+func (s *MemoryStore) RemoveTorrent(ctx context.Context, t *models.Torrent) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("removeTorrent: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeTorrent(s.torrents[string(t.Infohash)])
+	return nil
+}
+
+func (s *MemoryStore) removeTorrent(t *memoryTorrent) {
+	if t == nil {
+		return
+	}
+	delete(s.torrents, string(t.Infohash))
+	for k, at := range s.aliases {
+		if at == t {
+			delete(s.aliases, k)
+		}
+	}
+}
+
+// SavePeer implements torrentStore
+func (s *MemoryStore) SavePeer(ctx context.Context, p *models.Peer) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	mp := s.savePeer(p, now)
+
+	// Do not replace existing torrents, they may already have metadata
+	t := s.lookup(p.Infohash)
+	if t == nil {
+		t = newMemoryTorrent(s.nextID(), p.Infohash, now)
+		t.FirstSeen = now
+		s.torrents[string(p.Infohash)] = t
+	}
+	if _, ok := t.peers[mp.Addr.String()]; !ok {
+		t.peers[mp.Addr.String()] = 0
+	}
+	return s.saveAnnounce(t, p, now)
+}
+
+// savePeer adds or refreshes a peer by address
+func (s *MemoryStore) savePeer(p *models.Peer, now time.Time) *memoryPeer {
+	mp, ok := s.peers[p.Addr.String()]
+	if !ok {
+		mp = &memoryPeer{id: s.nextID()}
+		mp.Addr = p.Addr
+		mp.Created = now
+		s.peers[p.Addr.String()] = mp
+	}
+	mp.Updated = now
+	return mp
+}
+
+// SaveAnnounce records an announce for an existing torrent without queuing
+// the peer for a metadata fetch
+func (s *MemoryStore) SaveAnnounce(ctx context.Context, p *models.Peer) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("saveAnnounce: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := s.lookup(p.Infohash)
+	if t == nil {
+		return nil
+	}
+	return s.saveAnnounce(t, p, time.Now())
+}
+
+// saveAnnounce updates the announce counters for a torrent
+func (s *MemoryStore) saveAnnounce(t *memoryTorrent, p *models.Peer, now time.Time) error {
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return err
+	}
+	if _, ok := t.ips[host]; !ok {
+		t.SeenIPs++
+	}
+	t.ips[host] = now
+	t.Announces++
+	if t.FirstSeen.IsZero() {
+		t.FirstSeen = now
+	}
+	t.LastSeen = now
+
+	for period := range announcePeriods {
+		if t.buckets[period] == nil {
+			t.buckets[period] = make(map[time.Time]int)
+		}
+		t.buckets[period][announceBucket(period, now)]++
+	}
+	return nil
+}
+
+// announceBucket truncates a time to the start of its bucket in UTC
+func announceBucket(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func (s *MemoryStore) RemovePeer(ctx context.Context, p *models.Peer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removePeer(p.Addr.String())
+	return nil
+}
+
+func (s *MemoryStore) removePeer(addr string) {
+	delete(s.peers, addr)
+	for _, t := range s.torrents {
+		delete(t.peers, addr)
+	}
+}
+
+// SavePeerClient records the client fingerprint of a peer
+func (s *MemoryStore) SavePeerClient(ctx context.Context, p *models.Peer) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("savePeerClient: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mp := s.savePeer(p, time.Now())
+	mp.ID = append([]byte(nil), p.ID...)
+	mp.Client = p.Client
+	mp.Agent = p.Agent
+	mp.hasClient = true
+	return nil
+}
+
+// ClientCounts returns the number of peers seen running each client, most
+// popular first
+func (s *MemoryStore) ClientCounts(ctx context.Context, limit int) ([]models.ClientCount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make(map[string]int)
+	for _, p := range s.peers {
+		if !p.hasClient {
+			continue
+		}
+		name := p.Client.Name
+		if name == "" {
+			name = "unknown"
+		}
+		counts[name]++
+	}
+
+	out := make([]models.ClientCount, 0, len(counts))
+	for name, n := range counts {
+		out = append(out, models.ClientCount{Client: name, Peers: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Peers != out[j].Peers {
+			return out[i].Peers > out[j].Peers
+		}
+		return out[i].Client < out[j].Client
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// FetchFailed records a failed metadata fetch from a peer, scheduling the
+// next attempt or marking the infohash as unfetchable
+func (s *MemoryStore) FetchFailed(ctx context.Context, p *models.Peer, reason error, b models.Backoff) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("fetchFailed: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.torrents[string(p.Infohash)]
+	if !ok {
+		return nil
+	}
+	t.fetchAttempts++
+	t.fetchError = ""
+	if reason != nil {
+		t.fetchError = reason.Error()
+	}
+	t.fetchNext = time.Now().Add(b.Delay(t.fetchAttempts))
+	t.unfetchable = b.Exhausted(t.fetchAttempts)
+	if attempts, ok := t.peers[p.Addr.String()]; ok {
+		t.peers[p.Addr.String()] = attempts + 1
+	}
+	return nil
+}
+
+// RemoveStalePeers removes peers not seen since before
+func (s *MemoryStore) RemoveStalePeers(ctx context.Context, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("removeStalePeers: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int64
+	for addr, p := range s.peers {
+		if p.Updated.Before(before) {
+			s.removePeer(addr)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// RemoveOrphans removes infohashes without metadata that are either
+// unfetchable or have no peers left, and have not been announced since before
+func (s *MemoryStore) RemoveOrphans(ctx context.Context, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("removeOrphans: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int64
+	for _, t := range s.torrents {
+		if t.Name != "" || (!t.unfetchable && len(t.peers) > 0) {
+			continue
+		}
+		seen := t.LastSeen
+		if seen.IsZero() {
+			seen = t.Updated
+		}
+		if seen.Before(before) {
+			s.removeTorrent(t)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ClusterTorrents has nothing to do, torrents are clustered when saved
+func (s *MemoryStore) ClusterTorrents(ctx context.Context, limit int) (int64, error) {
+	return 0, ctx.Err()
+}
+
+// RemoveAnnounceIPs removes the announcing IPs of torrents not seen since
+// before, recounting their seen_ips from those left
+func (s *MemoryStore) RemoveAnnounceIPs(ctx context.Context, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int64
+	for _, t := range s.torrents {
+		for ip, seen := range t.ips {
+			if seen.Before(before) {
+				delete(t.ips, ip)
+				t.SeenIPs = len(t.ips)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// RemoveAnnounceBuckets removes announce counters for a period older than
+// before
+func (s *MemoryStore) RemoveAnnounceBuckets(ctx context.Context, period string, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("removeAnnounceBuckets: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int64
+	for _, t := range s.torrents {
+		for bucket := range t.buckets[period] {
+			if bucket.Before(before) {
+				delete(t.buckets[period], bucket)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Optimize does nothing for memory stores
+func (s *MemoryStore) Optimize(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// IndexedInfohashes calls fn for each infohash that has metadata
+func (s *MemoryStore) IndexedInfohashes(ctx context.Context, fn func(models.Infohash) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// fn is called without the lock held
+	var ihs []models.Infohash
+	s.lock.RLock()
+	for _, t := range s.torrents {
+		if t.Name == "" {
+			continue
+		}
+		ihs = append(ihs, t.Infohash)
+		if t.Hybrid && t.InfohashV2 != nil {
+			ihs = append(ihs, t.InfohashV2.Truncated())
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, ih := range ihs {
+		if err := fn(ih); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TorrentByHash implements torrentStore
+func (s *MemoryStore) TorrentByHash(ctx context.Context, ih models.Infohash) (*models.Torrent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t := s.lookup(ih)
+	if t == nil || t.Name == "" {
+		return nil, models.ErrNotFound
+	}
+	return t.copy(), nil
+}
+
+// TorrentsByName searches torrents with the query language of
+// models.ParseQuery. Words found in names are more relevant than in files,
+// fuzzy words are ranked by their similarity.
+func (s *MemoryStore) TorrentsByName(ctx context.Context, query string, page models.Page) (*models.Results, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if q.Empty() {
+		return new(models.Results), nil
+	}
+	now := time.Now()
+	terms := models.IncludedTerms(q.Terms)
+	ranks := make(map[*memoryTorrent]int)
+	results, err := s.search(ctx, page, func(t *memoryTorrent) bool {
+		return t.matches(q, now)
+	}, func(t *memoryTorrent) int {
+		r, ok := ranks[t]
+		if !ok {
+			r = t.relevance(terms)
+			if q.Fuzzy {
+				r = t.fuzzyRelevance(q.FuzzyWords())
+			}
+			ranks[t] = r
+		}
+		return r
+	})
+	if err != nil || q.Fuzzy {
+		return results, err
+	}
+	for _, t := range results.Torrents {
+		t.Highlights = highlightFiles(t.Files, terms)
+	}
+	return results, nil
+}
+
+// TorrentFacets counts the torrents matching a query by facet
+func (s *MemoryStore) TorrentFacets(ctx context.Context, query string) (*models.Facets, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	facets := new(models.Facets)
+	if q.Empty() {
+		return facets, nil
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make(map[[2]string]int)
+	now := time.Now()
+	for _, t := range s.torrents {
+		if t.Name == "" || !t.matches(q, now) {
+			continue
+		}
+		counts[[2]string{"total", ""}]++
+		for _, tag := range t.Tags {
+			counts[[2]string{"tag", tag}]++
+		}
+		counts[[2]string{"size", models.SizeBucketName(int64(t.Size))}]++
+		categories := make(map[string]bool)
+		for _, p := range t.paths() {
+			if c := models.ExtensionCategoryName(p); c != "" && !categories[c] {
+				categories[c] = true
+				counts[[2]string{"extension", c}]++
+			}
+		}
+		if !t.FirstSeen.IsZero() {
+			counts[[2]string{"first_seen", t.FirstSeen.UTC().Format("2006-01")}]++
+		}
+	}
+	for k, n := range counts {
+		facets.Add(k[0], k[1], n)
+	}
+	facets.Sort()
+	return facets, nil
+}
+
+// matches checks a torrent against every term and filter of a query
+func (t *memoryTorrent) matches(q *models.Query, now time.Time) bool {
+	for _, term := range q.Terms {
+		if q.Fuzzy && !term.Exclude {
+			continue
+		}
+		if t.hasTerm(term.Text) == term.Exclude {
+			return false
+		}
+	}
+	if q.Fuzzy {
+		for _, w := range q.FuzzyWords() {
+			if models.WordSimilarity(w, t.Name) < models.FuzzyThreshold {
+				return false
+			}
+		}
+	}
+	for _, tag := range q.Tags {
+		if hasString(t.Tags, tag.Text) == tag.Exclude {
+			return false
+		}
+	}
+	for _, ext := range q.Exts {
+		found := false
+		for _, p := range t.paths() {
+			found = found || strings.HasSuffix(strings.ToLower(p), "."+ext.Text)
+		}
+		if found == ext.Exclude {
+			return false
+		}
+	}
+	for _, c := range q.Size {
+		if !c.Match(int64(t.Size)) {
+			return false
+		}
+	}
+	for _, c := range q.Files {
+		if !c.Match(int64(len(t.paths()))) {
+			return false
+		}
+	}
+	for _, c := range q.Seen {
+		if t.LastSeen.IsZero() || !c.Match(int64(now.Sub(t.LastSeen)/time.Second)) {
+			return false
+		}
+	}
+	if q.Cluster != 0 && t.ClusterID != q.Cluster {
+		return false
+	}
+	return true
+}
+
+// hasTerm finds the words of a term in the name or a file path
+func (t *memoryTorrent) hasTerm(term string) bool {
+	words := searchWords(term)
+	if hasPhrase(searchWords(t.Name), words) {
+		return true
+	}
+	for _, f := range t.Files {
+		if hasPhrase(searchWords(f.Path), words) {
+			return true
+		}
+	}
+	return false
+}
+
+// relevance weights terms in the name above those only in file paths
+func (t *memoryTorrent) relevance(terms []string) int {
+	n := 0
+	names := searchWords(t.Name)
+	for _, term := range terms {
+		if hasPhrase(names, searchWords(term)) {
+			n += 10
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// fuzzyRelevance sums the similarity of fuzzy words to the name, in
+// thousandths
+func (t *memoryTorrent) fuzzyRelevance(words []string) int {
+	sim := 0.0
+	for _, w := range words {
+		sim += models.WordSimilarity(w, t.Name)
+	}
+	return int(sim * 1000)
+}
+
+// highlightFiles marks the words of any term in file paths
+func highlightFiles(files []models.File, terms []string) []models.Highlight {
+	var out []models.Highlight
+	for _, f := range files {
+		words, spans := wordSpans(f.Path)
+		h := models.Highlight{Path: f.Path}
+		marked := make([]bool, len(words))
+		for _, term := range terms {
+			phrase := searchWords(term)
+			for i := 0; i+len(phrase) <= len(words); i++ {
+				if hasPhrase(words[i:i+len(phrase)], phrase) {
+					for j := range phrase {
+						marked[i+j] = true
+					}
+				}
+			}
+		}
+		for i, m := range marked {
+			if m {
+				h.Matches = append(h.Matches, spans[i])
+			}
+		}
+		if len(h.Matches) > 0 {
+			out = append(out, h)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	if len(out) > maxHighlights {
+		out = out[:maxHighlights]
+	}
+	return out
+}
+
+// paths are the file paths, or the name of a single file torrent
+func (t *memoryTorrent) paths() []string {
+	if len(t.Files) == 0 {
+		return []string{t.Name}
+	}
+	out := make([]string, len(t.Files))
+	for i, f := range t.Files {
+		out[i] = f.Path
+	}
+	return out
+}
+
+// TorrentsByTag implements torrentStore
+func (s *MemoryStore) TorrentsByTag(ctx context.Context, tag string, page models.Page) (*models.Results, error) {
+	return s.search(ctx, page, func(t *memoryTorrent) bool {
+		return hasString(t.Tags, tag)
+	}, nil)
+}
+
+// SimilarTorrents compares a torrent with every other indexed torrent
+func (s *MemoryStore) SimilarTorrents(ctx context.Context, ih models.Infohash, limit int) ([]models.SimilarTorrent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t := s.lookup(ih)
+	if t == nil || t.Name == "" {
+		return nil, models.ErrNotFound
+	}
+	var candidates []*models.Torrent
+	stored := make(map[*models.Torrent]*memoryTorrent)
+	for _, c := range s.torrents {
+		if c.Name != "" {
+			candidates = append(candidates, &c.Torrent)
+			stored[&c.Torrent] = c
+		}
+	}
+	out := rankSimilar(&t.Torrent, candidates, limit)
+	for i := range out {
+		out[i].Torrent = stored[out[i].Torrent].copy()
+	}
+	return out, nil
+}
+
+// search returns a page of indexed torrents matching fn. Relevance is
+// ranked by rank, or is the default order without it.
+func (s *MemoryStore) search(ctx context.Context, page models.Page, fn func(*memoryTorrent) bool, rank func(*memoryTorrent) int) (*models.Results, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sortKeys, ok := memoryOrderKeys[page.Order]
+	if page.Order == models.OrderRelevance {
+		sortKeys, ok = memoryOrderKeys[models.OrderDefault], true
+		if rank != nil {
+			sortKeys = byRank(rank, sortKeys)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid ordering %d", page.Order)
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	since := time.Now().Add(-24 * time.Hour)
+	keys := func(t *memoryTorrent) []int64 {
+		return append(sortKeys(t, since), int64(t.ID))
+	}
+	var after []int64
+	if page.Cursor != "" {
+		var err error
+		if after, err = decodeMemoryCursor(page, len(keys(&memoryTorrent{}))); err != nil {
+			return nil, err
+		}
+	}
+
+	type keyed struct {
+		t    *memoryTorrent
+		keys []int64
+	}
+	var found []keyed
+	for _, t := range s.torrents {
+		if t.Name != "" && fn(t) {
+			found = append(found, keyed{t, keys(t)})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return keysBefore(found[i].keys, found[j].keys)
+	})
+
+	// Collapsed clusters keep their first match
+	variants := make(map[int]int)
+	if page.Collapse {
+		first := found[:0]
+		for _, k := range found {
+			if variants[k.t.clusterKey()]++; variants[k.t.clusterKey()] == 1 {
+				first = append(first, k)
+			}
+		}
+		found = first
+	}
+	total := len(found)
+	if after != nil {
+		found = found[sort.Search(len(found), func(i int) bool {
+			return keysBefore(after, found[i].keys)
+		}):]
+	}
+	if len(found) > page.Limit() {
+		found = found[:page.Limit()]
+	}
+
+	results := &models.Results{Torrents: make([]*models.Torrent, len(found))}
+	for i, k := range found {
+		results.Torrents[i] = k.t.copy()
+		results.Torrents[i].Variants = variants[k.t.clusterKey()]
+	}
+	if len(found) > 0 {
+		last := found[len(found)-1].keys
+		values := make([]interface{}, len(last))
+		for i, v := range last {
+			values[i] = v
+		}
+		results.Next = nextCursor(len(found), page, values)
+	}
+	results.SetTotal(total)
+	return results, nil
+}
+
+// memoryOrderKeys match the order keys of the SQL stores, sorted descending
+var memoryOrderKeys = map[models.Ordering]func(t *memoryTorrent, since time.Time) []int64{
+	models.OrderDefault: func(t *memoryTorrent, _ time.Time) []int64 {
+		return []int64{unixNano(t.Updated)}
+	},
+	models.OrderPopular: func(t *memoryTorrent, _ time.Time) []int64 {
+		return []int64{int64(t.SeenIPs), int64(t.Announces)}
+	},
+	models.OrderTrending: func(t *memoryTorrent, since time.Time) []int64 {
+		return []int64{int64(t.trending(since)), unixNano(t.LastSeen)}
+	},
+	models.OrderRecent: func(t *memoryTorrent, _ time.Time) []int64 {
+		return []int64{unixNano(t.LastSeen)}
+	},
+	models.OrderSize: func(t *memoryTorrent, _ time.Time) []int64 {
+		return []int64{int64(t.Size)}
+	},
+	models.OrderCreated: func(t *memoryTorrent, _ time.Time) []int64 {
+		return []int64{unixNano(t.Created)}
+	},
+}
+
+// byRank sorts by rank before the keys of another order
+func byRank(rank func(*memoryTorrent) int, then func(*memoryTorrent, time.Time) []int64) func(*memoryTorrent, time.Time) []int64 {
+	return func(t *memoryTorrent, since time.Time) []int64 {
+		return append([]int64{int64(rank(t))}, then(t, since)...)
+	}
+}
+
+// clusterKey groups duplicates like the clusterKey of the SQL stores
+func (t *memoryTorrent) clusterKey() int {
+	if t.ClusterID == 0 {
+		return -t.ID
+	}
+	return t.ClusterID
+}
+
+// keysBefore is true when a sorts before b, comparing each key descending
+func keysBefore(a, b []int64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// unixNano sorts missing times last
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// decodeMemoryCursor returns the n integer sort keys of a cursor
+func decodeMemoryCursor(page models.Page, n int) ([]int64, error) {
+	values, err := models.DecodeCursor(page.Cursor, page.Order, n)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int64, n)
+	for i, v := range values {
+		var ok bool
+		if out[i], ok = v.(int64); !ok {
+			return nil, models.ErrInvalidCursor
+		}
+	}
+	return out, nil
+}
+
+// trending is the number of announces in hourly buckets since a time
+func (t *memoryTorrent) trending(since time.Time) int {
+	since = since.UTC().Truncate(time.Hour)
+	n := 0
+	for bucket, count := range t.buckets["hour"] {
+		if !bucket.Before(since) {
+			n += count
+		}
+	}
+	return n
+}
+
+// copy returns the torrent without store state, safe to modify
+func (t *memoryTorrent) copy() *models.Torrent {
+	out := t.Torrent
+	out.Files = append([]models.File(nil), t.Files...)
+	out.Tags = append([]string(nil), t.Tags...)
+	return &out
+}
+
+// SaveTag implements tagStore interface
+func (s *MemoryStore) SaveTag(ctx context.Context, tag string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("saveTag: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.tags[tag]; !ok {
+		s.tags[tag] = s.nextID()
+	}
+	return s.tags[tag], nil
+}
+
+// searchWords splits text into lower case words like the sqlite tokenizer
+func searchWords(s string) []string {
+	words, _ := wordSpans(s)
+	return words
+}
+
+// wordSpans returns the lower case words of text with their byte offsets
+func wordSpans(s string) (words []string, spans [][2]int) {
+	start := -1
+	for i, r := range s + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			words = append(words, strings.ToLower(s[start:i]))
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	return words, spans
+}
+
+// hasPhrase finds consecutive words in a list
+func hasPhrase(list, words []string) bool {
+	for i := 0; i+len(words) <= len(list); i++ {
+		found := true
+		for j, w := range words {
+			found = found && list[i+j] == w
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
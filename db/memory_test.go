@@ -0,0 +1,14 @@
+package db
+
+import (
+	"testing"
+
+	"src.userspace.com.au/dhtsearch/db/storetest"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) models.Store {
+		return NewMemoryStore()
+	})
+}
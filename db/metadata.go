@@ -0,0 +1,33 @@
+package db
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+)
+
+// compressMetadata deflates raw info dictionaries for storage
+func compressMetadata(md []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(md); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressMetadata inflates stored info dictionaries
+func decompressMetadata(b []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// Migration is a numbered schema change. Each backend has its own ordered
+// list, starting at version 1.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrator applies migrations to a database, recording them in the
+// schema_migrations table
+type migrator interface {
+	// appliedVersions returns the versions already applied
+	appliedVersions(context.Context) (map[int]bool, error)
+	// applyMigration runs and records a migration in one transaction
+	applyMigration(context.Context, Migration) error
+}
+
+// Migrate applies the pending schema migrations for a DSN and returns them.
+// With dryRun the pending migrations are only returned.
+func Migrate(ctx context.Context, dsn string, dryRun bool) ([]Migration, error) {
+	kind, err := storeKind(dsn)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case pgsqlStore:
+		pool, err := pgsqlConnect(dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.Close()
+		return runMigrations(ctx, pgsqlMigrator{pool}, pgsqlMigrations, dryRun)
+	case memoryStore:
+		return nil, nil
+	default:
+		conn, err := sqliteConnect(dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return runMigrations(ctx, sqliteMigrator{conn}, sqliteMigrations, dryRun)
+	}
+}
+
+// runMigrations applies the migrations not yet applied in order, returning
+// those applied before any error
+func runMigrations(ctx context.Context, m migrator, migrations []Migration, dryRun bool) ([]Migration, error) {
+	for i, mg := range migrations {
+		if mg.Version != i+1 {
+			return nil, fmt.Errorf("migration %q out of order", mg.Name)
+		}
+	}
+
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	for v := range applied {
+		if v > len(migrations) {
+			return nil, fmt.Errorf("schema version %d is newer than this build", v)
+		}
+	}
+
+	var pending []Migration
+	for _, mg := range migrations {
+		if !applied[mg.Version] {
+			pending = append(pending, mg)
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+
+	for i, mg := range pending {
+		if err = m.applyMigration(ctx, mg); err != nil {
+			return pending[:i], fmt.Errorf("migration %d %q failed: %s", mg.Version, mg.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// baselineVersions are applied before schema_migrations was used, when the
+// schema version was a single number
+func baselineVersions(version int) map[int]bool {
+	out := make(map[int]bool)
+	for v := 1; v <= version; v++ {
+		out[v] = true
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeMigrator fails to apply the migration with version fail
+type fakeMigrator struct {
+	applied map[int]bool
+	fail    int
+}
+
+func (m *fakeMigrator) appliedVersions(context.Context) (map[int]bool, error) {
+	return m.applied, nil
+}
+
+func (m *fakeMigrator) applyMigration(_ context.Context, mg Migration) error {
+	if mg.Version == m.fail {
+		return errors.New("failed")
+	}
+	m.applied[mg.Version] = true
+	return nil
+}
+
+func TestRunMigrations(t *testing.T) {
+	migrations := []Migration{{1, "one", ""}, {2, "two", ""}, {3, "three", ""}}
+	ctx := context.Background()
+
+	m := &fakeMigrator{applied: map[int]bool{1: true}, fail: 3}
+	applied, err := runMigrations(ctx, m, migrations, true)
+	if err != nil || len(applied) != 2 || len(m.applied) != 1 {
+		t.Errorf("dry run => %v, %v, applied %v", applied, err, m.applied)
+	}
+	applied, err = runMigrations(ctx, m, migrations, false)
+	if err == nil || len(applied) != 1 || applied[0].Version != 2 {
+		t.Errorf("failed migration => %v, %v", applied, err)
+	}
+
+	m = &fakeMigrator{applied: map[int]bool{4: true}}
+	if _, err = runMigrations(ctx, m, migrations, false); err == nil {
+		t.Errorf("newer schema should fail")
+	}
+	if _, err = runMigrations(ctx, m, migrations[1:], false); err == nil {
+		t.Errorf("migrations out of order should fail")
+	}
+}
+
+func TestMigrationParity(t *testing.T) {
+	if len(sqliteMigrations) != len(pgsqlMigrations) {
+		t.Fatalf("%d sqlite migrations, %d pgsql", len(sqliteMigrations), len(pgsqlMigrations))
+	}
+	for i, m := range sqliteMigrations {
+		if m.Name != pgsqlMigrations[i].Name {
+			t.Errorf("migration %d is %q for sqlite, %q for pgsql", m.Version, m.Name, pgsqlMigrations[i].Name)
+		}
+	}
+}
+
+func TestSqliteMigrate(t *testing.T) {
+	skipWithoutSqlite(t)
+	dir, err := ioutil.TempDir("", "dhtsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "legacy.db")
+	ctx := context.Background()
+
+	// A database migrated to version 5 by user_version alone
+	conn, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range sqliteMigrations[:5] {
+		if _, err = conn.Exec(m.SQL); err != nil {
+			t.Fatalf("migration %d failed: %s", m.Version, err)
+		}
+	}
+	if _, err = conn.Exec("pragma user_version = 5"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	pending, err := Migrate(ctx, dsn, true)
+	if err != nil {
+		t.Fatalf("Migrate failed: %s", err)
+	}
+	if len(pending) != len(sqliteMigrations)-5 || pending[0].Version != 6 {
+		t.Errorf("dry run => %v", pending)
+	}
+
+	applied, err := Migrate(ctx, dsn, false)
+	if err != nil {
+		t.Fatalf("Migrate failed: %s", err)
+	}
+	if len(applied) != len(pending) {
+		t.Errorf("Migrate => %v, expected %v", applied, pending)
+	}
+	if pending, err = Migrate(ctx, dsn, true); err != nil || len(pending) != 0 {
+		t.Errorf("Migrate => %v, %v, expected nothing pending", pending, err)
+	}
+
+	s, err := NewSqliteStore(dsn)
+	if err != nil {
+		t.Fatalf("NewSqliteStore failed: %s", err)
+	}
+	defer s.Close()
+	var recorded, version int
+	if err = s.conn.QueryRow("select count(*) from schema_migrations").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.conn.QueryRow("pragma user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != len(sqliteMigrations) || version != len(sqliteMigrations) {
+		t.Errorf("recorded %d migrations, user_version %d", recorded, version)
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// sortKeys appends the torrent id to the sort keys of an ordering, so every
+// row has a distinct position
+func sortKeys(keys ...string) []string {
+	return append(keys[:len(keys):len(keys)], "t.id")
+}
+
+// keysetOrder sorts by each key descending
+func keysetOrder(keys []string) string {
+	return strings.Join(keys, " desc, ") + " desc"
+}
+
+// keysetAfter selects the rows sorted after the keys of a cursor
+func keysetAfter(keys []string, after []interface{}, arg func(interface{}) string) string {
+	values := make([]string, len(after))
+	for i, v := range after {
+		values[i] = arg(v)
+	}
+	return "(" + strings.Join(keys, ", ") + ") < (" + strings.Join(values, ", ") + ")"
+}
+
+// searchStatement selects a page of torrents t from the rows of from
+// matching where, and their sort keys. Collapsed pages have the first match
+// of each cluster, and the number of matches in it after the keys.
+func searchStatement(from string, where, keys []string, after []interface{}, limit int, collapse bool, arg func(interface{}) string) string {
+	if !collapse {
+		if after != nil {
+			where = append(where, keysetAfter(keys, after, arg))
+		}
+		return `select ` + torrentColumns + `, ` + strings.Join(keys, ", ") + `
+		from ` + from + `
+		where ` + strings.Join(where, "\n\t\tand ") + `
+		order by ` + keysetOrder(keys) + `
+		limit ` + arg(limit)
+	}
+
+	named := make([]string, len(keys))
+	matched := make([]string, len(keys))
+	for i, k := range keys {
+		named[i] = fmt.Sprintf("%s as k%d", k, i)
+		matched[i] = fmt.Sprintf("m.k%d", i)
+	}
+	cond := []string{"m.variant = 1"}
+	if after != nil {
+		cond = append(cond, keysetAfter(matched, after, arg))
+	}
+	return `with matched as (
+			select t.id, ` + strings.Join(named, ", ") + `,
+			row_number() over (
+				partition by ` + clusterKey + ` order by ` + keysetOrder(keys) + `
+			) as variant,
+			count(*) over (partition by ` + clusterKey + `) as variants
+			from ` + from + `
+			where ` + strings.Join(where, "\n\t\t\tand ") + `
+		)
+		select ` + torrentColumns + `, ` + strings.Join(matched, ", ") + `, m.variants
+		from matched m
+		inner join torrents t on t.id = m.id
+		where ` + strings.Join(cond, " and ") + `
+		order by ` + keysetOrder(matched) + `
+		limit ` + arg(limit)
+}
+
+// countStatement counts the torrents t, or clusters when collapsed, in the
+// rows of from matching where, stopping after models.MaxTotal
+func countStatement(from string, where []string, collapse bool) string {
+	selected := "1"
+	if collapse {
+		selected = "distinct " + clusterKey
+	}
+	return `select count(*) from (
+		select ` + selected + `
+		from ` + from + `
+		where ` + strings.Join(where, "\n\t\tand ") + `
+		limit ` + fmt.Sprint(models.MaxTotal+1) + `
+	) matched`
+}
+
+// clusterKey groups duplicates, torrents not yet clustered are alone
+const clusterKey = "coalesce(t.cluster_id, -t.id)"
+
+// sortKey scans a value of any type, as returned by the driver
+type sortKey struct {
+	values []interface{}
+	i      int
+}
+
+// Scan implements sql.Scanner
+func (k sortKey) Scan(src interface{}) error {
+	k.values[k.i] = src
+	return nil
+}
+
+// scanKeys returns scan destinations for n sort keys and the values they
+// hold, which are those of the last row scanned
+func scanKeys(n int) ([]interface{}, []interface{}) {
+	dest := make([]interface{}, n)
+	values := make([]interface{}, n)
+	for i := range dest {
+		dest[i] = sortKey{values, i}
+	}
+	return dest, values
+}
+
+// columnValues scans a column of every row
+type columnValues struct {
+	values *[]interface{}
+}
+
+// Scan implements sql.Scanner
+func (c columnValues) Scan(src interface{}) error {
+	*c.values = append(*c.values, src)
+	return nil
+}
+
+// setVariants sets the variant counts scanned for each torrent
+func setVariants(torrents []*models.Torrent, counts []interface{}) {
+	for i, n := range counts {
+		if n, ok := n.(int64); ok && i < len(torrents) {
+			torrents[i].Variants = int(n)
+		}
+	}
+}
+
+// nextCursor continues after the last of a full page of results
+func nextCursor(found int, page models.Page, keys []interface{}) string {
+	if found < page.Limit() {
+		return ""
+	}
+	return models.EncodeCursor(page.Order, keys)
+}
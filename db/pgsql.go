@@ -1,434 +1,1397 @@
-// +build ignore postgres
-
 package db
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/jackc/pgx/pgtype"
 	"src.userspace.com.au/dhtsearch/models"
 )
 
-// Store is a store
-type Store struct {
-	*pgx.ConnPool
+// PgsqlStore is a PostgreSQL store
+type PgsqlStore struct {
+	pool *pgx.ConnPool
 }
 
-// NewStore connects and initializes a new store
-func NewStore(dsn string) (*Store, error) {
-	cfg, err := pgx.ParseURI(dsn)
+// NewPgsqlStore connects and initializes a new PostgreSQL store
+func NewPgsqlStore(dsn string) (*PgsqlStore, error) {
+	pool, err := pgsqlConnect(dsn)
 	if err != nil {
 		return nil, err
 	}
-	c, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: cfg, MaxConnections: 10})
+
+	s := &PgsqlStore{pool: pool}
+
+	_, err = runMigrations(context.Background(), pgsqlMigrator{pool}, pgsqlMigrations, false)
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	s := &Store{c}
+	if err = s.prepareStatements(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *PgsqlStore) Close() error {
+	s.pool.Close()
+	return nil
+}
 
-	err = s.migrate()
+// PendingInfohashes gets the next pending infohashes from the store, each
+// with the least attempted peer. The infohashes are leased so they are not
+// returned again while being fetched.
+func (s *PgsqlStore) PendingInfohashes(ctx context.Context, n int) (peers []*models.Peer, err error) {
+	tx, err := s.pool.BeginEx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	err = s.prepareStatements()
+	rows, err := tx.QueryEx(ctx, "selectPendingInfohashes", nil, n)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	for rows.Next() {
+		var ih []byte
+		var addr string
+		if err = rows.Scan(&addr, &ih); err != nil {
+			return nil, err
+		}
+		p := models.Peer{Infohash: models.Infohash(ih)}
+		p.Addr, err = net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-	return s, err
+	lease := time.Now().Add(fetchLease)
+	for _, p := range peers {
+		if _, err = tx.ExecEx(ctx, "leaseInfohash", nil, lease, p.Infohash.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return peers, tx.Commit()
 }
 
-// PendingInfohashes gets the next pending infohash from the store
-func (s *Store) PendingInfohashes(n int) (peers []*models.Peer, err error) {
-
-	rows, err := s.Query("selectPendingInfohashes", n)
+// PeersByInfohash returns up to n peers for an infohash, least attempted
+// first
+func (s *PgsqlStore) PeersByInfohash(ctx context.Context, ih models.Infohash, n int) (peers []*models.Peer, err error) {
+	rows, err := s.pool.QueryEx(ctx, "selectPeersByInfohash", nil, ih.Bytes(), n)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var p models.Peer
-		var ih pgtype.Bytea
 		var addr string
-		err = rows.Scan(&addr, &ih)
-		if err != nil {
+		if err = rows.Scan(&addr); err != nil {
 			return nil, err
 		}
-		// TODO save peer network?
+		p := models.Peer{Infohash: ih}
 		p.Addr, err = net.ResolveUDPAddr("udp", addr)
 		if err != nil {
 			return nil, err
 		}
-		ih.AssignTo(&p.Infohash)
 		peers = append(peers, &p)
 	}
-	return peers, nil
+	return peers, rows.Err()
 }
 
 // SaveTorrent implements torrentStore
-func (s *Store) SaveTorrent(t *models.Torrent) error {
-	tx, err := s.Begin()
+func (s *PgsqlStore) SaveTorrent(ctx context.Context, t *models.Torrent) error {
+	tx, err := s.pool.BeginEx(ctx, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("saveTorrent: %s", err)
 	}
 	defer tx.Rollback()
 
+	if err = s.saveTorrent(ctx, tx, t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PgsqlStore) saveTorrent(ctx context.Context, tx *pgx.Tx, t *models.Torrent) error {
 	var torrentID int
-	err = tx.QueryRow("insertTorrent", t.Name, t.Infohash, t.Size).Scan(&torrentID)
+	_, err := tx.ExecEx(
+		ctx, "insertTorrent", nil,
+		t.Name, t.Infohash.Bytes(), t.Size, t.PieceLength, t.Pieces,
+		t.Private, t.Source, t.MetaVersion, t.Hybrid, nullBytes(t.InfohashV2),
+		t.Repaired,
+	)
 	if err != nil {
 		return fmt.Errorf("insertTorrent: %s", err)
 	}
+	if err = tx.QueryRowEx(ctx, "selectTorrentID", nil, t.Infohash.Bytes()).Scan(&torrentID); err != nil {
+		return fmt.Errorf("insertTorrent: %s", err)
+	}
+
+	// Hybrids may also have been announced by their truncated v2 infohash
+	if t.Hybrid && t.InfohashV2 != nil {
+		alias := t.InfohashV2.Truncated().Bytes()
+		if _, err = tx.ExecEx(ctx, "mergeTorrentPeers", nil, torrentID, alias); err != nil {
+			return fmt.Errorf("mergeTorrentPeers: %s", err)
+		}
+		if _, err = tx.ExecEx(ctx, "mergeTorrentAnnounces", nil, alias, torrentID); err != nil {
+			return fmt.Errorf("mergeTorrentAnnounces: %s", err)
+		}
+		if _, err = tx.ExecEx(ctx, "removeTorrent", nil, alias); err != nil {
+			return fmt.Errorf("removeTorrent: %s", err)
+		}
+	}
 
 	// Write tags
 	for _, tag := range t.Tags {
-		tagID, err := s.SaveTag(tag)
-		if err != nil {
+		var tagID int
+		if _, err = tx.ExecEx(ctx, "insertTag", nil, tag); err != nil {
 			return fmt.Errorf("saveTag: %s", err)
 		}
-		_, err = tx.Exec("insertTagTorrent", tagID, torrentID)
-		if err != nil {
+		if err = tx.QueryRowEx(ctx, "selectTagID", nil, tag).Scan(&tagID); err != nil {
+			return fmt.Errorf("saveTag: %s", err)
+		}
+		if _, err = tx.ExecEx(ctx, "insertTagTorrent", nil, tagID, torrentID); err != nil {
 			return fmt.Errorf("insertTagTorrent: %s", err)
 		}
 	}
 
-	// Write files
+	// Write files, replacing any previously saved
+	if _, err = tx.ExecEx(ctx, "removeFiles", nil, torrentID); err != nil {
+		return fmt.Errorf("removeFiles: %s", err)
+	}
 	for _, f := range t.Files {
-		_, err := tx.Exec("insertFile", torrentID, f.Path, f.Size)
-		if err != nil {
+		if _, err = tx.ExecEx(ctx, "insertFile", nil, torrentID, f.Path, f.Size, f.Attributes); err != nil {
 			return fmt.Errorf("insertFile: %s", err)
 		}
 	}
 
-	// Should this be outside the transaction?
-	_, err = tx.Exec("updateFTSVectors", torrentID)
-	if err != nil {
+	if err = s.clusterTorrent(ctx, tx, torrentID, t); err != nil {
+		return err
+	}
+
+	if len(t.Metadata) > 0 {
+		md, err := compressMetadata(t.Metadata)
+		if err != nil {
+			return fmt.Errorf("compressMetadata: %s", err)
+		}
+		if _, err = tx.ExecEx(ctx, "insertMetadata", nil, torrentID, md); err != nil {
+			return fmt.Errorf("insertMetadata: %s", err)
+		}
+	}
+
+	if _, err = tx.ExecEx(ctx, "updateFTSVectors", nil, torrentID); err != nil {
 		return fmt.Errorf("updateVectors: %s", err)
 	}
-	return tx.Commit()
+	return nil
 }
 
-func (s *Store) RemoveTorrent(t *models.Torrent) (err error) {
-	_, err = s.Exec("removeTorrent", t.Infohash.Bytes())
-	return err
+// clusterTorrent adds a torrent to the cluster of its fingerprint
+func (s *PgsqlStore) clusterTorrent(ctx context.Context, tx *pgx.Tx, torrentID int, t *models.Torrent) error {
+	fp := models.Fingerprint(t)
+	if _, err := tx.ExecEx(ctx, "insertCluster", nil, fp); err != nil {
+		return fmt.Errorf("insertCluster: %s", err)
+	}
+	if err := tx.QueryRowEx(ctx, "selectClusterID", nil, fp).Scan(&t.ClusterID); err != nil {
+		return fmt.Errorf("selectClusterID: %s", err)
+	}
+	if _, err := tx.ExecEx(ctx, "updateTorrentCluster", nil, t.ClusterID, torrentID); err != nil {
+		return fmt.Errorf("updateTorrentCluster: %s", err)
+	}
+	return nil
 }
 
-// SavePeer implements torrentStore
-func (s *Store) SavePeer(p *models.Peer) (err error) {
-	_, err = s.Exec("insertPeer", p.Addr.String(), p.Infohash.Bytes())
-	return err
+// TorrentMetadata returns the raw info dictionary for an infohash
+func (s *PgsqlStore) TorrentMetadata(ctx context.Context, ih models.Infohash) ([]byte, error) {
+	var md []byte
+	err := s.pool.QueryRowEx(ctx, "selectMetadata", nil, ih.Bytes(), ih.Truncated().Bytes()).Scan(&md)
+	if err == pgx.ErrNoRows {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("selectMetadata: %s", err)
+	}
+	return decompressMetadata(md)
 }
 
-func (s *Store) RemovePeer(p *models.Peer) (err error) {
-	_, err = s.Exec("removePeer", p.Addr.String())
-	return err
+func (s *PgsqlStore) RemoveTorrent(ctx context.Context, t *models.Torrent) error {
+	if _, err := s.pool.ExecEx(ctx, "removeTorrent", nil, t.Infohash.Bytes()); err != nil {
+		return fmt.Errorf("removeTorrent: %s", err)
+	}
+	return nil
 }
 
-// TorrentsByHash implements torrentStore
-func (s *Store) TorrentByHash(ih models.Infohash) (*models.Torrent, error) {
-	rows, err := s.Query("getTorrent", ih)
+// SavePeer implements torrentStore
+func (s *PgsqlStore) SavePeer(ctx context.Context, p *models.Peer) error {
+	tx, err := s.pool.BeginEx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
-	if err != nil {
-		return nil, err
+	defer tx.Rollback()
+
+	if err = s.savePeer(ctx, tx, p); err != nil {
+		return err
 	}
-	return torrents[0], nil
+	return tx.Commit()
+}
+
+func (s *PgsqlStore) savePeer(ctx context.Context, tx *pgx.Tx, p *models.Peer) (err error) {
+	var peerID, torrentID int
+	if err = tx.QueryRowEx(ctx, "insertPeer", nil, p.Addr.String()).Scan(&peerID); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+
+	// Do not replace existing torrents, they may already have metadata
+	if _, err = tx.ExecEx(ctx, "insertPendingTorrent", nil, p.Infohash.Bytes()); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+	if err = tx.QueryRowEx(ctx, "selectTorrentID", nil, p.Infohash.Bytes()).Scan(&torrentID); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+
+	if _, err = tx.ExecEx(ctx, "insertPeerTorrent", nil, peerID, torrentID); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+	if err = s.saveAnnounce(ctx, tx, torrentID, p); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+	return nil
 }
 
-// TorrentsByName implements torrentStore
-func (s *Store) TorrentsByName(query string, offset int) ([]*models.Torrent, error) {
-	rows, err := s.Query("searchTorrents", fmt.Sprintf("%%%s%%", query), offset)
+// SaveAnnounce records an announce for an existing torrent without queuing
+// the peer for a metadata fetch
+func (s *PgsqlStore) SaveAnnounce(ctx context.Context, p *models.Peer) error {
+	tx, err := s.pool.BeginEx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.saveKnownAnnounce(ctx, tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveKnownAnnounce counts an announce if the torrent is known
+func (s *PgsqlStore) saveKnownAnnounce(ctx context.Context, tx *pgx.Tx, p *models.Peer) error {
+	var torrentID int
+	err := tx.QueryRowEx(ctx, "selectTorrentID", nil, p.Infohash.Bytes()).Scan(&torrentID)
+	if err == pgx.ErrNoRows {
+		return nil
 	}
-	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("saveAnnounce: %s", err)
 	}
-	return torrents, nil
+	if err = s.saveAnnounce(ctx, tx, torrentID, p); err != nil {
+		return fmt.Errorf("saveAnnounce: %s", err)
+	}
+	return nil
 }
 
-// TorrentsByTag implements torrentStore
-func (s *Store) TorrentsByTag(tag string, offset int) ([]*models.Torrent, error) {
-	rows, err := s.Query("torrentsByTag", tag, offset)
+// saveAnnounce updates the announce counters for a torrent
+func (s *PgsqlStore) saveAnnounce(ctx context.Context, tx *pgx.Tx, torrentID int, p *models.Peer) error {
+	host, _, err := net.SplitHostPort(p.Addr.String())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
+
+	ct, err := tx.ExecEx(ctx, "insertTorrentIP", nil, torrentID, host)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return torrents, nil
+
+	if ct.RowsAffected() == 0 {
+		if _, err = tx.ExecEx(ctx, "updateTorrentIP", nil, torrentID, host); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecEx(ctx, "updateAnnounces", nil, ct.RowsAffected(), torrentID); err != nil {
+		return err
+	}
+	for period := range announcePeriods {
+		if _, err = tx.ExecEx(ctx, "insertAnnounceBucket", nil, torrentID, period); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// SaveTag implements tagStore interface
-func (s *Store) SaveTag(tag string) (tagID int, err error) {
-	err = s.QueryRow("insertTag", tag).Scan(&tagID)
-	return tagID, err
+func (s *PgsqlStore) RemovePeer(ctx context.Context, p *models.Peer) error {
+	_, err := s.pool.ExecEx(ctx, "removePeer", nil, p.Addr.String())
+	return err
 }
 
-func (s *Store) fetchTorrents(rows *pgx.Rows) (torrents []*models.Torrent, err error) {
-	for rows.Next() {
-		var t models.Torrent
-		/*
-			t := &models.Torrent{
-				Files: []models.File{},
-				Tags:  []string{},
-			}
-		*/
-		err = rows.Scan(
-			&t.ID, &t.Infohash, &t.Name, &t.Size, &t.Created, &t.Updated,
-		)
-		if err != nil {
-			return nil, err
-		}
+// writeBatch applies queued writes in one transaction
+func (s *PgsqlStore) writeBatch(ctx context.Context, ops []writeOp) error {
+	tx, err := s.pool.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		err = func() error {
-			rowsf, err := s.Query("selectFiles", t.ID)
-			defer rowsf.Close()
-			if err != nil {
-				return fmt.Errorf("failed to select files: %s", err)
-			}
-			for rowsf.Next() {
-				var f models.File
-				err = rowsf.Scan(&f.ID, &f.TorrentID, &f.Path, &f.Size)
-				if err != nil {
-					return fmt.Errorf("failed to build file: %s", err)
-				}
-			}
-			return nil
-		}()
+	for _, op := range ops {
+		switch op.kind {
+		case opSavePeer:
+			err = s.savePeer(ctx, tx, op.peer)
+		case opSaveAnnounce:
+			err = s.saveKnownAnnounce(ctx, tx, op.peer)
+		case opRemovePeer:
+			_, err = tx.ExecEx(ctx, "removePeer", nil, op.peer.Addr.String())
+		case opSaveTorrent:
+			err = s.saveTorrent(ctx, tx, op.torrent)
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+	return tx.Commit()
+}
 
-		err = func() error {
-			rowst, err := s.Query("selectTags", t.ID)
-			defer rowst.Close()
-			if err != nil {
-				return fmt.Errorf("failed to select tags: %s", err)
-			}
-			for rowst.Next() {
-				var tg string
-				err = rowst.Scan(&tg)
-				if err != nil {
-					return fmt.Errorf("failed to build tag: %s", err)
-				}
-				t.Tags = append(t.Tags, tg)
-			}
-			return nil
-		}()
-		if err != nil {
+// SavePeerClient records the client fingerprint of a peer
+func (s *PgsqlStore) SavePeerClient(ctx context.Context, p *models.Peer) error {
+	_, err := s.pool.ExecEx(
+		ctx, "savePeerClient", nil,
+		p.Addr.String(), p.ID, p.Client.Name, p.Client.Version, p.Agent,
+	)
+	if err != nil {
+		return fmt.Errorf("savePeerClient: %s", err)
+	}
+	return nil
+}
+
+// ClientCounts returns the number of peers seen running each client, most
+// popular first
+func (s *PgsqlStore) ClientCounts(ctx context.Context, limit int) ([]models.ClientCount, error) {
+	rows, err := s.pool.QueryEx(ctx, "selectClientCounts", nil, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []models.ClientCount
+	for rows.Next() {
+		var c models.ClientCount
+		if err = rows.Scan(&c.Client, &c.Peers); err != nil {
 			return nil, err
 		}
-		torrents = append(torrents, &t)
+		out = append(out, c)
 	}
-	return torrents, err
+	return out, rows.Err()
 }
 
-func (s *Store) migrate() error {
-	tx, err := s.Begin()
+// FetchFailed records a failed metadata fetch from a peer, scheduling the
+// next attempt or marking the infohash as unfetchable
+func (s *PgsqlStore) FetchFailed(ctx context.Context, p *models.Peer, reason error, b models.Backoff) error {
+	tx, err := s.pool.BeginEx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	var initialized bool
-	err = tx.QueryRow(`select exists (
-		select 1 from pg_tables
-		where schemaname = 'public'
-		and tablename = 'settings'
-	)`).Scan(&initialized)
+	var torrentID, attempts int
+	err = tx.QueryRowEx(ctx, "selectFetchAttempts", nil, p.Infohash.Bytes()).Scan(&torrentID, &attempts)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("fetchFailed: %s", err)
 	}
 
-	if !initialized {
-		_, err = tx.Exec("baseSchema")
+	attempts++
+	var msg string
+	if reason != nil {
+		msg = reason.Error()
 	}
+	next := time.Now().Add(b.Delay(attempts))
 
-	// Start migrations
-	var currentVersion int
-	err = tx.QueryRow("select schema_version from settings").Scan(currentVersion)
+	_, err = tx.ExecEx(ctx, "updateFetchFailed", nil, attempts, msg, next, b.Exhausted(attempts), torrentID)
 	if err != nil {
-		return err
+		return fmt.Errorf("fetchFailed: %s", err)
 	}
-
-	switch currentVersion {
-	case 1:
-	default:
+	if _, err = tx.ExecEx(ctx, "incrPeerAttempts", nil, torrentID, p.Addr.String()); err != nil {
+		return fmt.Errorf("fetchFailed: %s", err)
 	}
+	return tx.Commit()
+}
 
-	return nil
+// RemoveStalePeers removes peers not seen since before
+func (s *PgsqlStore) RemoveStalePeers(ctx context.Context, before time.Time) (int64, error) {
+	ct, err := s.pool.ExecEx(ctx, "removeStalePeers", nil, before)
+	if err != nil {
+		return 0, fmt.Errorf("removeStalePeers: %s", err)
+	}
+	return ct.RowsAffected(), nil
 }
 
-func (s *Store) prepareStatements() error {
-	if _, err := s.Prepare(
-		"removeTorrent",
-		`delete from torrents
-		where infohash = $1`,
-	); err != nil {
-		return err
+// RemoveOrphans removes infohashes without metadata that are either
+// unfetchable or have no peers left, and have not been announced since before
+func (s *PgsqlStore) RemoveOrphans(ctx context.Context, before time.Time) (int64, error) {
+	ct, err := s.pool.ExecEx(ctx, "removeOrphans", nil, before)
+	if err != nil {
+		return 0, fmt.Errorf("removeOrphans: %s", err)
 	}
-	if _, err := s.Prepare(
-		"selectPendingInfohashes",
-		`with get_order as (
-			select t.id as torrent_id, min(pt.peer_id) as peer_id, count(pt.peer_id) as c
-			from torrents t
-			join peers_torrents pt on pt.torrent_id = t.id
-			where t.name is null
-			group by t.id
-			-- order by c desc
-			order by t.updated desc
-			limit $1
-		) select p.address, t.infohash
-		from get_order go
-		join torrents t on t.id = go.torrent_id
-		join peers p on p.id = go.peer_id`,
-	); err != nil {
-		return err
+	if _, err = s.pool.ExecEx(ctx, "removeEmptyClusters", nil); err != nil {
+		return 0, fmt.Errorf("removeEmptyClusters: %s", err)
 	}
+	return ct.RowsAffected(), nil
+}
 
-	if _, err := s.Prepare(
-		"selectFiles",
-		`select * from files
-		where torrent_id = $1
-		order by path asc`,
-	); err != nil {
-		return err
+// ClusterTorrents assigns clusters to up to limit torrents indexed before
+// they were clustered on save
+func (s *PgsqlStore) ClusterTorrents(ctx context.Context, limit int) (int64, error) {
+	torrents, err := s.queryTorrents(ctx, nil, "selectUnclustered", limit)
+	if err != nil {
+		return 0, fmt.Errorf("selectUnclustered: %s", err)
 	}
 
-	if _, err := s.Prepare(
-		"insertPeer",
-		`with save_peer as (
-			insert into peers
-			(address, created, updated) values ($1, now(), now())
-			returning id
-		), save_torrent as (
-			insert into torrents (infohash, created, updated)
-			values ($2, now(), now())
-			on conflict (infohash) do update set
-			updated = now()
-			returning id
-		) insert into peers_torrents
-		(peer_id, torrent_id)
-		select
-		sp.id, st.id
-		from save_peer sp, save_torrent st
-		on conflict do nothing`,
-	); err != nil {
-		return err
+	tx, err := s.pool.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("clusterTorrents: %s", err)
 	}
-
-	if _, err := s.Prepare(
-		"getTorrent",
-		`select * from torrents where infohash = $1 limit 1`,
-	); err != nil {
-		return err
+	defer tx.Rollback()
+	for _, t := range torrents {
+		if err = s.clusterTorrent(ctx, tx, t.ID, t); err != nil {
+			return 0, err
+		}
 	}
+	return int64(len(torrents)), tx.Commit()
+}
 
-	if _, err := s.Prepare(
-		"insertFile",
-		`insert into files
-		(torrent_id, path, size)
-		values
-		($1, $2, $3)`,
-	); err != nil {
-		return err
+// RemoveAnnounceBuckets removes announce counters for a period older than
+// before
+func (s *PgsqlStore) RemoveAnnounceBuckets(ctx context.Context, period string, before time.Time) (int64, error) {
+	ct, err := s.pool.ExecEx(ctx, "removeAnnounceBuckets", nil, period, before)
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceBuckets: %s", err)
 	}
+	return ct.RowsAffected(), nil
+}
 
-	if _, err := s.Prepare(
-		"selectTags",
-		`select name
-		from tags t
-		inner join tags_torrents tt on t.id = tt.tag_id
-		where tt.torrent_id = $1`,
-	); err != nil {
-		return err
+// RemoveAnnounceIPs removes the announcing IPs of torrents not seen since
+// before, recounting their seen_ips from those left
+func (s *PgsqlStore) RemoveAnnounceIPs(ctx context.Context, before time.Time) (int64, error) {
+	tx, err := s.pool.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
 	}
+	defer tx.Rollback()
 
-	if _, err := s.Prepare(
-		"removePeer",
-		`delete from peers where address = $1`,
-	); err != nil {
-		return err
+	if _, err = tx.ExecEx(ctx, "recountSeenIPs", nil, before); err != nil {
+		return 0, fmt.Errorf("recountSeenIPs: %s", err)
 	}
-
-	if _, err := s.Prepare(
-		"insertTagTorrent",
-		`insert into tags_torrents
-		(tag_id, torrent_id) values ($1, $2)
-		on conflict do nothing`,
-	); err != nil {
-		return err
+	ct, err := tx.ExecEx(ctx, "removeAnnounceIPs", nil, before)
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
 	}
+	return ct.RowsAffected(), tx.Commit()
+}
 
-	if _, err := s.Prepare(
-		"insertTag",
-		`insert into tags (name) values ($1)
-		on conflict (name) do update set name = excluded.name returning id`,
-	); err != nil {
-		return err
+// Optimize reclaims space and updates the planner statistics
+func (s *PgsqlStore) Optimize(ctx context.Context) error {
+	if _, err := s.pool.ExecEx(ctx, `vacuum analyze`, nil); err != nil {
+		return fmt.Errorf("vacuum: %s", err)
 	}
+	return nil
+}
 
-	if _, err := s.Prepare(
-		"torrentsByTag",
-		`select t.id, t.infohash, t.name, t.size, t.created, t.updated
-		from torrents t
-		inner join tags_torrents tt on t.id = tt.torrent_id
-		inner join tags ta on tt.tag_id = ta.id
-		where ta.name = $1 group by t.id
-		order by updated asc
-		limit 50 offset $2`,
-	); err != nil {
+// IndexedInfohashes calls fn for each infohash that has metadata
+func (s *PgsqlStore) IndexedInfohashes(ctx context.Context, fn func(models.Infohash) error) error {
+	rows, err := s.pool.QueryEx(ctx, "selectIndexedInfohashes", nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ih []byte
+		if err = rows.Scan(&ih); err != nil {
+			return err
+		}
+		if err = fn(models.Infohash(ih)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// TorrentByHash implements torrentStore
+func (s *PgsqlStore) TorrentByHash(ctx context.Context, ih models.Infohash) (*models.Torrent, error) {
+	torrents, err := s.queryTorrents(ctx, nil, "getTorrent", ih.Bytes(), ih.Truncated().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) == 0 {
+		return nil, models.ErrNotFound
+	}
+	return torrents[0], nil
+}
+
+// TorrentsByName searches torrents with the query language of
+// models.ParseQuery
+func (s *PgsqlStore) TorrentsByName(ctx context.Context, query string, page models.Page) (*models.Results, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.search(ctx, q, page)
+}
+
+// search returns a page of the torrents matching a query, with the files
+// matching its words highlighted
+func (s *PgsqlStore) search(ctx context.Context, q *models.Query, page models.Page) (*models.Results, error) {
+	results := new(models.Results)
+	if q.Empty() {
+		return results, nil
+	}
+	now := time.Now()
+	stmt, args, nkeys, err := pgsqlSearch(q, page, now)
+	if err != nil {
+		return nil, err
+	}
+	dest, keys := scanKeys(nkeys)
+	var variants []interface{}
+	if page.Collapse {
+		dest = append(dest, columnValues{&variants})
+	}
+	if results.Torrents, err = s.queryTorrents(ctx, dest, stmt, args...); err != nil {
+		return nil, err
+	}
+	setVariants(results.Torrents, variants)
+	results.Next = nextCursor(len(results.Torrents), page, keys)
+
+	var total int
+	stmt, args = pgsqlCount(q, page.Collapse, now)
+	if err = s.pool.QueryRowEx(ctx, stmt, nil, args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("countTorrents: %s", err)
+	}
+	results.SetTotal(total)
+
+	terms := models.IncludedTerms(q.Terms)
+	if len(terms) == 0 || q.Fuzzy {
+		return results, nil
+	}
+	for _, t := range results.Torrents {
+		if t.Highlights, err = s.fileHighlights(ctx, t.ID, terms); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// fileHighlights marks the words of any term in the paths of a torrent.
+// Paths are headlined as they are indexed, with the same length.
+func (s *PgsqlStore) fileHighlights(ctx context.Context, torrentID int, terms []string) ([]models.Highlight, error) {
+	args := []interface{}{torrentID, maxHighlights}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	query := pgsqlTSQuery(terms, " || ", arg)
+	rows, err := s.pool.QueryEx(ctx, `select f.path, ts_headline(
+			translate(f.path, './_-', '    '), `+query+`,
+			'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', HighlightAll=true'
+		)
+		from files f
+		where f.torrent_id = $1
+		and to_tsvector(translate(f.path, './_-', '    ')) @@ `+query+`
+		order by f.path asc
+		limit $2`, nil, args...)
+	if err != nil {
+		return nil, fmt.Errorf("selectFileHighlights: %s", err)
+	}
+	defer rows.Close()
+
+	var out []models.Highlight
+	for rows.Next() {
+		var path, marked string
+		if err = rows.Scan(&path, &marked); err != nil {
+			return nil, err
+		}
+		if h, ok := parseHighlight(marked); ok && len(h.Path) == len(path) {
+			h.Path = path
+			out = append(out, h)
+		}
+	}
+	return out, rows.Err()
+}
+
+// TorrentFacets counts the torrents matching a query by facet
+func (s *PgsqlStore) TorrentFacets(ctx context.Context, query string) (*models.Facets, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	facets := new(models.Facets)
+	if q.Empty() {
+		return facets, nil
+	}
+	stmt, args := pgsqlFacets(q, time.Now())
+
+	rows, err := s.pool.QueryEx(ctx, stmt, nil, args...)
+	if err != nil {
+		return nil, fmt.Errorf("selectFacets: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var facet, value string
+		var count int
+		if err = rows.Scan(&facet, &value, &count); err != nil {
+			return nil, err
+		}
+		facets.Add(facet, value, count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	facets.Sort()
+	return facets, nil
+}
+
+// TorrentsByTag implements torrentStore
+func (s *PgsqlStore) TorrentsByTag(ctx context.Context, tag string, page models.Page) (*models.Results, error) {
+	return s.search(ctx, &models.Query{Tags: []models.QueryTerm{{Text: tag}}}, page)
+}
+
+// SimilarTorrents compares a torrent with those sharing its name tokens or
+// file sizes
+func (s *PgsqlStore) SimilarTorrents(ctx context.Context, ih models.Infohash, limit int) ([]models.SimilarTorrent, error) {
+	t, err := s.TorrentByHash(ctx, ih)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{t.ID, similarCandidates}
+	shared := []string{`t.id in (
+		select f2.torrent_id from files f1
+		inner join files f2 on f2.size = f1.size
+		where f1.torrent_id = $1 and f1.size > 0
+		limit $2
+	)`}
+	if tokens := models.NameTokens(t.Name); len(tokens) > 0 {
+		// Tokens are only letters and numbers, matched in names
+		for i, tok := range tokens {
+			tokens[i] = tok + ":A"
+		}
+		args = append(args, strings.Join(tokens, " | "))
+		shared = append(shared, `t.id in (
+			select id from torrents
+			where tsv @@ to_tsquery($3)
+			order by ts_rank(tsv, to_tsquery($3)) desc
+			limit $2
+		)`)
+	}
+
+	candidates, err := s.queryTorrents(ctx, nil, `select `+torrentColumns+`
+		from torrents t
+		where t.name is not null
+		and (`+strings.Join(shared, " or ")+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("selectSimilar: %s", err)
+	}
+	return rankSimilar(t, candidates, limit), nil
+}
+
+// SaveTag implements tagStore interface
+func (s *PgsqlStore) SaveTag(ctx context.Context, tag string) (int, error) {
+	if _, err := s.pool.ExecEx(ctx, "insertTag", nil, tag); err != nil {
+		return 0, fmt.Errorf("saveTag: %s", err)
+	}
+	var tagID int
+	if err := s.pool.QueryRowEx(ctx, "selectTagID", nil, tag).Scan(&tagID); err != nil {
+		return 0, fmt.Errorf("saveTag: %s", err)
+	}
+	return tagID, nil
+}
+
+// queryTorrents runs a statement selecting torrentColumns, followed by any
+// columns scanned into extra, adding the files and tags of each torrent
+func (s *PgsqlStore) queryTorrents(ctx context.Context, extra []interface{}, stmt string, args ...interface{}) ([]*models.Torrent, error) {
+	torrents, err := s.scanTorrents(ctx, extra, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The torrent rows are closed so the connection is free for these
+	for _, t := range torrents {
+		err = func() error {
+			rows, err := s.pool.QueryEx(ctx, "selectFiles", nil, t.ID)
+			if err != nil {
+				return fmt.Errorf("failed to select files: %s", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var f models.File
+				err = rows.Scan(&f.ID, &f.TorrentID, &f.Path, &f.Size, &f.Attributes)
+				if err != nil {
+					return fmt.Errorf("failed to build file: %s", err)
+				}
+				t.Files = append(t.Files, f)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		err = func() error {
+			rows, err := s.pool.QueryEx(ctx, "selectTags", nil, t.ID)
+			if err != nil {
+				return fmt.Errorf("failed to select tags: %s", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var tg string
+				if err = rows.Scan(&tg); err != nil {
+					return fmt.Errorf("failed to build tag: %s", err)
+				}
+				t.Tags = append(t.Tags, tg)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return torrents, nil
+}
+
+func (s *PgsqlStore) scanTorrents(ctx context.Context, extra []interface{}, stmt string, args ...interface{}) (torrents []*models.Torrent, err error) {
+	rows, err := s.pool.QueryEx(ctx, stmt, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t models.Torrent
+		var ih, infohashV2 []byte
+		var firstSeen, lastSeen pgtype.Timestamptz
+		err = rows.Scan(append([]interface{}{
+			&t.ID, &ih, &t.Name, &t.Size, &t.Created, &t.Updated,
+			&t.Announces, &t.SeenIPs, &firstSeen, &lastSeen,
+			&t.PieceLength, &t.Pieces, &t.Private, &t.Source, &t.MetaVersion, &t.Hybrid,
+			&infohashV2, &t.Repaired, &t.ClusterID,
+		}, extra...)...)
+		if err != nil {
+			return nil, err
+		}
+		t.Infohash = models.Infohash(ih)
+		if infohashV2 != nil {
+			t.InfohashV2 = models.Infohash(infohashV2)
+		}
+		t.FirstSeen = firstSeen.Time
+		t.LastSeen = lastSeen.Time
+		torrents = append(torrents, &t)
+	}
+	return torrents, rows.Err()
+}
+
+// pgsqlConnect opens a pool of connections to a PostgreSQL database
+func pgsqlConnect(dsn string) (*pgx.ConnPool, error) {
+	cfg, err := pgx.ParseURI(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+	// The <<% operator of fuzzy searches matches at this threshold
+	if cfg.RuntimeParams == nil {
+		cfg.RuntimeParams = make(map[string]string)
+	}
+	if _, ok := cfg.RuntimeParams[pgsqlFuzzyThreshold]; !ok {
+		cfg.RuntimeParams[pgsqlFuzzyThreshold] = fmt.Sprint(models.FuzzyThreshold)
+	}
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: cfg, MaxConnections: 10})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+	return pool, nil
+}
+
+// pgsqlFuzzyThreshold is the pg_trgm setting for models.FuzzyThreshold
+const pgsqlFuzzyThreshold = "pg_trgm.strict_word_similarity_threshold"
+
+// pgsqlMigrator replaces the settings table, which was the only record of
+// the schema version before schema_migrations
+type pgsqlMigrator struct {
+	pool *pgx.ConnPool
+}
+
+func (m pgsqlMigrator) appliedVersions(ctx context.Context) (map[int]bool, error) {
+	ok, err := pgsqlTableExists(ctx, m.pool, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		version, err := pgsqlLegacyVersion(ctx, m.pool)
+		if err != nil {
+			return nil, err
+		}
+		return baselineVersions(version), nil
+	}
+
+	rows, err := m.pool.QueryEx(ctx, `select version from schema_migrations`, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int32
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[int(v)] = true
+	}
+	return applied, rows.Err()
+}
+
+func (m pgsqlMigrator) applyMigration(ctx context.Context, mg Migration) error {
+	tx, err := m.pool.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version, err := pgsqlLegacyVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecEx(ctx, pgsqlSchemaMigrations, nil); err != nil {
+		return err
+	}
+	// Record migrations applied before schema_migrations
+	if version > 0 {
+		for _, prev := range pgsqlMigrations {
+			if prev.Version > version {
+				break
+			}
+			_, err = tx.ExecEx(
+				ctx,
+				`insert into schema_migrations (version, name, applied)
+				values ($1, $2, now())
+				on conflict (version) do nothing`,
+				nil, int32(prev.Version), prev.Name,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = tx.ExecEx(ctx, `drop table settings`, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.ExecEx(ctx, mg.SQL, nil); err != nil {
+		return err
+	}
+	_, err = tx.ExecEx(
+		ctx,
+		`insert into schema_migrations (version, name, applied)
+		values ($1, $2, now())`,
+		nil, int32(mg.Version), mg.Name,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+// pgsqlQueryer is implemented by connection pools and transactions
+type pgsqlQueryer interface {
+	QueryRowEx(context.Context, string, *pgx.QueryExOptions, ...interface{}) *pgx.Row
+}
+
+func pgsqlTableExists(ctx context.Context, q pgsqlQueryer, name string) (bool, error) {
+	var ok bool
+	err := q.QueryRowEx(
+		ctx,
+		`select exists (
+			select 1 from pg_tables
+			where schemaname = current_schema() and tablename = $1
+		)`,
+		nil, name,
+	).Scan(&ok)
+	return ok, err
+}
+
+// pgsqlLegacyVersion returns the version from the settings table, or 0
+func pgsqlLegacyVersion(ctx context.Context, q pgsqlQueryer) (int, error) {
+	ok, err := pgsqlTableExists(ctx, q, "settings")
+	if err != nil || !ok {
+		return 0, err
+	}
+	var version int32
+	err = q.QueryRowEx(ctx, `select schema_version from settings`, nil).Scan(&version)
+	return int(version), err
+}
+
+func (s *PgsqlStore) prepareStatements() error {
+	if _, err := s.pool.Prepare(
+		"removeTorrent",
+		`delete from torrents
+		where infohash = $1`,
+	); err != nil {
 		return err
 	}
 
-	if _, err := s.Prepare(
-		"searchTorrents",
-		`select t.id, t.infohash, t.name, t.size, t.updated
+	if _, err := s.pool.Prepare(
+		"selectPendingInfohashes",
+		`select p.address, t.infohash
 		from torrents t
-		where t.tsv @@ plainto_tsquery($1)
-		order by ts_rank(tsv, plainto_tsquery($1)) desc, t.updated desc
-		limit 50 offset $2`,
+		join peers_torrents pt on pt.torrent_id = t.id
+		join peers p on p.id = pt.peer_id
+		where t.name is null
+		and not t.unfetchable
+		and (t.fetch_next is null or t.fetch_next <= now())
+		and pt.peer_id = (
+			select pt2.peer_id from peers_torrents pt2
+			where pt2.torrent_id = t.id
+			order by pt2.attempts asc, pt2.peer_id desc
+			limit 1
+		)
+		order by t.fetch_attempts asc, t.last_seen desc nulls last
+		limit $1
+		for update of t skip locked`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectPeersByInfohash",
+		`select p.address
+		from peers p
+		join peers_torrents pt on pt.peer_id = p.id
+		join torrents t on t.id = pt.torrent_id
+		where t.infohash = $1
+		order by pt.attempts asc, p.updated desc
+		limit $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectFiles",
+		`select id, torrent_id, path, size, attributes from files
+		where torrent_id = $1
+		order by path asc`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeFiles",
+		`delete from files where torrent_id = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertPeer",
+		`insert into peers
+		(address, created, updated)
+		values
+		($1, now(), now())
+		on conflict (address) do update set
+		updated = excluded.updated
+		returning id`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertMetadata",
+		`insert into torrents_metadata
+		(torrent_id, metadata) values ($1, $2)
+		on conflict (torrent_id) do update set
+		metadata = excluded.metadata`,
 	); err != nil {
 		return err
 	}
 
-	if _, err := s.Prepare(
+	if _, err := s.pool.Prepare(
+		"selectMetadata",
+		`select m.metadata
+		from torrents_metadata m
+		join torrents t on t.id = m.torrent_id
+		where t.infohash = $1 or t.infohash_v2 = $1
+		or substring(t.infohash_v2 from 1 for 20) = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"savePeerClient",
+		`insert into peers
+		(address, peer_id, client, client_version, agent, created, updated)
+		values
+		($1, $2, $3, $4, $5, now(), now())
+		on conflict (address) do update set
+		peer_id = excluded.peer_id,
+		client = excluded.client,
+		client_version = excluded.client_version,
+		agent = excluded.agent,
+		updated = excluded.updated`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectClientCounts",
+		`select coalesce(nullif(client, ''), 'unknown') as name, count(*) as c
+		from peers
+		where client is not null
+		group by name
+		order by c desc, name asc
+		limit $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeStalePeers",
+		`delete from peers where updated < $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectFetchAttempts",
+		`select id, fetch_attempts from torrents
+		where infohash = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"updateFetchFailed",
+		`update torrents set
+		fetch_attempts = $1,
+		fetch_error = $2,
+		fetch_next = $3,
+		unfetchable = $4
+		where id = $5`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"incrPeerAttempts",
+		`update peers_torrents set
+		attempts = attempts + 1
+		where torrent_id = $1
+		and peer_id = (select id from peers where address = $2)`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"leaseInfohash",
+		`update torrents set fetch_next = $1
+		where infohash = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeOrphans",
+		`delete from torrents
+		where name is null
+		and (
+			unfetchable
+			or not exists (
+				select 1 from peers_torrents pt
+				where pt.torrent_id = torrents.id
+			)
+		)
+		and coalesce(last_seen, updated) < $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeAnnounceBuckets",
+		`delete from torrents_announces
+		where period = $1 and bucket < $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeAnnounceIPs",
+		`delete from torrents_ips where seen < $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"recountSeenIPs",
+		`update torrents set seen_ips = (
+			select count(*) from torrents_ips i
+			where i.torrent_id = torrents.id and i.seen >= $1
+		)
+		where id in (select torrent_id from torrents_ips where seen < $1)`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertPeerTorrent",
+		`insert into peers_torrents
+		(peer_id, torrent_id)
+		values
+		($1, $2)
+		on conflict do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
 		"insertTorrent",
 		`insert into torrents (
-			name, infohash, size, created, updated
+			name, infohash, size, piece_length, pieces,
+			private, source, meta_version, hybrid, infohash_v2, repaired,
+			created, updated
 		) values (
-			$1, $2, $3, now(), now()
-		) on conflict (infohash) do
-		update set
-		name = $1,
-		size = $3,
-		updated = now()
-		returning id`,
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, now(), now()
+		) on conflict (infohash) do update set
+		infohash_v2 = excluded.infohash_v2,
+		name = excluded.name,
+		size = excluded.size,
+		piece_length = excluded.piece_length,
+		pieces = excluded.pieces,
+		private = excluded.private,
+		source = excluded.source,
+		meta_version = excluded.meta_version,
+		hybrid = excluded.hybrid,
+		repaired = excluded.repaired,
+		updated = excluded.updated`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertPendingTorrent",
+		`insert into torrents (
+			infohash, created, updated, first_seen
+		) select $1::bytea, now(), now(), now()
+		where not exists (
+			select 1 from torrents
+			where substring(infohash_v2 from 1 for 20) = $1::bytea
+		)
+		on conflict (infohash) do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectTorrentID",
+		`select id from torrents where infohash = $1
+		union all
+		select id from torrents where substring(infohash_v2 from 1 for 20) = $1
+		limit 1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"mergeTorrentPeers",
+		`insert into peers_torrents (peer_id, torrent_id, attempts)
+		select pt.peer_id, $1::integer, pt.attempts
+		from peers_torrents pt
+		join torrents t on t.id = pt.torrent_id
+		where t.infohash = $2
+		on conflict do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"mergeTorrentAnnounces",
+		`update torrents set announces = announces + coalesce((
+			select announces from torrents where infohash = $1
+		), 0)
+		where id = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectIndexedInfohashes",
+		`select infohash from torrents where name is not null
+		union all
+		select substring(infohash_v2 from 1 for 20) from torrents
+		where name is not null and hybrid`,
 	); err != nil {
 		return err
 	}
 
-	if _, err := s.Prepare(
+	if _, err := s.pool.Prepare(
+		"getTorrent",
+		`select `+torrentColumns+`
+		from torrents t
+		where (
+			t.infohash = $1 or t.infohash_v2 = $1
+			or substring(t.infohash_v2 from 1 for 20) = $2
+		)
+		and t.name is not null
+		limit 1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertFile",
+		`insert into files
+		(torrent_id, path, size, attributes)
+		values
+		($1, $2, $3, $4)`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectTags",
+		`select name
+		from tags t
+		inner join tags_torrents tt on t.id = tt.tag_id
+		where tt.torrent_id = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removePeer",
+		`delete from peers where address = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertTagTorrent",
+		`insert into tags_torrents
+		(tag_id, torrent_id) values ($1, $2)
+		on conflict do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertTag",
+		`insert into tags (name) values ($1)
+		on conflict (name) do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectTagID",
+		`select id from tags where name = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertCluster",
+		`insert into clusters (fingerprint) values ($1)
+		on conflict (fingerprint) do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectClusterID",
+		`select id from clusters where fingerprint = $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"updateTorrentCluster",
+		`update torrents set cluster_id = $1 where id = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"selectUnclustered",
+		`select `+torrentColumns+`
+		from torrents t
+		where t.name is not null and t.cluster_id is null
+		limit $1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"removeEmptyClusters",
+		`delete from clusters
+		where not exists (
+			select 1 from torrents t where t.cluster_id = clusters.id
+		)`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertTorrentIP",
+		`insert into torrents_ips
+		(torrent_id, ip) values ($1, $2)
+		on conflict do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"updateTorrentIP",
+		`update torrents_ips set seen = now()
+		where torrent_id = $1 and ip = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"updateAnnounces",
+		`update torrents set
+		announces = announces + 1,
+		seen_ips = seen_ips + $1,
+		first_seen = coalesce(first_seen, now()),
+		last_seen = now()
+		where id = $2`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
+		"insertAnnounceBucket",
+		`insert into torrents_announces
+		(torrent_id, period, bucket, announces)
+		values
+		($1, $2::text, date_trunc($2::text, now()), 1)
+		on conflict (torrent_id, period, bucket) do update set
+		announces = torrents_announces.announces + 1`,
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.pool.Prepare(
 		"updateFTSVectors",
 		`update torrents set
 		tsv = sub.tsv from (
 			select t.id,
 			setweight(to_tsvector(
-				translate(t.name, '._-', ' ')
+				translate(t.name, '._-', '   ')
 			), 'A')
 			|| setweight(to_tsvector(
-				translate(string_agg(coalesce(f.path, ''), ' '), './_-', ' ')
+				translate(coalesce(string_agg(f.path, ' '), ''), './_-', '    ')
 			), 'B') as tsv
 			from torrents t
 			left join files f on t.id = f.torrent_id
@@ -440,50 +1403,320 @@ func (s *Store) prepareStatements() error {
 		return err
 	}
 
-	if _, err := s.Prepare(
-		"baseSchema",
-		`create table if not exists torrents (
-			id serial primary key,
-			infohash bytea not null unique,
-			size bigint,
-			name text,
-			created timestamp with time zone,
-			updated timestamp with time zone,
-			tsv tsvector
-		);
-		create index tsv_idx on torrents using gin(tsv);
-		create table if not exists files (
-			id serial not null primary key,
-			torrent_id integer not null references torrents on delete cascade,
-			path text,
-			size bigint
-		);
-		create table if not exists tags (
-			id serial primary key,
-			name character varying(50) unique
-		);
-		create table if not exists tags_torrents (
-			tag_id integer not null references tags (id) on delete cascade,
-			torrent_id integer not null references torrents (id) on delete cascade,
-			primary key (tag_id, torrent_id)
-		);
-		create table if not exists peers (
-			id serial primary key,
-			address character varying(50) not null,
-			created timestamp with time zone,
-			updated timestamp with time zone
-		);
-		create table if not exists peers_torrents (
-			peer_id integer not null references peers (id) on delete cascade,
-			torrent_id integer not null references torrents (id) on delete cascade,
-			primary key (peer_id, torrent_id)
-		);
-		create table if not exists settings (
-			schema_version integer not null
-		);
-		insert into settings (schema_version) values (1);`,
-	); err != nil {
-		return err
-	}
 	return nil
 }
+
+// pgsqlSearch compiles a page of a query to a statement, its arguments and
+// the number of sort keys selected after torrentColumns. Names have the
+// higher 'A' weight in ts_rank, fuzzy words are ranked by similarity.
+func pgsqlSearch(q *models.Query, page models.Page, now time.Time) (string, []interface{}, int, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	keys, ok := pgsqlOrderKeys[page.Order]
+	if page.Order == models.OrderRelevance {
+		keys, ok = pgsqlOrderKeys[models.OrderDefault], true
+	}
+	if !ok {
+		return "", nil, 0, fmt.Errorf("invalid ordering %d", page.Order)
+	}
+
+	rank, where := pgsqlMatch(q, now, arg)
+	if rank != "" && page.Order == models.OrderRelevance {
+		keys = append([]string{rank}, keys...)
+	}
+	keys = sortKeys(keys...)
+	var after []interface{}
+	if page.Cursor != "" {
+		var err error
+		if after, err = models.DecodeCursor(page.Cursor, page.Order, len(keys)); err != nil {
+			return "", nil, 0, err
+		}
+	}
+
+	from := `torrents t
+		` + pgsqlOrderJoins[page.Order]
+	return searchStatement(from, where, keys, after, page.Limit(), page.Collapse, arg), args, len(keys), nil
+}
+
+// pgsqlCount compiles a count of the matches of a query, or of their
+// clusters when collapsed
+func pgsqlCount(q *models.Query, collapse bool, now time.Time) (string, []interface{}) {
+	var args []interface{}
+	_, where := pgsqlMatch(q, now, func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	})
+	return countStatement("torrents t", where, collapse), args
+}
+
+// pgsqlFacets compiles the facet counts of a query
+func pgsqlFacets(q *models.Query, now time.Time) (string, []interface{}) {
+	var args []interface{}
+	_, where := pgsqlMatch(q, now, func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	})
+	return facetsStatement(
+		`select t.id, t.name, t.size, t.first_seen
+		from torrents t
+		where `+strings.Join(where, "\n\t\tand "),
+		"ilike",
+		func(col string) string { return "to_char(" + col + ", 'YYYY-MM')" },
+	), args
+}
+
+// pgsqlMatch compiles the terms and filters of a query to conditions on
+// torrents t, and a rank of the words where higher is better. Fuzzy words
+// are compared with names by pg_trgm.
+func pgsqlMatch(q *models.Query, now time.Time, arg func(interface{}) string) (string, []string) {
+	// Pending torrents have no name
+	where := []string{"t.name is not null"}
+	var rank string
+	if q.Fuzzy {
+		var ranks []string
+		for _, w := range q.FuzzyWords() {
+			word := arg(w)
+			where = append(where, word+" <<% t.name")
+			ranks = append(ranks, "strict_word_similarity("+word+", t.name)")
+		}
+		if len(ranks) > 0 {
+			rank = "(" + strings.Join(ranks, " + ") + ")"
+		}
+	} else if terms := models.IncludedTerms(q.Terms); len(terms) > 0 {
+		tsquery := pgsqlTSQuery(terms, " && ", arg)
+		where = append(where, "t.tsv @@ "+tsquery)
+		rank = "ts_rank(t.tsv, " + tsquery + ")"
+	}
+	if terms := models.ExcludedTerms(q.Terms); len(terms) > 0 {
+		where = append(where, "not t.tsv @@ "+pgsqlTSQuery(terms, " || ", arg))
+	}
+	for _, tag := range q.Tags {
+		where = append(where, negate(tag.Exclude)+`t.id in (
+			select tt.torrent_id from tags_torrents tt
+			inner join tags ta on tt.tag_id = ta.id
+			where ta.name = `+arg(tag.Text)+`
+		)`)
+	}
+	for _, ext := range q.Exts {
+		pattern := arg("%." + likeEscape(ext.Text))
+		where = append(where, negate(ext.Exclude)+`(
+			exists (
+				select 1 from files f
+				where f.torrent_id = t.id and f.path ilike `+pattern+`
+			) or (
+				not exists (select 1 from files f where f.torrent_id = t.id)
+				and t.name ilike `+pattern+`
+			)
+		)`)
+	}
+	for _, c := range q.Size {
+		where = append(where, "t.size "+c.Op+" "+arg(c.Value))
+	}
+	for _, c := range q.Files {
+		where = append(where, `greatest(1, (
+			select count(*) from files f where f.torrent_id = t.id
+		)) `+c.Op+" "+arg(c.Value))
+	}
+	for _, c := range q.Seen {
+		// An age below a duration is a time after that long ago
+		since := now.Add(-time.Duration(c.Value) * time.Second)
+		where = append(where, "t.last_seen "+c.Invert().Op+" "+arg(since))
+	}
+	if q.Cluster != 0 {
+		where = append(where, "t.cluster_id = "+arg(q.Cluster))
+	}
+	return rank, where
+}
+
+// pgsqlTSQuery joins terms as phrase queries, splitting words as the name
+// vectors are
+func pgsqlTSQuery(terms []string, sep string, arg func(interface{}) string) string {
+	out := make([]string, len(terms))
+	for i, t := range terms {
+		out[i] = "phraseto_tsquery(translate(" + arg(t) + "::text, './_-', '    '))"
+	}
+	return "(" + strings.Join(out, sep) + ")"
+}
+
+// pgsqlOrderKeys are sorted descending, missing times sort last as they do
+// in sqlite
+var pgsqlOrderKeys = map[models.Ordering][]string{
+	models.OrderDefault:  {"t.updated"},
+	models.OrderPopular:  {"t.seen_ips", "t.announces"},
+	models.OrderTrending: {"coalesce(tr.announces, 0)", "coalesce(t.last_seen, 'epoch')"},
+	models.OrderRecent:   {"coalesce(t.last_seen, 'epoch')"},
+	models.OrderSize:     {"t.size"},
+	models.OrderCreated:  {"t.created"},
+}
+
+// pgsqlOrderJoins are required by some orderings
+var pgsqlOrderJoins = map[models.Ordering]string{
+	models.OrderTrending: `left join (
+		select torrent_id, sum(announces) as announces
+		from torrents_announces
+		where period = 'hour'
+		and bucket >= date_trunc('hour', now() - interval '24 hours')
+		group by torrent_id
+	) tr on tr.torrent_id = t.id`,
+}
+
+// pgsqlMigrations match sqliteMigrations, the versions continue those
+// recorded in the settings table by earlier releases
+var pgsqlMigrations = []Migration{
+	{1, "create tables", pgsqlSchema},
+	{2, "announce counters", pgsqlSchemaAnnounces},
+	{3, "fetch attempts", pgsqlSchemaFetchAttempts},
+	{4, "fetch retries", pgsqlSchemaFetchRetries},
+	{5, "peer clients", pgsqlSchemaPeerClients},
+	{6, "torrent metadata", pgsqlSchemaMetadata},
+	{7, "info dictionary fields", pgsqlSchemaInfoFields},
+	{8, "v2 infohashes", pgsqlSchemaInfohashV2},
+	{9, "repaired names", pgsqlSchemaRepaired},
+	{10, "file search", pgsqlSchemaFileSearch},
+	{11, "similar torrents", pgsqlSchemaSimilar},
+	{12, "duplicate clusters", pgsqlSchemaClusters},
+	{13, "announcing ip ages", pgsqlSchemaAnnounceIPs},
+}
+
+const pgsqlSchemaMigrations = `create table if not exists schema_migrations (
+	version integer primary key,
+	name text not null,
+	applied timestamp with time zone not null
+)`
+
+const pgsqlSchema = `create table if not exists torrents (
+	id serial primary key,
+	infohash bytea not null unique,
+	size bigint,
+	name text,
+	created timestamp with time zone,
+	updated timestamp with time zone,
+	tsv tsvector
+);
+create index tsv_idx on torrents using gin(tsv);
+create table if not exists files (
+	id serial not null primary key,
+	torrent_id integer not null references torrents on delete cascade,
+	path text,
+	size bigint
+);
+create index files_torrent_idx on files (torrent_id);
+create table if not exists tags (
+	id serial primary key,
+	name character varying(50) unique
+);
+create table if not exists tags_torrents (
+	tag_id integer not null references tags (id) on delete cascade,
+	torrent_id integer not null references torrents (id) on delete cascade,
+	primary key (tag_id, torrent_id)
+);
+create index tags_torrents_torrent_idx on tags_torrents (torrent_id);
+create table if not exists peers (
+	id serial primary key,
+	address character varying(50) not null unique,
+	created timestamp with time zone,
+	updated timestamp with time zone
+);
+create table if not exists peers_torrents (
+	peer_id integer not null references peers (id) on delete cascade,
+	torrent_id integer not null references torrents (id) on delete cascade,
+	primary key (peer_id, torrent_id)
+);
+create index peers_torrents_torrent_idx on peers_torrents (torrent_id);`
+
+const pgsqlSchemaAnnounces = `alter table torrents add column announces integer not null default 0;
+alter table torrents add column seen_ips integer not null default 0;
+alter table torrents add column first_seen timestamp with time zone;
+alter table torrents add column last_seen timestamp with time zone;
+update torrents set first_seen = created, last_seen = updated;
+create index torrents_last_seen_idx on torrents (last_seen);
+create index torrents_seen_ips_idx on torrents (seen_ips, announces);
+create table if not exists torrents_ips (
+	torrent_id integer not null references torrents on delete cascade,
+	ip character varying(50) not null,
+	primary key (torrent_id, ip)
+);
+create table if not exists torrents_announces (
+	torrent_id integer not null references torrents on delete cascade,
+	period character varying(10) not null,
+	bucket timestamp with time zone not null,
+	announces integer not null default 0,
+	primary key (torrent_id, period, bucket)
+);
+create index torrents_announces_bucket_idx on torrents_announces (period, bucket);`
+
+const pgsqlSchemaFetchAttempts = `alter table torrents add column fetch_attempts integer not null default 0;
+create index peers_updated_idx on peers (updated);`
+
+const pgsqlSchemaFetchRetries = `alter table torrents add column fetch_error text;
+alter table torrents add column fetch_next timestamp with time zone;
+alter table torrents add column unfetchable boolean not null default false;
+alter table peers_torrents add column attempts integer not null default 0;
+create index torrents_pending_idx on torrents (unfetchable, fetch_next) where name is null;`
+
+const pgsqlSchemaPeerClients = `alter table peers add column peer_id bytea;
+alter table peers add column client text;
+alter table peers add column client_version text;
+alter table peers add column agent text;
+create index peers_client_idx on peers (client);`
+
+const pgsqlSchemaMetadata = `create table if not exists torrents_metadata (
+	torrent_id integer primary key references torrents on delete cascade,
+	metadata bytea not null
+);`
+
+const pgsqlSchemaInfoFields = `alter table torrents add column piece_length integer not null default 0;
+alter table torrents add column pieces integer not null default 0;
+alter table torrents add column private boolean not null default false;
+alter table torrents add column source text not null default '';
+alter table torrents add column meta_version integer not null default 1;
+alter table torrents add column hybrid boolean not null default false;
+alter table files add column attributes text not null default '';`
+
+const pgsqlSchemaInfohashV2 = `alter table torrents add column infohash_v2 bytea;
+create unique index torrents_infohash_v2_idx on torrents (infohash_v2);
+create index torrents_infohash_v2_truncated_idx on torrents ((substring(infohash_v2 from 1 for 20)));`
+
+const pgsqlSchemaRepaired = `alter table torrents add column repaired boolean not null default false;`
+
+// pgsqlSchemaFileSearch reindexes the torrents, file paths are already in
+// the vectors
+const pgsqlSchemaFileSearch = `update torrents set
+tsv = sub.tsv from (
+	select t.id,
+	setweight(to_tsvector(
+		translate(t.name, '._-', '   ')
+	), 'A')
+	|| setweight(to_tsvector(
+		translate(coalesce(string_agg(f.path, ' '), ''), './_-', '    ')
+	), 'B') as tsv
+	from torrents t
+	left join files f on t.id = f.torrent_id
+	where t.name is not null
+	group by t.id
+) as sub
+where sub.id = torrents.id;`
+
+// pgsqlSchemaSimilar indexes names for fuzzy searches and finds torrents
+// sharing file sizes
+const pgsqlSchemaSimilar = `create extension if not exists pg_trgm;
+create index torrents_name_trgm_idx on torrents using gin (name gin_trgm_ops);
+create index files_size_idx on files (size);`
+
+// pgsqlSchemaClusters groups torrents by models.Fingerprint, existing
+// torrents are clustered by maintenance
+const pgsqlSchemaClusters = `create table if not exists clusters (
+	id serial primary key,
+	fingerprint character varying(40) not null unique
+);
+alter table torrents add column cluster_id integer references clusters (id) on delete set null;
+create index torrents_cluster_idx on torrents (cluster_id);`
+
+// pgsqlSchemaAnnounceIPs records when each IP last announced a torrent, so
+// maintenance can remove those gone
+const pgsqlSchemaAnnounceIPs = `alter table torrents_ips add column seen timestamp with time zone not null default now();
+create index torrents_ips_seen_idx on torrents_ips (seen);`
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// ErrQueueClosed is returned for writes after a WriteQueue is closed
+var ErrQueueClosed = errors.New("write queue closed")
+
+type writeKind int
+
+const (
+	opSavePeer writeKind = iota
+	opSaveAnnounce
+	opRemovePeer
+	opSaveTorrent
+)
+
+// writeOp is a queued write
+type writeOp struct {
+	kind    writeKind
+	peer    *models.Peer
+	torrent *models.Torrent
+}
+
+// batchWriter is implemented by stores that can apply several writes in one
+// transaction
+type batchWriter interface {
+	writeBatch(context.Context, []writeOp) error
+}
+
+// WriteQueue is a write-behind store. SavePeer, SaveAnnounce, RemovePeer and
+// SaveTorrent are queued and written in batches, everything else goes
+// straight to the underlying store. Queued writes are not visible to reads
+// until flushed.
+//
+// Writers block while the queue is full, until the context is done.
+type WriteQueue struct {
+	models.Store
+	ops       chan writeOp
+	batchSize int
+	interval  time.Duration
+	queueSize int
+	onError   func(error)
+	lock      sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+// QueueOption configures a WriteQueue
+type QueueOption func(*WriteQueue) error
+
+// SetBatchSize sets the most writes flushed in one transaction
+func SetBatchSize(n int) QueueOption {
+	return func(q *WriteQueue) error {
+		if n < 1 {
+			return fmt.Errorf("invalid batch size %d", n)
+		}
+		q.batchSize = n
+		return nil
+	}
+}
+
+// SetFlushInterval sets the longest a write waits in the queue
+func SetFlushInterval(d time.Duration) QueueOption {
+	return func(q *WriteQueue) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid flush interval %s", d)
+		}
+		q.interval = d
+		return nil
+	}
+}
+
+// SetQueueSize sets the number of writes queued before writers block
+func SetQueueSize(n int) QueueOption {
+	return func(q *WriteQueue) error {
+		if n < 0 {
+			return fmt.Errorf("invalid queue size %d", n)
+		}
+		q.queueSize = n
+		return nil
+	}
+}
+
+// SetOnWriteError sets a function called for each write that fails
+func SetOnWriteError(f func(error)) QueueOption {
+	return func(q *WriteQueue) error {
+		q.onError = f
+		return nil
+	}
+}
+
+// NewWriteQueue starts queueing writes to a store
+func NewWriteQueue(s models.Store, opts ...QueueOption) (*WriteQueue, error) {
+	q := &WriteQueue{
+		Store:     s,
+		batchSize: 256,
+		interval:  time.Second,
+		queueSize: 1024,
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			return nil, err
+		}
+	}
+	q.ops = make(chan writeOp, q.queueSize)
+	go q.run()
+	return q, nil
+}
+
+// SavePeer queues a peer
+func (q *WriteQueue) SavePeer(ctx context.Context, p *models.Peer) error {
+	cp := *p
+	return q.enqueue(ctx, writeOp{kind: opSavePeer, peer: &cp})
+}
+
+// SaveAnnounce queues an announce
+func (q *WriteQueue) SaveAnnounce(ctx context.Context, p *models.Peer) error {
+	cp := *p
+	return q.enqueue(ctx, writeOp{kind: opSaveAnnounce, peer: &cp})
+}
+
+// RemovePeer queues a peer removal
+func (q *WriteQueue) RemovePeer(ctx context.Context, p *models.Peer) error {
+	cp := *p
+	return q.enqueue(ctx, writeOp{kind: opRemovePeer, peer: &cp})
+}
+
+// SaveTorrent queues a torrent. Its files, tags and metadata must not be
+// modified afterwards.
+func (q *WriteQueue) SaveTorrent(ctx context.Context, t *models.Torrent) error {
+	ct := *t
+	return q.enqueue(ctx, writeOp{kind: opSaveTorrent, torrent: &ct})
+}
+
+// Close flushes the queued writes and closes the underlying store
+func (q *WriteQueue) Close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.ops)
+	q.lock.Unlock()
+
+	<-q.done
+	return q.Store.Close()
+}
+
+func (q *WriteQueue) enqueue(ctx context.Context, op writeOp) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.ops <- op:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *WriteQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]writeOp, 0, q.batchSize)
+	for {
+		select {
+		case op, ok := <-q.ops:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, op)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch in one transaction where possible. If the batch
+// fails each write is retried alone so one bad write does not lose the rest.
+func (q *WriteQueue) flush(batch []writeOp) {
+	ops := coalesce(batch)
+	if len(ops) == 0 {
+		return
+	}
+	ctx := context.Background()
+
+	if bw, ok := q.Store.(batchWriter); ok {
+		if err := bw.writeBatch(ctx, ops); err == nil {
+			return
+		}
+	}
+	for _, op := range ops {
+		if err := q.write(ctx, op); err != nil && q.onError != nil {
+			q.onError(err)
+		}
+	}
+}
+
+func (q *WriteQueue) write(ctx context.Context, op writeOp) error {
+	switch op.kind {
+	case opSavePeer:
+		return q.Store.SavePeer(ctx, op.peer)
+	case opSaveAnnounce:
+		return q.Store.SaveAnnounce(ctx, op.peer)
+	case opRemovePeer:
+		return q.Store.RemovePeer(ctx, op.peer)
+	case opSaveTorrent:
+		return q.Store.SaveTorrent(ctx, op.torrent)
+	}
+	return fmt.Errorf("unknown write %d", op.kind)
+}
+
+// coalesce drops writes superseded later in the batch: all but the last
+// SaveTorrent for an infohash, and repeated removals of a peer
+func coalesce(batch []writeOp) []writeOp {
+	lastTorrent := make(map[string]int)
+	for i, op := range batch {
+		if op.kind == opSaveTorrent {
+			lastTorrent[op.torrent.Infohash.String()] = i
+		}
+	}
+
+	out := make([]writeOp, 0, len(batch))
+	removed := make(map[string]bool)
+	for i, op := range batch {
+		switch op.kind {
+		case opSaveTorrent:
+			if lastTorrent[op.torrent.Infohash.String()] != i {
+				continue
+			}
+		case opRemovePeer:
+			addr := op.peer.Addr.String()
+			if removed[addr] {
+				continue
+			}
+			removed[addr] = true
+		case opSavePeer:
+			delete(removed, op.peer.Addr.String())
+		}
+		out = append(out, op)
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// blockingStore blocks SavePeer until released
+type blockingStore struct {
+	models.Store
+	release chan struct{}
+}
+
+func (s blockingStore) SavePeer(ctx context.Context, p *models.Peer) error {
+	<-s.release
+	return s.Store.SavePeer(ctx, p)
+}
+
+func queuePeer(t *testing.T, addr string, ih models.Infohash) *models.Peer {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("invalid address: %s", err)
+	}
+	return &models.Peer{Addr: a, Infohash: ih}
+}
+
+func TestWriteQueue(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	q, err := NewWriteQueue(s, SetBatchSize(2), SetFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("NewWriteQueue failed: %s", err)
+	}
+
+	tor := &models.Torrent{Infohash: models.GenInfohash(), Name: "ubuntu", Size: 1, Pieces: 1}
+	if err = q.SavePeer(ctx, queuePeer(t, "10.0.0.1:6881", tor.Infohash)); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+	if err = q.SavePeer(ctx, queuePeer(t, "10.0.0.2:6881", models.GenInfohash())); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+	// A full batch is flushed without waiting for the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peers, err := s.PendingInfohashes(ctx, 10)
+		if err != nil {
+			t.Fatalf("PendingInfohashes failed: %s", err)
+		}
+		if len(peers) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch not flushed, %d pending", len(peers))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Close flushes a partial batch
+	if err = q.SaveTorrent(ctx, tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if _, err = s.TorrentByHash(ctx, tor.Infohash); err != nil {
+		t.Errorf("TorrentByHash failed after Close: %s", err)
+	}
+	if err = q.SavePeer(ctx, queuePeer(t, "10.0.0.3:6881", tor.Infohash)); err != ErrQueueClosed {
+		t.Errorf("SavePeer after Close => %v, expected %v", err, ErrQueueClosed)
+	}
+}
+
+func TestWriteQueueBackpressure(t *testing.T) {
+	s := blockingStore{NewMemoryStore(), make(chan struct{})}
+	q, err := NewWriteQueue(s, SetBatchSize(1), SetQueueSize(1))
+	if err != nil {
+		t.Fatalf("NewWriteQueue failed: %s", err)
+	}
+
+	// One write is blocked in the store and one queued
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err = q.SavePeer(ctx, queuePeer(t, "10.0.0.1:6881", models.GenInfohash())); err != nil {
+			t.Fatalf("SavePeer failed: %s", err)
+		}
+	}
+	if err = q.SavePeer(ctx, queuePeer(t, "10.0.0.1:6881", models.GenInfohash())); err != context.DeadlineExceeded {
+		t.Errorf("SavePeer on full queue => %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	close(s.release)
+	if err = q.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	peers, err := s.PendingInfohashes(context.Background(), 10)
+	if err != nil || len(peers) != 2 {
+		t.Errorf("PendingInfohashes => %d, %v, expected 2", len(peers), err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tor := &models.Torrent{Infohash: models.GenInfohash(), Name: "old"}
+	renamed := &models.Torrent{Infohash: tor.Infohash, Name: "new"}
+	p := queuePeer(t, "10.0.0.1:6881", tor.Infohash)
+
+	ops := coalesce([]writeOp{
+		{kind: opSaveTorrent, torrent: tor},
+		{kind: opRemovePeer, peer: p},
+		{kind: opRemovePeer, peer: p},
+		{kind: opSavePeer, peer: p},
+		{kind: opRemovePeer, peer: p},
+		{kind: opSaveTorrent, torrent: renamed},
+	})
+	expected := []writeKind{opRemovePeer, opSavePeer, opRemovePeer, opSaveTorrent}
+	if len(ops) != len(expected) {
+		t.Fatalf("coalesce => %d writes, expected %d", len(ops), len(expected))
+	}
+	for i, op := range ops {
+		if op.kind != expected[i] {
+			t.Errorf("write %d is %d, expected %d", i, op.kind, expected[i])
+		}
+	}
+	if ops[3].torrent.Name != "new" {
+		t.Errorf("coalesce kept %q, expected the last save", ops[3].torrent.Name)
+	}
+}
+
+func TestSqliteWriteBatch(t *testing.T) {
+	skipWithoutSqlite(t)
+	ctx := context.Background()
+	s, err := NewSqliteStore("file:TestSqliteWriteBatch?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("NewSqliteStore failed: %s", err)
+	}
+	defer s.Close()
+
+	tor := &models.Torrent{Infohash: models.GenInfohash(), Name: "ubuntu", Size: 1, PieceLength: 16384, Pieces: 1, MetaVersion: 1}
+	p := queuePeer(t, "10.0.0.1:6881", tor.Infohash)
+	other := queuePeer(t, "10.0.0.2:6881", models.GenInfohash())
+	err = s.writeBatch(ctx, []writeOp{
+		{kind: opSavePeer, peer: p},
+		{kind: opSavePeer, peer: other},
+		{kind: opSaveTorrent, torrent: tor},
+		{kind: opSaveAnnounce, peer: queuePeer(t, "10.0.0.3:6881", tor.Infohash)},
+		{kind: opRemovePeer, peer: other},
+	})
+	if err != nil {
+		t.Fatalf("writeBatch failed: %s", err)
+	}
+	if _, err = s.TorrentByHash(ctx, tor.Infohash); err != nil {
+		t.Errorf("TorrentByHash failed: %s", err)
+	}
+	peers, err := s.PeersByInfohash(ctx, other.Infohash, 10)
+	if err != nil || len(peers) != 0 {
+		t.Errorf("PeersByInfohash => %v, %v, expected removed", peers, err)
+	}
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"sort"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// similarCandidates is the most torrents found by shared name tokens, and by
+// shared file sizes, to compare with a torrent
+const similarCandidates = 100
+
+// rankSimilar returns the candidates most similar to a torrent
+func rankSimilar(t *models.Torrent, candidates []*models.Torrent, limit int) []models.SimilarTorrent {
+	var out []models.SimilarTorrent
+	for _, c := range candidates {
+		if c.ID == t.ID {
+			continue
+		}
+		if sim := models.Similarity(t, c); sim >= models.MinSimilarity {
+			out = append(out, models.SimilarTorrent{Torrent: c, Similarity: sim})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Similarity != out[j].Similarity {
+			return out[i].Similarity > out[j].Similarity
+		}
+		return out[i].ID > out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
@@ -1,33 +1,40 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"src.userspace.com.au/dhtsearch/models"
 )
 
-// Store is a store
-type Store struct {
+// sqliteDriver is registered with the fuzzy_similarity function and the
+// pragmas of each connection in the pool when built with cgo
+const sqliteDriver = "sqlite3_dhtsearch"
+
+// SqliteStore is a sqlite store
+type SqliteStore struct {
 	stmts map[string]*sql.Stmt
 	conn  *sql.DB
 	lock  sync.RWMutex
 }
 
-// NewStore connects and initializes a new store
-func NewStore(dsn string) (*Store, error) {
-	conn, err := sql.Open("sqlite3", dsn)
+// NewSqliteStore connects and initializes a new sqlite store
+func NewSqliteStore(dsn string) (*SqliteStore, error) {
+	conn, err := sqliteConnect(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open store: %s", err)
+		return nil, err
 	}
 
-	s := &Store{conn: conn, stmts: make(map[string]*sql.Stmt)}
+	s := &SqliteStore{conn: conn, stmts: make(map[string]*sql.Stmt)}
 
-	err = s.migrate()
+	_, err = runMigrations(context.Background(), sqliteMigrator{conn}, sqliteMigrations, false)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -39,16 +46,24 @@ func NewStore(dsn string) (*Store, error) {
 	return s, err
 }
 
-func (s *Store) Close() error {
+func (s *SqliteStore) Close() error {
 	return s.conn.Close()
 }
 
-// PendingInfohashes gets the next pending infohash from the store
-func (s *Store) PendingInfohashes(n int) (peers []*models.Peer, err error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+// PendingInfohashes gets the next pending infohashes from the store, each
+// with the least attempted peer. The infohashes are leased so they are not
+// returned again while being fetched.
+func (s *SqliteStore) PendingInfohashes(ctx context.Context, n int) (peers []*models.Peer, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	rows, err := s.stmts["selectPendingInfohashes"].Query(n)
+	rows, err := tx.StmtContext(ctx, s.stmts["selectPendingInfohashes"]).QueryContext(ctx, n)
 	if err != nil {
 		return nil, err
 	}
@@ -69,178 +84,733 @@ func (s *Store) PendingInfohashes(n int) (peers []*models.Peer, err error) {
 		p.Infohash = ih
 		peers = append(peers, &p)
 	}
-	return peers, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	lease := time.Now().Add(fetchLease).UTC().Format(sqliteTimeFormat)
+	for _, p := range peers {
+		if _, err = tx.StmtContext(ctx, s.stmts["leaseInfohash"]).ExecContext(ctx, lease, p.Infohash); err != nil {
+			return nil, err
+		}
+	}
+	return peers, tx.Commit()
+}
+
+// PeersByInfohash returns up to n peers for an infohash, least attempted
+// first
+func (s *SqliteStore) PeersByInfohash(ctx context.Context, ih models.Infohash, n int) (peers []*models.Peer, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.stmts["selectPeersByInfohash"].QueryContext(ctx, ih, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addr string
+		if err = rows.Scan(&addr); err != nil {
+			return nil, err
+		}
+		p := models.Peer{Infohash: ih}
+		p.Addr, err = net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, &p)
+	}
+	return peers, rows.Err()
 }
 
 // SaveTorrent implements torrentStore
-func (s *Store) SaveTorrent(t *models.Torrent) error {
+func (s *SqliteStore) SaveTorrent(ctx context.Context, t *models.Torrent) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	tx, err := s.conn.Begin()
+	tx, err := s.conn.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("saveTorrent: %s", err)
 	}
 	defer tx.Rollback()
 
+	if err = s.saveTorrent(ctx, tx, t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) saveTorrent(ctx context.Context, tx *sql.Tx, t *models.Torrent) error {
 	var torrentID int64
-	var res sql.Result
-	res, err = tx.Stmt(s.stmts["insertTorrent"]).Exec(t.Name, t.Infohash.Bytes(), t.Size)
+	_, err := tx.StmtContext(ctx, s.stmts["insertTorrent"]).ExecContext(
+		ctx, t.Name, t.Infohash.Bytes(), t.Size, t.PieceLength, t.Pieces,
+		t.Private, t.Source, t.MetaVersion, t.Hybrid, nullBytes(t.InfohashV2),
+		t.Repaired,
+	)
 	if err != nil {
 		return fmt.Errorf("insertTorrent: %s", err)
 	}
-	if torrentID, err = res.LastInsertId(); err != nil {
+	err = tx.StmtContext(ctx, s.stmts["selectTorrentID"]).QueryRowContext(ctx, t.Infohash.Bytes(), t.Infohash.Bytes()).Scan(&torrentID)
+	if err != nil {
 		return fmt.Errorf("insertTorrent: %s", err)
 	}
 
+	// Hybrids may also have been announced by their truncated v2 infohash
+	if t.Hybrid && t.InfohashV2 != nil {
+		alias := t.InfohashV2.Truncated().Bytes()
+		if _, err = tx.StmtContext(ctx, s.stmts["mergeTorrentPeers"]).ExecContext(ctx, torrentID, alias); err != nil {
+			return fmt.Errorf("mergeTorrentPeers: %s", err)
+		}
+		if _, err = tx.StmtContext(ctx, s.stmts["mergeTorrentAnnounces"]).ExecContext(ctx, alias, torrentID); err != nil {
+			return fmt.Errorf("mergeTorrentAnnounces: %s", err)
+		}
+		if _, err = tx.StmtContext(ctx, s.stmts["removeTorrent"]).ExecContext(ctx, alias); err != nil {
+			return fmt.Errorf("removeTorrent: %s", err)
+		}
+	}
+
 	// Write tags
 	for _, tag := range t.Tags {
 		var tagID int64
 
-		res, err = tx.Stmt(s.stmts["insertTag"]).Exec(tag)
-		if err != nil {
+		if _, err = tx.StmtContext(ctx, s.stmts["insertTag"]).ExecContext(ctx, tag); err != nil {
 			return fmt.Errorf("saveTag: %s", err)
 		}
-		tagID, err = res.LastInsertId()
-		if err != nil {
+		if err = tx.StmtContext(ctx, s.stmts["selectTagID"]).QueryRowContext(ctx, tag).Scan(&tagID); err != nil {
 			return fmt.Errorf("saveTag: %s", err)
 		}
-		_, err = tx.Stmt(s.stmts["insertTagTorrent"]).Exec(tagID, torrentID)
+		_, err = tx.StmtContext(ctx, s.stmts["insertTagTorrent"]).ExecContext(ctx, tagID, torrentID)
 		if err != nil {
 			return fmt.Errorf("insertTagTorrent: %s", err)
 		}
 	}
 
-	// Write files
+	// Write files, replacing any previously saved
+	if _, err = tx.StmtContext(ctx, s.stmts["removeFiles"]).ExecContext(ctx, torrentID); err != nil {
+		return fmt.Errorf("removeFiles: %s", err)
+	}
 	for _, f := range t.Files {
-		_, err := tx.Stmt(s.stmts["insertFile"]).Exec(torrentID, f.Path, f.Size)
+		_, err := tx.StmtContext(ctx, s.stmts["insertFile"]).ExecContext(ctx, torrentID, f.Path, f.Size, f.Attributes)
 		if err != nil {
 			return fmt.Errorf("insertFile: %s", err)
 		}
 	}
 
-	return tx.Commit()
+	if err = s.clusterTorrent(ctx, tx, torrentID, t); err != nil {
+		return err
+	}
+
+	// Index the name and file paths for search
+	if _, err = tx.StmtContext(ctx, s.stmts["removeFTS"]).ExecContext(ctx, torrentID); err != nil {
+		return fmt.Errorf("removeFTS: %s", err)
+	}
+	if _, err = tx.StmtContext(ctx, s.stmts["insertFTS"]).ExecContext(ctx, torrentID); err != nil {
+		return fmt.Errorf("insertFTS: %s", err)
+	}
+
+	if len(t.Metadata) > 0 {
+		md, err := compressMetadata(t.Metadata)
+		if err != nil {
+			return fmt.Errorf("compressMetadata: %s", err)
+		}
+		if _, err = tx.StmtContext(ctx, s.stmts["insertMetadata"]).ExecContext(ctx, torrentID, md); err != nil {
+			return fmt.Errorf("insertMetadata: %s", err)
+		}
+	}
+	return nil
 }
 
-func (s *Store) RemoveTorrent(t *models.Torrent) (err error) {
+// clusterTorrent adds a torrent to the cluster of its fingerprint
+func (s *SqliteStore) clusterTorrent(ctx context.Context, tx *sql.Tx, torrentID int64, t *models.Torrent) error {
+	fp := models.Fingerprint(t)
+	if _, err := tx.StmtContext(ctx, s.stmts["insertCluster"]).ExecContext(ctx, fp); err != nil {
+		return fmt.Errorf("insertCluster: %s", err)
+	}
+	if err := tx.StmtContext(ctx, s.stmts["selectClusterID"]).QueryRowContext(ctx, fp).Scan(&t.ClusterID); err != nil {
+		return fmt.Errorf("selectClusterID: %s", err)
+	}
+	if _, err := tx.StmtContext(ctx, s.stmts["updateTorrentCluster"]).ExecContext(ctx, t.ClusterID, torrentID); err != nil {
+		return fmt.Errorf("updateTorrentCluster: %s", err)
+	}
+	return nil
+}
+
+// TorrentMetadata returns the raw info dictionary for an infohash
+func (s *SqliteStore) TorrentMetadata(ctx context.Context, ih models.Infohash) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var md []byte
+	err := s.stmts["selectMetadata"].QueryRowContext(ctx, ih.Bytes(), ih.Bytes(), ih.Truncated().Bytes()).Scan(&md)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("selectMetadata: %s", err)
+	}
+	return decompressMetadata(md)
+}
+
+func (s *SqliteStore) RemoveTorrent(ctx context.Context, t *models.Torrent) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, err = s.stmts["removeTorrent"].Exec(t.Infohash)
-	return fmt.Errorf("removeTorrent: %s", err)
+	if _, err = s.stmts["removeTorrent"].ExecContext(ctx, t.Infohash); err != nil {
+		return fmt.Errorf("removeTorrent: %s", err)
+	}
+	return nil
 }
 
 // SavePeer implements torrentStore
-func (s *Store) SavePeer(p *models.Peer) (err error) {
+func (s *SqliteStore) SavePeer(ctx context.Context, p *models.Peer) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	var peerID int64
-	var torrentID int64
-	var res sql.Result
-
-	tx, err := s.conn.Begin()
+	tx, err := s.conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	if res, err = tx.Stmt(s.stmts["insertPeer"]).Exec(p.Addr.String()); err != nil {
+	if err = s.savePeer(ctx, tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) savePeer(ctx context.Context, tx *sql.Tx, p *models.Peer) (err error) {
+	var peerID int64
+	var torrentID int64
+
+	if _, err = tx.StmtContext(ctx, s.stmts["insertPeer"]).ExecContext(ctx, p.Addr.String()); err != nil {
 		return fmt.Errorf("savePeer: %s", err)
 	}
-	if peerID, err = res.LastInsertId(); err != nil {
+	if err = tx.StmtContext(ctx, s.stmts["selectPeerID"]).QueryRowContext(ctx, p.Addr.String()).Scan(&peerID); err != nil {
 		return fmt.Errorf("savePeer: %s", err)
 	}
 
-	if res, err = tx.Stmt(s.stmts["insertTorrent"]).Exec(nil, p.Infohash, 0); err != nil {
+	// Do not replace existing torrents, they may already have metadata
+	if _, err = tx.StmtContext(ctx, s.stmts["insertPendingTorrent"]).ExecContext(ctx, p.Infohash, p.Infohash); err != nil {
 		return fmt.Errorf("savePeer: %s", err)
 	}
-	if torrentID, err = res.LastInsertId(); err != nil {
+	if err = tx.StmtContext(ctx, s.stmts["selectTorrentID"]).QueryRowContext(ctx, p.Infohash, p.Infohash).Scan(&torrentID); err != nil {
 		return fmt.Errorf("savePeer: %s", err)
 	}
 
-	if _, err = tx.Stmt(s.stmts["insertPeerTorrent"]).Exec(peerID, torrentID); err != nil {
+	if _, err = tx.StmtContext(ctx, s.stmts["insertPeerTorrent"]).ExecContext(ctx, peerID, torrentID); err != nil {
 		return fmt.Errorf("savePeer: %s", err)
 	}
+	if err = s.saveAnnounce(ctx, tx, torrentID, p); err != nil {
+		return fmt.Errorf("savePeer: %s", err)
+	}
+	return nil
+}
+
+// SaveAnnounce records an announce for an existing torrent without queuing
+// the peer for a metadata fetch
+func (s *SqliteStore) SaveAnnounce(ctx context.Context, p *models.Peer) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.saveKnownAnnounce(ctx, tx, p); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
-func (s *Store) RemovePeer(p *models.Peer) (err error) {
+// saveKnownAnnounce counts an announce if the torrent is known
+func (s *SqliteStore) saveKnownAnnounce(ctx context.Context, tx *sql.Tx, p *models.Peer) error {
+	var torrentID int64
+	err := tx.StmtContext(ctx, s.stmts["selectTorrentID"]).QueryRowContext(ctx, p.Infohash, p.Infohash).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("saveAnnounce: %s", err)
+	}
+	if err = s.saveAnnounce(ctx, tx, torrentID, p); err != nil {
+		return fmt.Errorf("saveAnnounce: %s", err)
+	}
+	return nil
+}
+
+// saveAnnounce updates the announce counters for a torrent
+func (s *SqliteStore) saveAnnounce(ctx context.Context, tx *sql.Tx, torrentID int64, p *models.Peer) error {
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.StmtContext(ctx, s.stmts["insertTorrentIP"]).ExecContext(ctx, torrentID, host)
+	if err != nil {
+		return err
+	}
+	newIP, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if newIP == 0 {
+		if _, err = tx.StmtContext(ctx, s.stmts["updateTorrentIP"]).ExecContext(ctx, torrentID, host); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.StmtContext(ctx, s.stmts["updateAnnounces"]).ExecContext(ctx, newIP, torrentID); err != nil {
+		return err
+	}
+	for period, format := range announcePeriods {
+		if _, err = tx.StmtContext(ctx, s.stmts["insertAnnounceBucket"]).ExecContext(ctx, torrentID, period, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStore) RemovePeer(ctx context.Context, p *models.Peer) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, err = s.stmts["removePeer"].Exec(p.Addr.String())
+	_, err = s.stmts["removePeer"].ExecContext(ctx, p.Addr.String())
 	return err
 }
 
+// writeBatch applies queued writes in one transaction
+func (s *SqliteStore) writeBatch(ctx context.Context, ops []writeOp) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range ops {
+		switch op.kind {
+		case opSavePeer:
+			err = s.savePeer(ctx, tx, op.peer)
+		case opSaveAnnounce:
+			err = s.saveKnownAnnounce(ctx, tx, op.peer)
+		case opRemovePeer:
+			_, err = tx.StmtContext(ctx, s.stmts["removePeer"]).ExecContext(ctx, op.peer.Addr.String())
+		case opSaveTorrent:
+			err = s.saveTorrent(ctx, tx, op.torrent)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SavePeerClient records the client fingerprint of a peer
+func (s *SqliteStore) SavePeerClient(ctx context.Context, p *models.Peer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.stmts["savePeerClient"].ExecContext(
+		ctx, p.Addr.String(), p.ID, p.Client.Name, p.Client.Version, p.Agent,
+	)
+	if err != nil {
+		return fmt.Errorf("savePeerClient: %s", err)
+	}
+	return nil
+}
+
+// ClientCounts returns the number of peers seen running each client, most
+// popular first
+func (s *SqliteStore) ClientCounts(ctx context.Context, limit int) ([]models.ClientCount, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.stmts["selectClientCounts"].QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []models.ClientCount
+	for rows.Next() {
+		var c models.ClientCount
+		if err = rows.Scan(&c.Client, &c.Peers); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// FetchFailed records a failed metadata fetch from a peer, scheduling the
+// next attempt or marking the infohash as unfetchable
+func (s *SqliteStore) FetchFailed(ctx context.Context, p *models.Peer, reason error, b models.Backoff) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var torrentID int64
+	var attempts int
+	err = tx.StmtContext(ctx, s.stmts["selectFetchAttempts"]).QueryRowContext(ctx, p.Infohash).Scan(&torrentID, &attempts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetchFailed: %s", err)
+	}
+
+	attempts++
+	var msg string
+	if reason != nil {
+		msg = reason.Error()
+	}
+	next := time.Now().Add(b.Delay(attempts)).UTC().Format(sqliteTimeFormat)
+
+	_, err = tx.StmtContext(ctx, s.stmts["updateFetchFailed"]).ExecContext(
+		ctx, attempts, msg, next, b.Exhausted(attempts), torrentID,
+	)
+	if err != nil {
+		return fmt.Errorf("fetchFailed: %s", err)
+	}
+	if _, err = tx.StmtContext(ctx, s.stmts["incrPeerAttempts"]).ExecContext(ctx, torrentID, p.Addr.String()); err != nil {
+		return fmt.Errorf("fetchFailed: %s", err)
+	}
+	return tx.Commit()
+}
+
+// RemoveStalePeers removes peers not seen since before
+func (s *SqliteStore) RemoveStalePeers(ctx context.Context, before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.stmts["removeStalePeers"].ExecContext(ctx, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, fmt.Errorf("removeStalePeers: %s", err)
+	}
+	return res.RowsAffected()
+}
+
+// RemoveOrphans removes infohashes without metadata that are either
+// unfetchable or have no peers left, and have not been announced since before
+func (s *SqliteStore) RemoveOrphans(ctx context.Context, before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.stmts["removeOrphans"].ExecContext(ctx, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, fmt.Errorf("removeOrphans: %s", err)
+	}
+	if _, err = s.stmts["removeEmptyClusters"].ExecContext(ctx); err != nil {
+		return 0, fmt.Errorf("removeEmptyClusters: %s", err)
+	}
+	return res.RowsAffected()
+}
+
+// ClusterTorrents assigns clusters to up to limit torrents indexed before
+// they were clustered on save
+func (s *SqliteStore) ClusterTorrents(ctx context.Context, limit int) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rows, err := s.stmts["selectUnclustered"].QueryContext(ctx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("selectUnclustered: %s", err)
+	}
+	torrents, err := s.fetchTorrents(ctx, rows)
+	rows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("selectUnclustered: %s", err)
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("clusterTorrents: %s", err)
+	}
+	defer tx.Rollback()
+	for _, t := range torrents {
+		if err = s.clusterTorrent(ctx, tx, int64(t.ID), t); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(torrents)), tx.Commit()
+}
+
+// RemoveAnnounceBuckets removes announce counters for a period older than
+// before
+func (s *SqliteStore) RemoveAnnounceBuckets(ctx context.Context, period string, before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.stmts["removeAnnounceBuckets"].ExecContext(ctx, period, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceBuckets: %s", err)
+	}
+	return res.RowsAffected()
+}
+
+// RemoveAnnounceIPs removes the announcing IPs of torrents not seen since
+// before, recounting their seen_ips from those left
+func (s *SqliteStore) RemoveAnnounceIPs(ctx context.Context, before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
+	}
+	defer tx.Rollback()
+
+	since := before.UTC().Format(sqliteTimeFormat)
+	if _, err = tx.StmtContext(ctx, s.stmts["recountSeenIPs"]).ExecContext(ctx, since); err != nil {
+		return 0, fmt.Errorf("recountSeenIPs: %s", err)
+	}
+	res, err := tx.StmtContext(ctx, s.stmts["removeAnnounceIPs"]).ExecContext(ctx, since)
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("removeAnnounceIPs: %s", err)
+	}
+	return n, tx.Commit()
+}
+
+// Optimize merges the full text index and rebuilds the database file
+func (s *SqliteStore) Optimize(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.conn.ExecContext(ctx, `insert into torrents_fts(torrents_fts) values('optimize')`); err != nil {
+		return fmt.Errorf("optimize: %s", err)
+	}
+	if _, err := s.conn.ExecContext(ctx, `vacuum`); err != nil {
+		return fmt.Errorf("vacuum: %s", err)
+	}
+	return nil
+}
+
+// IndexedInfohashes calls fn for each infohash that has metadata
+func (s *SqliteStore) IndexedInfohashes(ctx context.Context, fn func(models.Infohash) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.stmts["selectIndexedInfohashes"].QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ih models.Infohash
+		if err = rows.Scan(&ih); err != nil {
+			return err
+		}
+		if err = fn(ih); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 // TorrentsByHash implements torrentStore
-func (s *Store) TorrentByHash(ih models.Infohash) (*models.Torrent, error) {
+func (s *SqliteStore) TorrentByHash(ctx context.Context, ih models.Infohash) (*models.Torrent, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	rows, err := s.stmts["getTorrent"].Query(ih)
+	rows, err := s.stmts["getTorrent"].QueryContext(ctx, ih, ih, ih.Truncated())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
+	torrents, err := s.fetchTorrents(ctx, rows)
 	if err != nil {
 		return nil, err
 	}
+	if len(torrents) == 0 {
+		return nil, models.ErrNotFound
+	}
 	return torrents[0], nil
 }
 
-// TorrentsByName implements torrentStore
-func (s *Store) TorrentsByName(query string, offset int) ([]*models.Torrent, error) {
+// TorrentsByName searches torrents with the query language of
+// models.ParseQuery
+func (s *SqliteStore) TorrentsByName(ctx context.Context, query string, page models.Page) (*models.Results, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.search(ctx, q, page)
+}
+
+// search returns a page of the torrents matching a query, with the files
+// matching its words highlighted
+func (s *SqliteStore) search(ctx context.Context, q *models.Query, page models.Page) (*models.Results, error) {
+	results := new(models.Results)
+	if q.Empty() {
+		return results, nil
+	}
+	now := time.Now()
+	stmt, args, nkeys, err := sqliteSearch(q, page, now)
+	if err != nil {
+		return nil, err
+	}
+
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	rows, err := s.stmts["searchTorrents"].Query(fmt.Sprintf("%%%s%%", query), offset)
+	rows, err := s.conn.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
+	dest, keys := scanKeys(nkeys)
+	var variants []interface{}
+	if page.Collapse {
+		dest = append(dest, columnValues{&variants})
+	}
+	if results.Torrents, err = s.fetchTorrents(ctx, rows, dest...); err != nil {
+		return nil, err
+	}
+	setVariants(results.Torrents, variants)
+	results.Next = nextCursor(len(results.Torrents), page, keys)
+
+	var total int
+	stmt, args = sqliteCount(q, page.Collapse, now)
+	if err = s.conn.QueryRowContext(ctx, stmt, args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("countTorrents: %s", err)
+	}
+	results.SetTotal(total)
+
+	terms := models.IncludedTerms(q.Terms)
+	if len(terms) == 0 || q.Fuzzy {
+		return results, nil
+	}
+	for _, t := range results.Torrents {
+		var marked string
+		err = s.stmts["selectFileHighlights"].QueryRowContext(ctx, ftsQuery(terms, " OR "), t.ID).Scan(&marked)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("selectFileHighlights: %s", err)
+		}
+		t.Highlights = fileHighlights(marked)
+	}
+	return results, nil
+}
+
+// TorrentFacets counts the torrents matching a query by facet
+func (s *SqliteStore) TorrentFacets(ctx context.Context, query string) (*models.Facets, error) {
+	q, err := models.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	facets := new(models.Facets)
+	if q.Empty() {
+		return facets, nil
+	}
+	stmt, args := sqliteFacets(q, time.Now())
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.conn.QueryContext(ctx, stmt, args...)
 	if err != nil {
+		return nil, fmt.Errorf("selectFacets: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var facet, value string
+		var count int
+		if err = rows.Scan(&facet, &value, &count); err != nil {
+			return nil, err
+		}
+		facets.Add(facet, value, count)
+	}
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return torrents, nil
+	facets.Sort()
+	return facets, nil
 }
 
 // TorrentsByTag implements torrentStore
-func (s *Store) TorrentsByTag(tag string, offset int) ([]*models.Torrent, error) {
+func (s *SqliteStore) TorrentsByTag(ctx context.Context, tag string, page models.Page) (*models.Results, error) {
+	return s.search(ctx, &models.Query{Tags: []models.QueryTerm{{Text: tag}}}, page)
+}
+
+// SimilarTorrents compares a torrent with those sharing its name tokens or
+// file sizes
+func (s *SqliteStore) SimilarTorrents(ctx context.Context, ih models.Infohash, limit int) ([]models.SimilarTorrent, error) {
+	t, err := s.TorrentByHash(ctx, ih)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("?%d", len(args))
+	}
+	shared := []string{`t.id in (
+		select f2.torrent_id from files f1
+		inner join files f2 on f2.size = f1.size
+		where f1.torrent_id = ` + arg(t.ID) + ` and f1.size > 0
+		limit ` + arg(similarCandidates) + `
+	)`}
+	if tokens := models.NameTokens(t.Name); len(tokens) > 0 {
+		for i, tok := range tokens {
+			tokens[i] = "name : " + ftsQuery([]string{tok}, "")
+		}
+		shared = append(shared, `t.id in (
+			select rowid from torrents_fts
+			where torrents_fts match `+arg(strings.Join(tokens, " OR "))+`
+			order by rank limit `+arg(similarCandidates)+`
+		)`)
+	}
+
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	rows, err := s.stmts["torrentsByTag"].Query(tag, offset)
+	rows, err := s.conn.QueryContext(ctx, `select `+torrentColumns+`
+		from torrents t
+		where t.name is not null
+		and (`+strings.Join(shared, " or ")+`)`, args...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("selectSimilar: %s", err)
 	}
 	defer rows.Close()
-	torrents, err := s.fetchTorrents(rows)
+	candidates, err := s.fetchTorrents(ctx, rows)
 	if err != nil {
 		return nil, err
 	}
-	return torrents, nil
+	return rankSimilar(t, candidates, limit), nil
 }
 
 // SaveTag implements tagStore interface
-func (s *Store) SaveTag(tag string) (int, error) {
+func (s *SqliteStore) SaveTag(ctx context.Context, tag string) (int, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	res, err := s.stmts["insertTag"].Exec(tag)
-	if err != nil {
+	if _, err := s.stmts["insertTag"].ExecContext(ctx, tag); err != nil {
 		return 0, fmt.Errorf("saveTag: %s", err)
 	}
-	tagID, err := res.LastInsertId()
-	if err != nil {
+	var tagID int
+	if err := s.stmts["selectTagID"].QueryRowContext(ctx, tag).Scan(&tagID); err != nil {
 		return 0, fmt.Errorf("saveTag: %s", err)
 	}
-	return int(tagID), nil
+	return tagID, nil
 }
 
-func (s *Store) fetchTorrents(rows *sql.Rows) (torrents []*models.Torrent, err error) {
+// fetchTorrents scans rows of torrentColumns followed by any extra columns,
+// adding the files and tags of each torrent
+func (s *SqliteStore) fetchTorrents(ctx context.Context, rows *sql.Rows, extra ...interface{}) (torrents []*models.Torrent, err error) {
 	for rows.Next() {
 		var t models.Torrent
 		/*
@@ -249,38 +819,51 @@ func (s *Store) fetchTorrents(rows *sql.Rows) (torrents []*models.Torrent, err e
 				Tags:  []string{},
 			}
 		*/
-		err = rows.Scan(
-			&t.ID, &t.Infohash, &t.Name, &t.Size, &t.Created, &t.Updated,
-		)
+		var created, updated, firstSeen, lastSeen timestamp
+		var infohashV2 []byte
+		err = rows.Scan(append([]interface{}{
+			&t.ID, &t.Infohash, &t.Name, &t.Size, &created, &updated,
+			&t.Announces, &t.SeenIPs, &firstSeen, &lastSeen,
+			&t.PieceLength, &t.Pieces, &t.Private, &t.Source, &t.MetaVersion, &t.Hybrid,
+			&infohashV2, &t.Repaired, &t.ClusterID,
+		}, extra...)...)
 		if err != nil {
 			return nil, err
 		}
+		if infohashV2 != nil {
+			t.InfohashV2 = models.Infohash(infohashV2)
+		}
+		t.Created = time.Time(created)
+		t.Updated = time.Time(updated)
+		t.FirstSeen = time.Time(firstSeen)
+		t.LastSeen = time.Time(lastSeen)
 
 		err = func() error {
-			rowsf, err := s.stmts["selectFiles"].Query(t.ID)
-			defer rowsf.Close()
+			rowsf, err := s.stmts["selectFiles"].QueryContext(ctx, t.ID)
 			if err != nil {
 				return fmt.Errorf("failed to select files: %s", err)
 			}
+			defer rowsf.Close()
 			for rowsf.Next() {
 				var f models.File
-				err = rowsf.Scan(&f.ID, &f.TorrentID, &f.Path, &f.Size)
+				err = rowsf.Scan(&f.ID, &f.TorrentID, &f.Path, &f.Size, &f.Attributes)
 				if err != nil {
 					return fmt.Errorf("failed to build file: %s", err)
 				}
+				t.Files = append(t.Files, f)
 			}
-			return nil
+			return rowsf.Err()
 		}()
 		if err != nil {
 			return nil, err
 		}
 
 		err = func() error {
-			rowst, err := s.stmts["selectTags"].Query(t.ID)
-			defer rowst.Close()
+			rowst, err := s.stmts["selectTags"].QueryContext(ctx, t.ID)
 			if err != nil {
 				return fmt.Errorf("failed to select tags: %s", err)
 			}
+			defer rowst.Close()
 			for rowst.Next() {
 				var tg string
 				err = rowst.Scan(&tg)
@@ -289,51 +872,126 @@ func (s *Store) fetchTorrents(rows *sql.Rows) (torrents []*models.Torrent, err e
 				}
 				t.Tags = append(t.Tags, tg)
 			}
-			return nil
+			return rowst.Err()
 		}()
 		if err != nil {
 			return nil, err
 		}
-		torrents = append(torrents, &t)
+		torrents = append(torrents, &t)
+	}
+	return torrents, rows.Err()
+}
+
+// sqliteConnect opens a sqlite database
+func sqliteConnect(dsn string) (*sql.DB, error) {
+	conn, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+	// These are kept in the database, the rest are set on connect
+	_, err = conn.Exec(`
+	pragma journal_mode=wal;
+	pragma encoding='utf-8';
+	`)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+	return conn, nil
+}
+
+// sqliteMigrator also keeps user_version, which was the only record of the
+// schema version before schema_migrations
+type sqliteMigrator struct {
+	conn *sql.DB
+}
+
+func (m sqliteMigrator) appliedVersions(ctx context.Context) (map[int]bool, error) {
+	var tables int
+	err := m.conn.QueryRowContext(
+		ctx,
+		`select count(*) from sqlite_master
+		where type = 'table' and name = 'schema_migrations'`,
+	).Scan(&tables)
+	if err != nil {
+		return nil, err
+	}
+	if tables == 0 {
+		var version int
+		if err = m.conn.QueryRowContext(ctx, `pragma user_version`).Scan(&version); err != nil {
+			return nil, err
+		}
+		return baselineVersions(version), nil
 	}
-	return torrents, err
-}
 
-func (s *Store) migrate() error {
-	_, err := s.conn.Exec(`
-	pragma journal_mode=wal;
-	pragma temp_store=1;
-	pragma foreign_keys=on;
-	pragma encoding='utf-8';
-	`)
+	rows, err := m.conn.QueryContext(ctx, `select version from schema_migrations`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
 
-	tx, err := s.conn.Begin()
+func (m sqliteMigrator) applyMigration(ctx context.Context, mg Migration) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	var version int
-	err = tx.QueryRow("pragma user_version;").Scan(&version)
-	if err != nil {
+	if err = tx.QueryRowContext(ctx, `pragma user_version`).Scan(&version); err != nil {
 		return err
 	}
-
-	if version == 0 {
-		_, err = tx.Exec(sqliteSchema)
+	if _, err = tx.ExecContext(ctx, sqliteSchemaMigrations); err != nil {
+		return err
+	}
+	// Record migrations applied before schema_migrations
+	for _, prev := range sqliteMigrations {
+		if prev.Version > version {
+			break
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			`insert or ignore into schema_migrations (version, name, applied)
+			values (?, ?, datetime('now'))`,
+			prev.Version, prev.Name,
+		)
 		if err != nil {
 			return err
 		}
 	}
-	tx.Commit()
 
-	return nil
+	if _, err = tx.ExecContext(ctx, mg.SQL); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`insert into schema_migrations (version, name, applied)
+		values (?, ?, datetime('now'))`,
+		mg.Version, mg.Name,
+	)
+	if err != nil {
+		return err
+	}
+	if version < mg.Version {
+		// Pragmas do not take parameters
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d", mg.Version)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *Store) prepareStatements() error {
+func (s *SqliteStore) prepareStatements() error {
 	var err error
 	if s.stmts["removeTorrent"], err = s.conn.Prepare(
 		`delete from torrents
@@ -343,30 +1001,212 @@ func (s *Store) prepareStatements() error {
 	}
 
 	if s.stmts["selectPendingInfohashes"], err = s.conn.Prepare(
-		`select max(p.address) as address, t.infohash
+		`select p.address, t.infohash
 		from torrents t
 		join peers_torrents pt on pt.torrent_id = t.id
 		join peers p on p.id = pt.peer_id
 		where t.name is null
-		group by t.infohash
+		and not t.unfetchable
+		and (t.fetch_next is null or t.fetch_next <= datetime('now'))
+		and pt.peer_id = (
+			select pt2.peer_id from peers_torrents pt2
+			where pt2.torrent_id = t.id
+			order by pt2.attempts asc, pt2.peer_id desc
+			limit 1
+		)
+		order by t.fetch_attempts asc, t.last_seen desc
+		limit ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectPeersByInfohash"], err = s.conn.Prepare(
+		`select p.address
+		from peers p
+		join peers_torrents pt on pt.peer_id = p.id
+		join torrents t on t.id = pt.torrent_id
+		where t.infohash = ?
+		order by pt.attempts asc, p.updated desc
 		limit ?`,
 	); err != nil {
 		return err
 	}
 
 	if s.stmts["selectFiles"], err = s.conn.Prepare(
-		`select * from files
+		`select id, torrent_id, path, size, attributes from files
 		where torrent_id = ?
 		order by path asc`,
 	); err != nil {
 		return err
 	}
 
+	if s.stmts["removeFiles"], err = s.conn.Prepare(
+		`delete from files where torrent_id = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["removeFTS"], err = s.conn.Prepare(
+		`delete from torrents_fts where rowid = ?`,
+	); err != nil {
+		return err
+	}
+
+	// Paths are one per line
+	if s.stmts["insertFTS"], err = s.conn.Prepare(
+		`insert into torrents_fts (rowid, name, files)
+		select t.id, t.name, (
+			select group_concat(path, char(10)) from (
+				select f.path from files f
+				where f.torrent_id = t.id order by f.path
+			)
+		)
+		from torrents t where t.id = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectFileHighlights"], err = s.conn.Prepare(
+		`select coalesce(highlight(torrents_fts, 1, char(2), char(3)), '')
+		from torrents_fts
+		where torrents_fts match ? and rowid = ?`,
+	); err != nil {
+		return err
+	}
+
 	if s.stmts["insertPeer"], err = s.conn.Prepare(
-		`insert or ignore into peers
+		`insert into peers
 		(address, created, updated)
 		values
-		(?, date('now'), date('now'))`,
+		(?, datetime('now'), datetime('now'))
+		on conflict (address) do update set
+		updated = excluded.updated`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["insertMetadata"], err = s.conn.Prepare(
+		`insert or replace into torrents_metadata
+		(torrent_id, metadata) values (?, ?)`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectMetadata"], err = s.conn.Prepare(
+		`select m.metadata
+		from torrents_metadata m
+		join torrents t on t.id = m.torrent_id
+		where t.infohash = ? or t.infohash_v2 = ? or substr(t.infohash_v2, 1, 20) = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["savePeerClient"], err = s.conn.Prepare(
+		`insert into peers
+		(address, peer_id, client, client_version, agent, created, updated)
+		values
+		(?, ?, ?, ?, ?, datetime('now'), datetime('now'))
+		on conflict (address) do update set
+		peer_id = excluded.peer_id,
+		client = excluded.client,
+		client_version = excluded.client_version,
+		agent = excluded.agent,
+		updated = excluded.updated`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectClientCounts"], err = s.conn.Prepare(
+		`select coalesce(nullif(client, ''), 'unknown') as name, count(*) as c
+		from peers
+		where client is not null
+		group by name
+		order by c desc, name asc
+		limit ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["removeStalePeers"], err = s.conn.Prepare(
+		`delete from peers where updated < ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectFetchAttempts"], err = s.conn.Prepare(
+		`select id, fetch_attempts from torrents
+		where infohash = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["updateFetchFailed"], err = s.conn.Prepare(
+		`update torrents set
+		fetch_attempts = ?,
+		fetch_error = ?,
+		fetch_next = ?,
+		unfetchable = ?
+		where id = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["incrPeerAttempts"], err = s.conn.Prepare(
+		`update peers_torrents set
+		attempts = attempts + 1
+		where torrent_id = ?
+		and peer_id = (select id from peers where address = ?)`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["leaseInfohash"], err = s.conn.Prepare(
+		`update torrents set fetch_next = ?
+		where infohash = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["removeOrphans"], err = s.conn.Prepare(
+		`delete from torrents
+		where name is null
+		and (
+			unfetchable
+			or not exists (
+				select 1 from peers_torrents pt
+				where pt.torrent_id = torrents.id
+			)
+		)
+		and coalesce(last_seen, updated) < ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["removeAnnounceBuckets"], err = s.conn.Prepare(
+		`delete from torrents_announces
+		where period = ? and bucket < ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["removeAnnounceIPs"], err = s.conn.Prepare(
+		`delete from torrents_ips where seen < ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["recountSeenIPs"], err = s.conn.Prepare(
+		`update torrents set seen_ips = (
+			select count(*) from torrents_ips i
+			where i.torrent_id = torrents.id and i.seen >= ?1
+		)
+		where id in (select torrent_id from torrents_ips where seen < ?1)`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectPeerID"], err = s.conn.Prepare(
+		`select id from peers where address = ?`,
 	); err != nil {
 		return err
 	}
@@ -381,26 +1221,91 @@ func (s *Store) prepareStatements() error {
 	}
 
 	if s.stmts["insertTorrent"], err = s.conn.Prepare(
-		`insert or replace into torrents (
-			name, infohash, size, created, updated
+		`insert into torrents (
+			name, infohash, size, piece_length, pieces,
+			private, source, meta_version, hybrid, infohash_v2, repaired,
+			created, updated
 		) values (
-			?, ?, ?, date('now'), date('now')
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, date('now'), date('now')
+		) on conflict (infohash) do update set
+		infohash_v2 = excluded.infohash_v2,
+		name = excluded.name,
+		size = excluded.size,
+		piece_length = excluded.piece_length,
+		pieces = excluded.pieces,
+		private = excluded.private,
+		source = excluded.source,
+		meta_version = excluded.meta_version,
+		hybrid = excluded.hybrid,
+		repaired = excluded.repaired,
+		updated = excluded.updated`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["insertPendingTorrent"], err = s.conn.Prepare(
+		`insert or ignore into torrents (
+			infohash, created, updated, first_seen
+		) select ?, date('now'), date('now'), datetime('now')
+		where not exists (
+			select 1 from torrents where substr(infohash_v2, 1, 20) = ?
 		)`,
 	); err != nil {
 		return err
 	}
 
+	if s.stmts["selectTorrentID"], err = s.conn.Prepare(
+		`select id from torrents where infohash = ?
+		union all
+		select id from torrents where substr(infohash_v2, 1, 20) = ?
+		limit 1`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["mergeTorrentPeers"], err = s.conn.Prepare(
+		`insert or ignore into peers_torrents (peer_id, torrent_id, attempts)
+		select pt.peer_id, ?, pt.attempts
+		from peers_torrents pt
+		join torrents t on t.id = pt.torrent_id
+		where t.infohash = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["mergeTorrentAnnounces"], err = s.conn.Prepare(
+		`update torrents set announces = announces + coalesce((
+			select announces from torrents where infohash = ?
+		), 0)
+		where id = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectIndexedInfohashes"], err = s.conn.Prepare(
+		`select infohash from torrents where name is not null
+		union all
+		select substr(infohash_v2, 1, 20) from torrents
+		where name is not null and hybrid`,
+	); err != nil {
+		return err
+	}
+
 	if s.stmts["getTorrent"], err = s.conn.Prepare(
-		`select * from torrents where infohash = ? limit 1`,
+		`select ` + torrentColumns + `
+		from torrents t
+		where (t.infohash = ? or t.infohash_v2 = ? or substr(t.infohash_v2, 1, 20) = ?)
+		and t.name is not null
+		limit 1`,
 	); err != nil {
 		return err
 	}
 
 	if s.stmts["insertFile"], err = s.conn.Prepare(
 		`insert into files
-		(torrent_id, path, size)
+		(torrent_id, path, size, attributes)
 		values
-		(?, ?, ?)`,
+		(?, ?, ?, ?)`,
 	); err != nil {
 		return err
 	}
@@ -427,34 +1332,89 @@ func (s *Store) prepareStatements() error {
 		return err
 	}
 
+	// Replacing would cascade to the tags of other torrents
 	if s.stmts["insertTag"], err = s.conn.Prepare(
-		`insert or replace into tags (name) values (?)`,
+		`insert into tags (name) values (?)
+		on conflict (name) do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectTagID"], err = s.conn.Prepare(
+		`select id from tags where name = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["insertCluster"], err = s.conn.Prepare(
+		`insert into clusters (fingerprint) values (?)
+		on conflict (fingerprint) do nothing`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["selectClusterID"], err = s.conn.Prepare(
+		`select id from clusters where fingerprint = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["updateTorrentCluster"], err = s.conn.Prepare(
+		`update torrents set cluster_id = ? where id = ?`,
 	); err != nil {
 		return err
 	}
 
-	if s.stmts["torrentsByTag"], err = s.conn.Prepare(
-		`select t.id, t.infohash, t.name, t.size, t.created, t.updated
+	if s.stmts["selectUnclustered"], err = s.conn.Prepare(
+		`select ` + torrentColumns + `
 		from torrents t
-		inner join tags_torrents tt on t.id = tt.torrent_id
-		inner join tags ta on tt.tag_id = ta.id
-		where ta.name = ? group by t.id
-		order by updated asc
-		limit 50 offset ?`,
+		where t.name is not null and t.cluster_id is null
+		limit ?`,
 	); err != nil {
 		return err
 	}
 
-	if s.stmts["searchTorrents"], err = s.conn.Prepare(
-		`select id, infohash, name, size, updated
-		from torrents
-		where id in (
-			select * from torrents_fts
-			where torrents_fts match ?
-			order by rank desc
-		)
-		order by updated desc
-		limit 50 offset ?`,
+	if s.stmts["removeEmptyClusters"], err = s.conn.Prepare(
+		`delete from clusters
+		where not exists (
+			select 1 from torrents t where t.cluster_id = clusters.id
+		)`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["insertTorrentIP"], err = s.conn.Prepare(
+		`insert or ignore into torrents_ips
+		(torrent_id, ip, seen) values (?, ?, datetime('now'))`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["updateTorrentIP"], err = s.conn.Prepare(
+		`update torrents_ips set seen = datetime('now')
+		where torrent_id = ? and ip = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["updateAnnounces"], err = s.conn.Prepare(
+		`update torrents set
+		announces = announces + 1,
+		seen_ips = seen_ips + ?,
+		first_seen = coalesce(first_seen, datetime('now')),
+		last_seen = datetime('now')
+		where id = ?`,
+	); err != nil {
+		return err
+	}
+
+	if s.stmts["insertAnnounceBucket"], err = s.conn.Prepare(
+		`insert into torrents_announces
+		(torrent_id, period, bucket, announces)
+		values
+		(?, ?, strftime(?, 'now'), 1)
+		on conflict (torrent_id, period, bucket) do update set
+		announces = announces + 1`,
 	); err != nil {
 		return err
 	}
@@ -462,6 +1422,280 @@ func (s *Store) prepareStatements() error {
 	return nil
 }
 
+// torrentColumns are scanned by fetchTorrents
+const torrentColumns = `t.id, t.infohash, t.name, t.size, t.created, t.updated,
+	t.announces, t.seen_ips, t.first_seen, t.last_seen,
+	t.piece_length, t.pieces, t.private, t.source, t.meta_version, t.hybrid,
+	t.infohash_v2, t.repaired, coalesce(t.cluster_id, 0)`
+
+// announcePeriods maps bucket periods to their strftime formats
+var announcePeriods = map[string]string{
+	"hour": "%Y-%m-%d %H:00:00",
+	"day":  "%Y-%m-%d 00:00:00",
+}
+
+// orderKeys are sorted descending. Times are compared as they are stored,
+// missing times sort last.
+var orderKeys = map[models.Ordering][]string{
+	models.OrderDefault:  {"coalesce(t.updated, '')"},
+	models.OrderPopular:  {"t.seen_ips", "t.announces"},
+	models.OrderTrending: {"coalesce(tr.announces, 0)", "coalesce(t.last_seen, '')"},
+	models.OrderRecent:   {"coalesce(t.last_seen, '')"},
+	models.OrderSize:     {"t.size"},
+	models.OrderCreated:  {"coalesce(t.created, '')"},
+}
+
+// orderJoins are required by some orderings
+var orderJoins = map[models.Ordering]string{
+	models.OrderTrending: `left join (
+		select torrent_id, sum(announces) as announces
+		from torrents_announces
+		where period = 'hour'
+		and bucket >= strftime('%Y-%m-%d %H:00:00', 'now', '-24 hours')
+		group by torrent_id
+	) tr on tr.torrent_id = t.id`,
+}
+
+// fetchLease is how long a pending infohash is withheld while being fetched
+const fetchLease = 2 * time.Minute
+
+// sqliteTimeFormat matches the output of datetime('now')
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqliteSearch compiles a page of a query to a statement, its arguments and
+// the number of sort keys selected after torrentColumns. Words are ranked by
+// bm25, where lower is better, with names weighted above files, or by the
+// similarity of fuzzy words.
+func sqliteSearch(q *models.Query, page models.Page, now time.Time) (string, []interface{}, int, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("?%d", len(args))
+	}
+
+	keys, ok := orderKeys[page.Order]
+	if page.Order == models.OrderRelevance {
+		keys, ok = orderKeys[models.OrderDefault], true
+	}
+	if !ok {
+		return "", nil, 0, fmt.Errorf("invalid ordering %d", page.Order)
+	}
+
+	joins, rank, where := sqliteMatch(q, now, arg)
+	if rank != "" && page.Order == models.OrderRelevance {
+		keys = append([]string{rank}, keys...)
+	}
+	keys = sortKeys(keys...)
+	var after []interface{}
+	if page.Cursor != "" {
+		var err error
+		if after, err = models.DecodeCursor(page.Cursor, page.Order, len(keys)); err != nil {
+			return "", nil, 0, err
+		}
+	}
+
+	from := `torrents t
+		` + joins + `
+		` + orderJoins[page.Order]
+	return searchStatement(from, where, keys, after, page.Limit(), page.Collapse, arg), args, len(keys), nil
+}
+
+// sqliteCount compiles a count of the matches of a query, or of their
+// clusters when collapsed
+func sqliteCount(q *models.Query, collapse bool, now time.Time) (string, []interface{}) {
+	var args []interface{}
+	joins, _, where := sqliteMatch(q, now, func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("?%d", len(args))
+	})
+	return countStatement("torrents t "+joins, where, collapse), args
+}
+
+// sqliteFacets compiles the facet counts of a query
+func sqliteFacets(q *models.Query, now time.Time) (string, []interface{}) {
+	var args []interface{}
+	joins, _, where := sqliteMatch(q, now, func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("?%d", len(args))
+	})
+	return facetsStatement(
+		`select t.id, t.name, t.size, t.first_seen
+		from torrents t
+		`+joins+`
+		where `+strings.Join(where, "\n\t\tand "),
+		"like",
+		func(col string) string { return "strftime('%Y-%m', " + col + ")" },
+	), args
+}
+
+// sqliteMatch compiles the terms and filters of a query to joins and
+// conditions on torrents t, and a rank of the words where higher is better.
+// Words are joined as fts, or fuzzy words compared with names.
+func sqliteMatch(q *models.Query, now time.Time, arg func(interface{}) string) (string, string, []string) {
+	// Pending torrents have no name
+	where := []string{"t.name is not null"}
+
+	var joins, rank string
+	if q.Fuzzy {
+		var ranks []string
+		for _, w := range q.FuzzyWords() {
+			sim := "fuzzy_similarity(" + arg(w) + ", coalesce(t.name, ''))"
+			where = append(where, sim+" >= "+fmt.Sprint(models.FuzzyThreshold))
+			ranks = append(ranks, sim)
+		}
+		if len(ranks) > 0 {
+			rank = "(" + strings.Join(ranks, " + ") + ")"
+		}
+	} else if terms := models.IncludedTerms(q.Terms); len(terms) > 0 {
+		joins = `inner join (
+			select rowid, bm25(torrents_fts, 10.0, 1.0) as rank from torrents_fts
+			where torrents_fts match ` + arg(ftsQuery(terms, " ")) + `
+		) fts on fts.rowid = t.id`
+		rank = "-fts.rank"
+	}
+
+	if terms := models.ExcludedTerms(q.Terms); len(terms) > 0 {
+		where = append(where, `t.id not in (
+			select rowid from torrents_fts
+			where torrents_fts match `+arg(ftsQuery(terms, " OR "))+`
+		)`)
+	}
+	for _, tag := range q.Tags {
+		where = append(where, negate(tag.Exclude)+`t.id in (
+			select tt.torrent_id from tags_torrents tt
+			inner join tags ta on tt.tag_id = ta.id
+			where ta.name = `+arg(tag.Text)+`
+		)`)
+	}
+	for _, ext := range q.Exts {
+		pattern := "%." + likeEscape(ext.Text)
+		where = append(where, negate(ext.Exclude)+`(
+			exists (
+				select 1 from files f
+				where f.torrent_id = t.id and f.path like `+arg(pattern)+` escape '\'
+			) or (
+				not exists (select 1 from files f where f.torrent_id = t.id)
+				and t.name like `+arg(pattern)+` escape '\'
+			)
+		)`)
+	}
+	for _, c := range q.Size {
+		where = append(where, "t.size "+c.Op+" "+arg(c.Value))
+	}
+	for _, c := range q.Files {
+		where = append(where, `max(1, (
+			select count(*) from files f where f.torrent_id = t.id
+		)) `+c.Op+" "+arg(c.Value))
+	}
+	for _, c := range q.Seen {
+		// An age below a duration is a time after that long ago
+		since := now.Add(-time.Duration(c.Value) * time.Second).UTC()
+		where = append(where, "t.last_seen "+c.Invert().Op+" "+arg(since.Format(sqliteTimeFormat)))
+	}
+	if q.Cluster != 0 {
+		where = append(where, "t.cluster_id = "+arg(q.Cluster))
+	}
+	return joins, rank, where
+}
+
+// ftsQuery joins terms as FTS5 strings, each matching as a phrase
+func ftsQuery(terms []string, sep string) string {
+	out := make([]string, len(terms))
+	for i, t := range terms {
+		out[i] = `"` + strings.Replace(t, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(out, sep)
+}
+
+// likeEscape escapes the LIKE wildcards in a pattern, using '\' as the
+// escape character
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// negate negates an SQL condition when exclude is set
+func negate(exclude bool) string {
+	if exclude {
+		return "not "
+	}
+	return ""
+}
+
+// nullBytes stores empty values as NULL
+func nullBytes(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// timestamp scans the various ways sqlite returns time columns
+type timestamp time.Time
+
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Scan implements sql.Scanner
+func (ts *timestamp) Scan(src interface{}) error {
+	var str string
+	switch v := src.(type) {
+	case nil:
+		*ts = timestamp(time.Time{})
+		return nil
+	case time.Time:
+		*ts = timestamp(v)
+		return nil
+	case int64:
+		*ts = timestamp(time.Unix(v, 0).UTC())
+		return nil
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	default:
+		return fmt.Errorf("unsupported timestamp type %T", src)
+	}
+	str = strings.TrimSuffix(str, "Z")
+	for _, f := range timestampFormats {
+		if t, err := time.ParseInLocation(f, str, time.UTC); err == nil {
+			*ts = timestamp(t)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp %q", str)
+}
+
+// sqliteMigrations are applied in order, the versions continue those
+// recorded in user_version by earlier releases
+var sqliteMigrations = []Migration{
+	{1, "create tables", sqliteSchema},
+	{2, "announce counters", sqliteSchemaAnnounces},
+	{3, "fetch attempts", sqliteSchemaFetchAttempts},
+	{4, "fetch retries", sqliteSchemaFetchRetries},
+	{5, "peer clients", sqliteSchemaPeerClients},
+	{6, "torrent metadata", sqliteSchemaMetadata},
+	{7, "info dictionary fields", sqliteSchemaInfoFields},
+	{8, "v2 infohashes", sqliteSchemaInfohashV2},
+	{9, "repaired names", sqliteSchemaRepaired},
+	{10, "file search", sqliteSchemaFileSearch},
+	{11, "similar torrents", sqliteSchemaSimilar},
+	{12, "duplicate clusters", sqliteSchemaClusters},
+	{13, "announcing ip ages", sqliteSchemaAnnounceIPs},
+}
+
+const sqliteSchemaMigrations = `create table if not exists schema_migrations (
+	version integer primary key,
+	name text not null,
+	applied timestamp not null
+);`
+
 const sqliteSchema = `create table if not exists torrents (
 	id integer primary key,
 	infohash blob not null unique,
@@ -516,5 +1750,99 @@ create table if not exists peers_torrents (
 	primary key (peer_id, torrent_id)
 );
 create index peers_torrents_peer_idx on peers_torrents (peer_id);
-create index peers_torrents_torrent_idx on peers_torrents (torrent_id);
-pragma user_version = 1;`
+create index peers_torrents_torrent_idx on peers_torrents (torrent_id);`
+
+const sqliteSchemaAnnounces = `alter table torrents add column announces integer not null default 0;
+alter table torrents add column seen_ips integer not null default 0;
+alter table torrents add column first_seen timestamp;
+alter table torrents add column last_seen timestamp;
+update torrents set first_seen = created, last_seen = updated;
+create index torrents_last_seen_idx on torrents (last_seen);
+create index torrents_seen_ips_idx on torrents (seen_ips, announces);
+create table if not exists torrents_ips (
+	torrent_id integer not null references torrents on delete cascade,
+	ip character varying(50) not null,
+	primary key (torrent_id, ip)
+) without rowid;
+create table if not exists torrents_announces (
+	torrent_id integer not null references torrents on delete cascade,
+	period character varying(10) not null,
+	bucket timestamp not null,
+	announces integer not null default 0,
+	primary key (torrent_id, period, bucket)
+) without rowid;
+create index torrents_announces_bucket_idx on torrents_announces (period, bucket);`
+
+const sqliteSchemaFetchAttempts = `alter table torrents add column fetch_attempts integer not null default 0;
+create index peers_updated_idx on peers (updated);`
+
+const sqliteSchemaFetchRetries = `alter table torrents add column fetch_error text;
+alter table torrents add column fetch_next timestamp;
+alter table torrents add column unfetchable boolean not null default 0;
+alter table peers_torrents add column attempts integer not null default 0;
+create index torrents_pending_idx on torrents (unfetchable, fetch_next) where name is null;`
+
+const sqliteSchemaPeerClients = `alter table peers add column peer_id blob;
+alter table peers add column client text;
+alter table peers add column client_version text;
+alter table peers add column agent text;
+create index peers_client_idx on peers (client);`
+
+const sqliteSchemaMetadata = `create table if not exists torrents_metadata (
+	torrent_id integer primary key references torrents on delete cascade,
+	metadata blob not null
+);`
+
+const sqliteSchemaInfoFields = `alter table torrents add column piece_length integer not null default 0;
+alter table torrents add column pieces integer not null default 0;
+alter table torrents add column private boolean not null default 0;
+alter table torrents add column source text not null default '';
+alter table torrents add column meta_version integer not null default 1;
+alter table torrents add column hybrid boolean not null default 0;
+alter table files add column attributes text not null default '';`
+
+const sqliteSchemaInfohashV2 = `alter table torrents add column infohash_v2 blob;
+create unique index torrents_infohash_v2_idx on torrents (infohash_v2);
+create index torrents_infohash_v2_truncated_idx on torrents (substr(infohash_v2, 1, 20));`
+
+const sqliteSchemaRepaired = `alter table torrents add column repaired boolean not null default 0;`
+
+// sqliteSchemaFileSearch indexes file paths, one per line. The index is
+// written with torrents rather than by triggers on every announce.
+const sqliteSchemaFileSearch = `drop trigger torrents_after_insert;
+drop trigger torrents_ad;
+drop trigger torrents_au;
+drop table torrents_fts;
+create virtual table torrents_fts using fts5(
+	name, files,
+	tokenize="porter unicode61 separators ' !""#$%&''()*+,-./:;<=>?@[\]^_` + "`" + `{|}~'"
+);
+insert into torrents_fts (rowid, name, files)
+select t.id, t.name, (
+	select group_concat(path, char(10)) from (
+		select f.path from files f
+		where f.torrent_id = t.id order by f.path
+	)
+)
+from torrents t where t.name is not null;
+create trigger torrents_fts_ad after delete on torrents begin
+delete from torrents_fts where rowid = old.id;
+end;`
+
+// sqliteSchemaSimilar finds torrents sharing file sizes
+const sqliteSchemaSimilar = `create index files_size_idx on files (size);`
+
+// sqliteSchemaClusters groups torrents by models.Fingerprint, existing
+// torrents are clustered by maintenance
+const sqliteSchemaClusters = `create table if not exists clusters (
+	id integer primary key,
+	fingerprint character varying(40) not null unique
+);
+alter table torrents add column cluster_id integer references clusters (id) on delete set null;
+create index torrents_cluster_idx on torrents (cluster_id);`
+
+// sqliteSchemaAnnounceIPs records when each IP last announced a torrent, so
+// maintenance can remove those gone
+const sqliteSchemaAnnounceIPs = `alter table torrents_ips add column seen timestamp;
+update torrents_ips set seen = datetime('now');
+create index torrents_ips_seen_idx on torrents_ips (seen);`
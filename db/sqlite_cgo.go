@@ -0,0 +1,29 @@
+//go:build cgo
+// +build cgo
+
+package db
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// sqliteAvailable is set when sqlite stores can be opened
+const sqliteAvailable = true
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			// Removals rely on foreign keys to cascade
+			if _, err := c.Exec(`
+			pragma temp_store=1;
+			pragma foreign_keys=on;
+			`, nil); err != nil {
+				return err
+			}
+			return c.RegisterFunc("fuzzy_similarity", models.WordSimilarity, true)
+		},
+	})
+}
@@ -0,0 +1,18 @@
+//go:build !cgo
+// +build !cgo
+
+package db
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteAvailable is set when sqlite stores can be opened, without cgo
+// they fail to open and the memory store can be used instead
+const sqliteAvailable = false
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{})
+}
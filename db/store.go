@@ -0,0 +1,55 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// Stores opened by a DSN
+const (
+	sqliteStore = iota
+	pgsqlStore
+	memoryStore
+)
+
+// storeKind classifies a DSN. PostgreSQL is used for postgres:// and
+// postgresql:// URIs, an empty memory store for "memory:" and sqlite for
+// file: URIs and plain paths.
+func storeKind(dsn string) (int, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return pgsqlStore, nil
+	case dsn == "memory:":
+		return memoryStore, nil
+	case strings.Contains(dsn, "://"):
+		return 0, fmt.Errorf("unsupported store %q", dsn[:strings.Index(dsn, "://")])
+	}
+	return sqliteStore, nil
+}
+
+// Open connects to the store for a DSN, as classified by storeKind
+func Open(dsn string) (models.Store, error) {
+	kind, err := storeKind(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Avoid returning typed nils on failure
+	switch kind {
+	case pgsqlStore:
+		s, err := NewPgsqlStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case memoryStore:
+		return NewMemoryStore(), nil
+	default:
+		s, err := NewSqliteStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
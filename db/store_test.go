@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"src.userspace.com.au/dhtsearch/db/storetest"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// pgsqlTestDSN names an environment variable with the DSN of a throwaway
+// PostgreSQL database. Its public schema is dropped before each test.
+const pgsqlTestDSN = "DHTSEARCH_TEST_PGSQL_DSN"
+
+// skipWithoutSqlite skips tests of sqlite stores in builds without cgo
+func skipWithoutSqlite(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("sqlite needs cgo")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if sqliteAvailable {
+		s, err := Open("file:TestOpen?mode=memory&cache=shared")
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		if _, ok := s.(*SqliteStore); !ok {
+			t.Errorf("Open => %T, expected sqlite", s)
+		}
+		s.Close()
+	}
+
+	s, err := Open("memory:")
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	if _, ok := s.(*MemoryStore); !ok {
+		t.Errorf("Open => %T, expected memory", s)
+	}
+
+	if _, err = Open("mysql://localhost/dht"); err == nil {
+		t.Errorf("Open should fail for unsupported schemes")
+	}
+	if _, err = Migrate(context.Background(), "mysql://localhost/dht", true); err == nil {
+		t.Errorf("Migrate should fail for unsupported schemes")
+	}
+}
+
+func TestSqliteStore(t *testing.T) {
+	skipWithoutSqlite(t)
+	storetest.Run(t, func(t *testing.T) models.Store {
+		dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.Replace(t.Name(), "/", "_", -1))
+		s, err := NewSqliteStore(dsn)
+		if err != nil {
+			t.Fatalf("NewSqliteStore failed: %s", err)
+		}
+		return s
+	})
+}
+
+func TestSqliteForeignKeys(t *testing.T) {
+	skipWithoutSqlite(t)
+	s, err := NewSqliteStore("file:TestSqliteForeignKeys?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("NewSqliteStore failed: %s", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	a, err := net.ResolveUDPAddr("udp", "10.0.0.1:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &models.Peer{Addr: a, Infohash: models.GenInfohash()}
+	if err = s.SavePeer(ctx, p); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+
+	// Hold connections open so the removal uses another
+	for i := 0; i < 3; i++ {
+		c, err := s.conn.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		var enabled int
+		if err = c.QueryRowContext(ctx, "pragma foreign_keys").Scan(&enabled); err != nil || enabled != 1 {
+			t.Errorf("connection %d has foreign_keys %d, %v", i, enabled, err)
+		}
+	}
+	if err = s.RemovePeer(ctx, p); err != nil {
+		t.Fatalf("RemovePeer failed: %s", err)
+	}
+	var left int
+	if err = s.conn.QueryRow("select count(*) from peers_torrents").Scan(&left); err != nil || left != 0 {
+		t.Errorf("%d peers_torrents left, %v", left, err)
+	}
+}
+
+func TestSqliteClusterTorrents(t *testing.T) {
+	skipWithoutSqlite(t)
+	s, err := NewSqliteStore("file:TestSqliteClusterTorrents?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("NewSqliteStore failed: %s", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Torrents saved before clustering have no cluster
+	for _, name := range []string{"Some.Release", "some release"} {
+		tor := &models.Torrent{Infohash: models.GenInfohash(), Name: name, Size: 10}
+		if err = s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+	if _, err = s.conn.Exec("update torrents set cluster_id = null; delete from clusters"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.ClusterTorrents(ctx, 1); err != nil || n != 1 {
+		t.Errorf("ClusterTorrents(1) => %d, %v", n, err)
+	}
+	if n, err := s.ClusterTorrents(ctx, 10); err != nil || n != 1 {
+		t.Errorf("ClusterTorrents(10) => %d, %v", n, err)
+	}
+	var clusters, clustered int
+	if err = s.conn.QueryRow("select count(distinct cluster_id), count(cluster_id) from torrents").Scan(&clusters, &clustered); err != nil {
+		t.Fatal(err)
+	}
+	if clusters != 1 || clustered != 2 {
+		t.Errorf("%d torrents in %d clusters, expected 2 in 1", clustered, clusters)
+	}
+
+	// Clusters left empty are removed with orphans
+	if _, err = s.conn.Exec("delete from torrents"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RemoveOrphans(ctx, time.Now()); err != nil {
+		t.Fatalf("RemoveOrphans failed: %s", err)
+	}
+	if err = s.conn.QueryRow("select count(*) from clusters").Scan(&clusters); err != nil || clusters != 0 {
+		t.Errorf("%d clusters left, %v", clusters, err)
+	}
+}
+
+func TestPgsqlStore(t *testing.T) {
+	dsn := os.Getenv(pgsqlTestDSN)
+	if dsn == "" {
+		t.Skipf("%s not set", pgsqlTestDSN)
+	}
+	cfg, err := pgx.ParseURI(dsn)
+	if err != nil {
+		t.Fatalf("invalid DSN: %s", err)
+	}
+
+	storetest.Run(t, func(t *testing.T) models.Store {
+		conn, err := pgx.Connect(cfg)
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+		_, err = conn.Exec("drop schema public cascade; create schema public")
+		conn.Close()
+		if err != nil {
+			t.Fatalf("failed to reset schema: %s", err)
+		}
+		s, err := NewPgsqlStore(dsn)
+		if err != nil {
+			t.Fatalf("NewPgsqlStore failed: %s", err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,715 @@
+// Package storetest is a conformance suite for implementations of
+// models.Store.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+// Run runs the suite against stores returned by open, which must be empty.
+// Each test opens its own store and closes it when done.
+func Run(t *testing.T, open func(*testing.T) models.Store) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, models.Store)
+	}{
+		{"Pending", testPending},
+		{"Torrents", testTorrents},
+		{"Hybrid", testHybrid},
+		{"Search", testSearch},
+		{"Pages", testPages},
+		{"Facets", testFacets},
+		{"Similar", testSimilar},
+		{"Clusters", testClusters},
+		{"Clients", testClients},
+		{"Maintenance", testMaintenance},
+		{"AnnounceIPs", testAnnounceIPs},
+		{"Cancelled", testCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			tt.fn(t, s)
+		})
+	}
+}
+
+func testPeer(t *testing.T, addr string, ih models.Infohash) *models.Peer {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("invalid address: %s", err)
+	}
+	return &models.Peer{Addr: a, Infohash: ih}
+}
+
+func testTorrent(name string, tags ...string) *models.Torrent {
+	return &models.Torrent{
+		Infohash:    models.GenInfohash(),
+		Name:        name,
+		Size:        15,
+		PieceLength: 16384,
+		Pieces:      1,
+		MetaVersion: 1,
+		Tags:        tags,
+		Metadata:    []byte("d4:name" + fmt.Sprintf("%d:%s", len(name), name) + "e"),
+		Files: []models.File{
+			{Path: name + "/b.txt", Size: 10},
+			{Path: name + "/a.sh", Size: 5, Attributes: "x"},
+		},
+	}
+}
+
+func testPending(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	ih := models.GenInfohash()
+	for _, addr := range []string{"10.0.0.1:6881", "10.0.0.2:6881"} {
+		if err := s.SavePeer(ctx, testPeer(t, addr, ih)); err != nil {
+			t.Fatalf("SavePeer failed: %s", err)
+		}
+	}
+
+	peers, err := s.PeersByInfohash(ctx, ih, 10)
+	if err != nil {
+		t.Fatalf("PeersByInfohash failed: %s", err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("PeersByInfohash => %d peers, expected 2", len(peers))
+	}
+
+	pending, err := s.PendingInfohashes(ctx, 10)
+	if err != nil {
+		t.Fatalf("PendingInfohashes failed: %s", err)
+	}
+	if len(pending) != 1 || !pending[0].Infohash.Equal(ih) {
+		t.Fatalf("PendingInfohashes => %v", pending)
+	}
+
+	// Leased
+	pending, err = s.PendingInfohashes(ctx, 10)
+	if err != nil {
+		t.Fatalf("PendingInfohashes failed: %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("leased infohash returned again: %v", pending)
+	}
+
+	b := models.Backoff{Base: time.Hour, MaxAttempts: 2}
+	for i := 0; i < 2; i++ {
+		if err = s.FetchFailed(ctx, peers[0], errors.New("timeout"), b); err != nil {
+			t.Fatalf("FetchFailed failed: %s", err)
+		}
+	}
+	n, err := s.RemoveOrphans(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("RemoveOrphans failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RemoveOrphans => %d, expected unfetchable infohash removed", n)
+	}
+}
+
+func testTorrents(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	tor := testTorrent("ubuntu-20.04-desktop", "linux", "iso")
+	if err := s.SavePeer(ctx, testPeer(t, "10.0.0.1:6881", tor.Infohash)); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+	if err := s.SaveTorrent(ctx, tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+	// Saving again replaces files and keeps tags
+	if err := s.SaveTorrent(ctx, tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+	other := testTorrent("debian-10-netinst", "linux")
+	if err := s.SaveTorrent(ctx, other); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+
+	got, err := s.TorrentByHash(ctx, tor.Infohash)
+	if err != nil {
+		t.Fatalf("TorrentByHash failed: %s", err)
+	}
+	if got.Name != tor.Name || got.Size != tor.Size || got.Announces != 1 {
+		t.Errorf("TorrentByHash => %+v", got)
+	}
+	if len(got.Files) != 2 || got.Files[0].Path != tor.Name+"/a.sh" || got.Files[0].Attributes != "x" {
+		t.Errorf("TorrentByHash files => %+v", got.Files)
+	}
+	if len(got.Tags) != 2 {
+		t.Errorf("TorrentByHash tags => %v", got.Tags)
+	}
+
+	md, err := s.TorrentMetadata(ctx, tor.Infohash)
+	if err != nil {
+		t.Fatalf("TorrentMetadata failed: %s", err)
+	}
+	if string(md) != string(tor.Metadata) {
+		t.Errorf("TorrentMetadata => %q", md)
+	}
+
+	if _, err = s.TorrentByHash(ctx, models.GenInfohash()); err != models.ErrNotFound {
+		t.Errorf("TorrentByHash => %v, expected not found", err)
+	}
+	if _, err = s.TorrentMetadata(ctx, models.GenInfohash()); err != models.ErrNotFound {
+		t.Errorf("TorrentMetadata => %v, expected not found", err)
+	}
+
+	pending, err := s.PendingInfohashes(ctx, 10)
+	if err != nil {
+		t.Fatalf("PendingInfohashes failed: %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("indexed torrent still pending: %v", pending)
+	}
+
+	var indexed int
+	err = s.IndexedInfohashes(ctx, func(models.Infohash) error {
+		indexed++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IndexedInfohashes failed: %s", err)
+	}
+	if indexed != 2 {
+		t.Errorf("IndexedInfohashes => %d, expected 2", indexed)
+	}
+
+	if err = s.RemoveTorrent(ctx, tor); err != nil {
+		t.Fatalf("RemoveTorrent failed: %s", err)
+	}
+	if _, err = s.TorrentByHash(ctx, tor.Infohash); err != models.ErrNotFound {
+		t.Errorf("removed torrent found: %v", err)
+	}
+	// Shared tags are kept for other torrents
+	got, err = s.TorrentByHash(ctx, other.Infohash)
+	if err != nil {
+		t.Fatalf("TorrentByHash failed: %s", err)
+	}
+	if len(got.Tags) != 1 || got.Tags[0] != "linux" {
+		t.Errorf("TorrentByHash tags => %v", got.Tags)
+	}
+}
+
+func testHybrid(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	v2, _ := models.InfohashFromString("caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e")
+	tor := testTorrent("hybrid")
+	tor.MetaVersion = 2
+	tor.Hybrid = true
+	tor.InfohashV2 = *v2
+
+	// Announced by the truncated v2 infohash before being indexed
+	if err := s.SavePeer(ctx, testPeer(t, "10.0.0.1:6881", v2.Truncated())); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+	if err := s.SaveTorrent(ctx, tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+
+	for _, ih := range []models.Infohash{tor.Infohash, *v2, v2.Truncated()} {
+		got, err := s.TorrentByHash(ctx, ih)
+		if err != nil {
+			t.Fatalf("TorrentByHash(%s) failed: %s", ih, err)
+		}
+		if !got.Infohash.Equal(tor.Infohash) || !got.InfohashV2.Equal(*v2) || got.Announces != 1 {
+			t.Errorf("TorrentByHash(%s) => %+v", ih, got)
+		}
+	}
+
+	peers, err := s.PeersByInfohash(ctx, tor.Infohash, 10)
+	if err != nil {
+		t.Fatalf("PeersByInfohash failed: %s", err)
+	}
+	if len(peers) != 1 {
+		t.Errorf("peers of the truncated infohash not merged: %v", peers)
+	}
+}
+
+func testSearch(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	for _, tor := range []*models.Torrent{
+		testTorrent("ubuntu-20.04-desktop", "linux"),
+		testTorrent("Big Buck Bunny", "video"),
+	} {
+		if err := s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+
+	for _, order := range []models.Ordering{
+		models.OrderDefault, models.OrderPopular, models.OrderTrending, models.OrderRecent,
+		models.OrderRelevance, models.OrderSize, models.OrderCreated,
+	} {
+		found, err := s.TorrentsByName(ctx, "ubuntu desktop", models.Page{Order: order})
+		if err != nil {
+			t.Fatalf("TorrentsByName(%s) failed: %s", order, err)
+		}
+		if len(found.Torrents) != 1 || found.Torrents[0].Name != "ubuntu-20.04-desktop" || len(found.Torrents[0].Files) != 2 {
+			t.Errorf("TorrentsByName(%s) => %v", order, found.Torrents)
+		}
+
+		found, err = s.TorrentsByTag(ctx, "video", models.Page{Order: order})
+		if err != nil {
+			t.Fatalf("TorrentsByTag(%s) failed: %s", order, err)
+		}
+		if len(found.Torrents) != 1 || found.Torrents[0].Name != "Big Buck Bunny" {
+			t.Errorf("TorrentsByTag(%s) => %v", order, found.Torrents)
+		}
+	}
+
+	found, err := s.TorrentsByName(ctx, "missing", models.Page{Order: models.OrderDefault})
+	if err != nil {
+		t.Fatalf("TorrentsByName failed: %s", err)
+	}
+	if len(found.Torrents) != 0 {
+		t.Errorf("TorrentsByName => %v, expected none", found.Torrents)
+	}
+
+	// A single file torrent, and a pending one that is never found
+	single := testTorrent("sintel.MKV", "video")
+	single.Files = nil
+	if err = s.SaveTorrent(ctx, single); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+	if err = s.SavePeer(ctx, testPeer(t, "10.0.0.1:6881", models.GenInfohash())); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+	if err = s.SaveAnnounce(ctx, testPeer(t, "10.0.0.2:6881", single.Infohash)); err != nil {
+		t.Fatalf("SaveAnnounce failed: %s", err)
+	}
+
+	for _, tt := range []struct {
+		query    string
+		expected []string
+	}{
+		{`"buck bunny" -ubuntu`, []string{"Big Buck Bunny"}},
+		{`"bunny buck"`, nil},
+		{"-ubuntu tag:video", []string{"Big Buck Bunny", "sintel.MKV"}},
+		{"-tag:linux -bunny", []string{"sintel.MKV"}},
+		{"ubuntu ext:sh size:>=15 size:<1KB files:2", []string{"ubuntu-20.04-desktop"}},
+		{"ubuntu -ext:sh", nil},
+		{"ext:mkv files:1", []string{"sintel.MKV"}},
+		{"files:>2", nil},
+		{"seen:<1d", []string{"sintel.MKV"}},
+		{"seen:>1d", nil},
+		{"ubunut mode:fuzzy", []string{"ubuntu-20.04-desktop"}},
+		{"ubunut", nil},
+		{"desktp -ubuntu mode:fuzzy", nil},
+		{"buny tag:video mode:fuzzy", []string{"Big Buck Bunny"}},
+	} {
+		found, err := s.TorrentsByName(ctx, tt.query, models.Page{Order: models.OrderRelevance})
+		if err != nil {
+			t.Errorf("TorrentsByName(%q) failed: %s", tt.query, err)
+			continue
+		}
+		var names []string
+		for _, f := range found.Torrents {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("TorrentsByName(%q) => %v, expected %v", tt.query, names, tt.expected)
+		}
+	}
+
+	// Names rank above file paths, and matching paths are highlighted
+	inName := testTorrent("beach holiday", "photos")
+	inFiles := testTorrent("summer", "photos")
+	inFiles.Files = []models.File{{Path: "photos/city.jpg", Size: 5}, {Path: "photos/beach.jpg", Size: 10}}
+	for _, tor := range []*models.Torrent{inName, inFiles} {
+		if err = s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+	found, err = s.TorrentsByName(ctx, "beach", models.Page{Order: models.OrderRelevance})
+	if err != nil {
+		t.Fatalf("TorrentsByName failed: %s", err)
+	}
+	if len(found.Torrents) != 2 || found.Torrents[0].Name != "beach holiday" || found.Torrents[1].Name != "summer" {
+		t.Fatalf("TorrentsByName => %v, expected the name match first", found.Torrents)
+	}
+	expected := []models.Highlight{{Path: "photos/beach.jpg", Matches: [][2]int{{7, 12}}}}
+	if !reflect.DeepEqual(found.Torrents[1].Highlights, expected) {
+		t.Errorf("Highlights => %v, expected %v", found.Torrents[1].Highlights, expected)
+	}
+
+	if _, err = s.TorrentsByName(ctx, "size:big", models.Page{Order: models.OrderDefault}); err == nil {
+		t.Errorf("TorrentsByName should fail for invalid queries")
+	}
+}
+
+func testPages(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	for i, size := range []int{30, 10, 20, 20, 50, 40, 60} {
+		tor := testTorrent(fmt.Sprintf("page %d", i), "paged")
+		tor.Size = size
+		if err := s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+
+	for _, order := range []models.Ordering{
+		models.OrderDefault, models.OrderPopular, models.OrderTrending, models.OrderRecent,
+		models.OrderRelevance, models.OrderSize, models.OrderCreated,
+	} {
+		for _, byTag := range []bool{false, true} {
+			var sizes []int
+			seen := make(map[string]bool)
+			page := models.Page{Order: order, Size: 3}
+			for pages := 0; pages == 0 || page.Cursor != ""; pages++ {
+				if pages == 3 {
+					t.Fatalf("%s: too many pages", order)
+				}
+				search := s.TorrentsByName
+				query := "page"
+				if byTag {
+					search, query = s.TorrentsByTag, "paged"
+				}
+				results, err := search(ctx, query, page)
+				if err != nil {
+					t.Fatalf("%s: search failed: %s", order, err)
+				}
+				if results.Total != 7 || results.Estimated {
+					t.Errorf("%s: Total => %d, expected 7", order, results.Total)
+				}
+				if expected := []int{3, 3, 1}[pages]; len(results.Torrents) != expected {
+					t.Fatalf("%s: page %d has %d torrents, expected %d", order, pages, len(results.Torrents), expected)
+				}
+				for _, tor := range results.Torrents {
+					if seen[tor.Name] {
+						t.Errorf("%s: %s repeated", order, tor.Name)
+					}
+					seen[tor.Name] = true
+					sizes = append(sizes, tor.Size)
+				}
+				page.Cursor = results.Next
+			}
+			if order == models.OrderSize && !reflect.DeepEqual(sizes, []int{60, 50, 40, 30, 20, 20, 10}) {
+				t.Errorf("sizes => %v, expected the largest first", sizes)
+			}
+		}
+	}
+
+	results, err := s.TorrentsByName(ctx, "page", models.Page{Order: models.OrderSize, Size: 1})
+	if err != nil {
+		t.Fatalf("TorrentsByName failed: %s", err)
+	}
+	for _, page := range []models.Page{
+		{Order: models.OrderDefault, Cursor: results.Next},
+		{Order: models.OrderSize, Cursor: "invalid"},
+	} {
+		if _, err = s.TorrentsByName(ctx, "page", page); err != models.ErrInvalidCursor {
+			t.Errorf("TorrentsByName(%v) => %v, expected an invalid cursor", page, err)
+		}
+	}
+}
+
+func testSimilar(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	episode := testTorrent("Some.Show.S01E02.720p.x264")
+	episode.Files = []models.File{
+		{Path: "Some.Show.S01E02.720p.x264/episode.mkv", Size: 1000},
+		{Path: "Some.Show.S01E02.720p.x264/sample.mkv", Size: 100},
+	}
+	repack := testTorrent("Some Show S01E02 1080p")
+	repack.Files = []models.File{{Path: "episode.mkv", Size: 2000}, {Path: "sample.mkv", Size: 100}}
+	renamed := testTorrent("renamed")
+	renamed.Files = []models.File{{Path: "episode.mkv", Size: 1000}, {Path: "sample.mkv", Size: 100}}
+	other := testTorrent("Other Show S03E01")
+	for _, tor := range []*models.Torrent{episode, repack, renamed, other} {
+		if err := s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+
+	similar, err := s.SimilarTorrents(ctx, episode.Infohash, 10)
+	if err != nil {
+		t.Fatalf("SimilarTorrents failed: %s", err)
+	}
+	var names []string
+	for _, st := range similar {
+		names = append(names, st.Name)
+	}
+	if expected := []string{"Some Show S01E02 1080p", "renamed"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("SimilarTorrents => %v, expected %v", names, expected)
+	}
+	if similar[0].Similarity <= similar[1].Similarity || len(similar[0].Files) != 2 {
+		t.Errorf("SimilarTorrents => %v", similar)
+	}
+
+	if similar, err = s.SimilarTorrents(ctx, episode.Infohash, 1); err != nil || len(similar) != 1 {
+		t.Errorf("SimilarTorrents(1) => %v, %v", similar, err)
+	}
+	if _, err = s.SimilarTorrents(ctx, models.GenInfohash(), 10); err != models.ErrNotFound {
+		t.Errorf("SimilarTorrents => %v, expected ErrNotFound", err)
+	}
+}
+
+func testClusters(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	movie := testTorrent("Some.Movie.2020.1080p")
+	movie.Files = []models.File{
+		{Path: "Some.Movie.2020.1080p/Some.Movie.2020.1080p.mkv", Size: 2 << 20},
+		{Path: "Some.Movie.2020.1080p/readme.txt", Size: 10},
+	}
+	duplicate := testTorrent("some movie 2020 1080p")
+	duplicate.Files = []models.File{
+		{Path: "some movie 2020 1080p/some movie 2020 1080p.MKV", Size: 2 << 20},
+		{Path: "some movie 2020 1080p/info.nfo", Size: 20},
+	}
+	other := testTorrent("Some Movie 2020 720p")
+	other.Files = []models.File{{Path: "Some Movie 2020 720p.mkv", Size: 1 << 20}}
+	clusters := make(map[string]int)
+	for _, tor := range []*models.Torrent{movie, duplicate, other} {
+		if err := s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+		saved, err := s.TorrentByHash(ctx, tor.Infohash)
+		if err != nil {
+			t.Fatalf("TorrentByHash failed: %s", err)
+		}
+		clusters[tor.Name] = saved.ClusterID
+	}
+	if id := clusters[movie.Name]; id == 0 || clusters[duplicate.Name] != id || clusters[other.Name] == id {
+		t.Fatalf("clusters => %v, expected the first two together", clusters)
+	}
+
+	results, err := s.TorrentsByName(ctx, "movie", models.Page{Order: models.OrderRelevance, Collapse: true})
+	if err != nil {
+		t.Fatalf("TorrentsByName failed: %s", err)
+	}
+	variants := make(map[int]int)
+	for _, tor := range results.Torrents {
+		variants[tor.ClusterID] = tor.Variants
+	}
+	if expected := map[int]int{clusters[movie.Name]: 2, clusters[other.Name]: 1}; !reflect.DeepEqual(variants, expected) || results.Total != 2 {
+		t.Errorf("collapsed => %v of %d, expected %v of 2", variants, results.Total, expected)
+	}
+
+	// Pages continue after collapsed clusters
+	seen := make(map[int]bool)
+	page := models.Page{Size: 1, Collapse: true}
+	for pages := 0; pages == 0 || page.Cursor != ""; pages++ {
+		if pages == 3 {
+			t.Fatal("too many pages")
+		}
+		if results, err = s.TorrentsByName(ctx, "movie", page); err != nil {
+			t.Fatalf("TorrentsByName failed: %s", err)
+		}
+		for _, tor := range results.Torrents {
+			if seen[tor.ClusterID] {
+				t.Errorf("cluster %d repeated", tor.ClusterID)
+			}
+			seen[tor.ClusterID] = true
+		}
+		page.Cursor = results.Next
+	}
+	if len(seen) != 2 {
+		t.Errorf("pages => %v, expected 2 clusters", seen)
+	}
+
+	if results, err = s.TorrentsByName(ctx, "movie", models.Page{}); err != nil || results.Total != 3 {
+		t.Errorf("TorrentsByName => %v, %v, expected 3 matches", results, err)
+	}
+	for _, tor := range results.Torrents {
+		if tor.Variants != 0 {
+			t.Errorf("%s has %d variants without collapsing", tor.Name, tor.Variants)
+		}
+	}
+
+	query := fmt.Sprintf("cluster:%d", clusters[movie.Name])
+	if results, err = s.TorrentsByName(ctx, query, models.Page{}); err != nil || len(results.Torrents) != 2 {
+		t.Errorf("TorrentsByName(%s) => %v, %v, expected 2 torrents", query, results, err)
+	}
+	if n, err := s.ClusterTorrents(ctx, 10); err != nil || n != 0 {
+		t.Errorf("ClusterTorrents => %d, %v, expected nothing left", n, err)
+	}
+}
+
+func testFacets(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	video := testTorrent("Big Buck Bunny", "video", "animation")
+	video.Files = []models.File{{Path: "bbb/movie.MKV", Size: 2 << 30}, {Path: "bbb/poster.jpg", Size: 1}}
+	video.Size = 2<<30 + 1
+	single := testTorrent("bunny.iso", "linux")
+	single.Files = nil
+	for _, tor := range []*models.Torrent{video, single, testTorrent("ubuntu desktop", "linux")} {
+		if err := s.SaveTorrent(ctx, tor); err != nil {
+			t.Fatalf("SaveTorrent failed: %s", err)
+		}
+	}
+	if err := s.SaveAnnounce(ctx, testPeer(t, "10.0.0.1:6881", single.Infohash)); err != nil {
+		t.Fatalf("SaveAnnounce failed: %s", err)
+	}
+	if err := s.SavePeer(ctx, testPeer(t, "10.0.0.2:6881", models.GenInfohash())); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+
+	facets, err := s.TorrentFacets(ctx, "size:>=0")
+	if err != nil {
+		t.Fatalf("TorrentFacets failed: %s", err)
+	}
+	expected := &models.Facets{
+		Total: 3,
+		Tags: []models.FacetCount{
+			{Value: "linux", Count: 2}, {Value: "animation", Count: 1}, {Value: "video", Count: 1},
+		},
+		Sizes: []models.FacetCount{{Value: "<100MB", Count: 2}, {Value: "1GB-4GB", Count: 1}},
+		Extensions: []models.FacetCount{
+			{Value: "archive", Count: 1}, {Value: "document", Count: 1},
+			{Value: "image", Count: 1}, {Value: "video", Count: 1},
+		},
+		FirstSeen: []models.FacetCount{{Value: time.Now().UTC().Format("2006-01"), Count: 1}},
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("TorrentFacets => %+v, expected %+v", facets, expected)
+	}
+
+	facets, err = s.TorrentFacets(ctx, "bunny -tag:video")
+	if err != nil {
+		t.Fatalf("TorrentFacets failed: %s", err)
+	}
+	if facets.Total != 1 || len(facets.Tags) != 1 || facets.Tags[0].Value != "linux" {
+		t.Errorf("TorrentFacets => %+v", facets)
+	}
+	if _, err = s.TorrentFacets(ctx, "size:big"); err == nil {
+		t.Errorf("TorrentFacets should fail for invalid queries")
+	}
+}
+
+func testClients(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	for i, name := range []string{"qBittorrent", "qBittorrent", "Transmission"} {
+		p := testPeer(t, fmt.Sprintf("10.0.0.%d:6881", i+1), models.GenInfohash())
+		p.Client = models.Client{Name: name, Version: "1.0"}
+		if err := s.SavePeerClient(ctx, p); err != nil {
+			t.Fatalf("SavePeerClient failed: %s", err)
+		}
+	}
+
+	counts, err := s.ClientCounts(ctx, 10)
+	if err != nil {
+		t.Fatalf("ClientCounts failed: %s", err)
+	}
+	if len(counts) != 2 || counts[0].Client != "qBittorrent" || counts[0].Peers != 2 {
+		t.Errorf("ClientCounts => %v", counts)
+	}
+}
+
+func testMaintenance(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	ih := models.GenInfohash()
+	if err := s.SavePeer(ctx, testPeer(t, "10.0.0.1:6881", ih)); err != nil {
+		t.Fatalf("SavePeer failed: %s", err)
+	}
+
+	future := time.Now().Add(48 * time.Hour)
+	n, err := s.RemoveAnnounceBuckets(ctx, "hour", future)
+	if err != nil {
+		t.Fatalf("RemoveAnnounceBuckets failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RemoveAnnounceBuckets => %d, expected 1", n)
+	}
+
+	if n, err = s.RemoveAnnounceIPs(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("RemoveAnnounceIPs => %d, %v, expected the recent IP kept", n, err)
+	}
+	if n, err = s.RemoveAnnounceIPs(ctx, future); err != nil || n != 1 {
+		t.Errorf("RemoveAnnounceIPs => %d, %v, expected 1", n, err)
+	}
+
+	if n, err = s.RemoveStalePeers(ctx, future); err != nil {
+		t.Fatalf("RemoveStalePeers failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RemoveStalePeers => %d, expected 1", n)
+	}
+	if n, err = s.RemoveOrphans(ctx, future); err != nil {
+		t.Fatalf("RemoveOrphans failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RemoveOrphans => %d, expected 1", n)
+	}
+
+	if err = s.Optimize(ctx); err != nil {
+		t.Errorf("Optimize failed: %s", err)
+	}
+}
+
+func testAnnounceIPs(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	tor := testTorrent("announced")
+	if err := s.SaveTorrent(ctx, tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+	announce := func(addr string, expected int) {
+		t.Helper()
+		if err := s.SaveAnnounce(ctx, testPeer(t, addr, tor.Infohash)); err != nil {
+			t.Fatalf("SaveAnnounce failed: %s", err)
+		}
+		saved, err := s.TorrentByHash(ctx, tor.Infohash)
+		if err != nil {
+			t.Fatalf("TorrentByHash failed: %s", err)
+		}
+		if saved.SeenIPs != expected {
+			t.Errorf("SeenIPs => %d after %s, expected %d", saved.SeenIPs, addr, expected)
+		}
+	}
+	announce("10.0.0.1:6881", 1)
+	announce("10.0.0.2:6881", 2)
+
+	// Pruned IPs are no longer counted, and count once when they return
+	n, err := s.RemoveAnnounceIPs(ctx, time.Now().Add(time.Hour))
+	if err != nil || n != 2 {
+		t.Errorf("RemoveAnnounceIPs => %d, %v, expected 2", n, err)
+	}
+	announce("10.0.0.1:6882", 1)
+	announce("10.0.0.1:6883", 1)
+}
+
+func testCancelled(t *testing.T, s models.Store) {
+	tor := testTorrent("cancelled")
+	if err := s.SaveTorrent(context.Background(), tor); err != nil {
+		t.Fatalf("SaveTorrent failed: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.SavePeer(ctx, testPeer(t, "10.0.0.1:6881", models.GenInfohash())); err == nil {
+		t.Errorf("SavePeer should fail when cancelled")
+	}
+	if err := s.SaveTorrent(ctx, testTorrent("other")); err == nil {
+		t.Errorf("SaveTorrent should fail when cancelled")
+	}
+	if _, err := s.TorrentByHash(ctx, tor.Infohash); err == nil {
+		t.Errorf("TorrentByHash should fail when cancelled")
+	}
+	if _, err := s.TorrentsByName(ctx, "cancelled", models.Page{Order: models.OrderDefault}); err == nil {
+		t.Errorf("TorrentsByName should fail when cancelled")
+	}
+	if _, err := s.PendingInfohashes(ctx, 10); err == nil {
+		t.Errorf("PendingInfohashes should fail when cancelled")
+	}
+
+	// Nothing was written
+	found, err := s.TorrentsByName(context.Background(), "other", models.Page{Order: models.OrderDefault})
+	if err != nil {
+		t.Fatalf("TorrentsByName failed: %s", err)
+	}
+	if len(found.Torrents) != 0 {
+		t.Errorf("cancelled SaveTorrent was written: %v", found.Torrents)
+	}
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/dhtsearch/models"
+)
+
+const (
+	// lookupWidth is the number of routing table nodes a lookup starts with
+	lookupWidth = 16
+	// maxLookupQueries bounds the get_peers queries sent by a lookup
+	maxLookupQueries = 256
+)
+
+// lookup is an iterative get_peers search for an infohash
+type lookup struct {
+	sync.Mutex
+	ih           models.Infohash
+	queried      map[string]bool
+	transactions []string
+	seen         map[string]bool
+	peers        []models.Peer
+}
+
+// GetPeers searches the DHT for peers of the infohash, returning those
+// found within the timeout. The node must be running.
+func (n *Node) GetPeers(ih models.Infohash, timeout time.Duration) ([]models.Peer, error) {
+	// v2 infohashes are truncated on the DHT
+	ih = ih.Truncated()
+	if len(ih) != models.InfohashLength {
+		return nil, fmt.Errorf("invalid infohash length %d", len(ih))
+	}
+
+	l := &lookup{
+		ih:      ih,
+		queried: make(map[string]bool),
+		seen:    make(map[string]bool),
+	}
+
+	start := n.rTable.get(lookupWidth)
+	if len(start) == 0 {
+		start = n.routerNodes()
+	}
+	for _, rn := range start {
+		n.queryPeers(l, rn)
+	}
+
+	time.Sleep(timeout)
+
+	n.lookupLock.Lock()
+	l.Lock()
+	defer l.Unlock()
+	for _, t := range l.transactions {
+		if n.lookups[t] == l {
+			delete(n.lookups, t)
+		}
+	}
+	n.lookupLock.Unlock()
+	return l.peers, nil
+}
+
+// queryPeers sends a get_peers query for the lookup if the node has not been
+// queried already
+func (n *Node) queryPeers(l *lookup, rn *remoteNode) {
+	l.Lock()
+	if l.queried[rn.addr.String()] || len(l.queried) >= maxLookupQueries {
+		l.Unlock()
+		return
+	}
+	l.queried[rn.addr.String()] = true
+	l.Unlock()
+
+	// Held until registered so the response cannot be missed
+	n.lookupLock.Lock()
+	defer n.lookupLock.Unlock()
+	t, err := n.sendQuery(rn, "get_peers", map[string]interface{}{
+		"id":        string(n.id),
+		"info_hash": string(l.ih),
+	})
+	if err != nil || t == "" {
+		return
+	}
+	n.lookups[t] = l
+
+	l.Lock()
+	l.transactions = append(l.transactions, t)
+	l.Unlock()
+}
+
+// lookupByTransaction finds the lookup a response belongs to
+func (n *Node) lookupByTransaction(t string) *lookup {
+	n.lookupLock.Lock()
+	defer n.lookupLock.Unlock()
+	return n.lookups[t]
+}
+
+// onGetPeersResponse collects the peers in a get_peers response and
+// continues the lookup with nodes closer to the infohash
+func (n *Node) onGetPeersResponse(l *lookup, rn remoteNode, r map[string]interface{}) {
+	if values, err := krpc.GetList(r, "values"); err == nil {
+		for _, v := range values {
+			cp, ok := v.(string)
+			if !ok {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", krpc.DecodeCompactNodeAddr(cp))
+			if err != nil || addr.Port == 0 {
+				continue
+			}
+			l.add(models.Peer{Addr: addr, Infohash: l.ih})
+		}
+	}
+
+	nodeList, err := krpc.GetString(r, "nodes")
+	if err != nil {
+		return
+	}
+	nodes, err := n.decodeNodes(nodeList)
+	if err != nil {
+		return
+	}
+	distance := rn.id.Distance(l.ih)
+	for _, c := range nodes {
+		// Distance is the length of the common prefix
+		if c.id.Distance(l.ih) >= distance {
+			n.queryPeers(l, c)
+		}
+	}
+}
+
+func (l *lookup) add(p models.Peer) {
+	l.Lock()
+	defer l.Unlock()
+	if l.seen[p.Addr.String()] {
+		return
+	}
+	l.seen[p.Addr.String()] = true
+	l.peers = append(l.peers, p)
+}
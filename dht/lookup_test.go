@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/dhtsearch/models"
+	"src.userspace.com.au/go-bencode"
+	"src.userspace.com.au/logger"
+)
+
+func TestGetPeers(t *testing.T) {
+	n, err := NewNode(SetPort(0), SetLogger(logger.New(&logger.Options{Name: "test"})))
+	if err != nil {
+		t.Fatalf("failed to create node: %s", err)
+	}
+	go n.Run()
+
+	// A remote node that knows a peer for any infohash
+	remote, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer remote.Close()
+	remoteID := models.GenInfohash()
+	queried := make(chan string, 1)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			c, addr, err := remote.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			m, _, err := bencode.DecodeDict(b[:c], 0)
+			if err != nil {
+				continue
+			}
+			if q, _ := krpc.GetString(m, "q"); q != "get_peers" {
+				continue
+			}
+			a, _ := krpc.GetMap(m, "a")
+			ih, _ := krpc.GetString(a, "info_hash")
+			queried <- ih
+			tid, _ := krpc.GetString(m, "t")
+			r, _ := bencode.Encode(krpc.MakeResponse(tid, map[string]interface{}{
+				"id":     string(remoteID),
+				"token":  "tk",
+				"values": []interface{}{krpc.EncodeCompactNodeAddr("10.0.0.1:6881")},
+			}))
+			remote.WriteTo(r, addr)
+		}
+	}()
+	n.rTable.add(&remoteNode{addr: remote.LocalAddr(), id: remoteID})
+
+	v2, _ := models.InfohashFromString("caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e")
+	peers, err := n.GetPeers(*v2, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("GetPeers failed: %s", err)
+	}
+
+	select {
+	case ih := <-queried:
+		if !models.Infohash(ih).Equal(v2.Truncated()) {
+			t.Errorf("queried info_hash %x, expected truncated %s", ih, v2.Truncated())
+		}
+	default:
+		t.Fatalf("get_peers was not sent")
+	}
+	if len(peers) != 1 || peers[0].Addr.String() != "10.0.0.1:6881" || !peers[0].Infohash.Equal(v2.Truncated()) {
+		t.Errorf("GetPeers => %v", peers)
+	}
+	if len(n.lookups) != 0 {
+		t.Errorf("lookup transactions not removed")
+	}
+}
@@ -115,7 +115,7 @@ func (n *Node) onAnnouncePeerQuery(rn remoteNode, msg map[string]interface{}) er
 
 	p := models.Peer{Addr: rn.addr, Infohash: *ih}
 	if n.OnAnnouncePeer != nil {
-		go n.OnAnnouncePeer(p)
+		n.OnAnnouncePeer(p)
 	}
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru"
@@ -38,8 +39,12 @@ type Node struct {
 	log        logger.Logger
 	limiter    *rate.Limiter
 	blacklist  *lru.ARCCache
+	// get_peers lookups by transaction ID
+	lookups    map[string]*lookup
+	lookupLock sync.Mutex
 
-	// OnAnnoucePeer is called for each peer that announces itself
+	// OnAnnouncePeer is called for each peer that announces itself. It is
+	// called from the packet reader so a slow handler slows the node.
 	OnAnnouncePeer func(models.Peer)
 	// OnBadPeer is called for each bad peer
 	OnBadPeer func(models.Peer)
@@ -57,6 +62,8 @@ func NewNode(opts ...Option) (*Node, error) {
 		udpTimeout: 10,
 		limiter:    rate.NewLimiter(rate.Limit(100000), 2000000),
 		log:        logger.New(&logger.Options{Name: "dht"}),
+		packetsOut: make(chan packet, 1024),
+		lookups:    make(map[string]*lookup),
 	}
 
 	n.rTable, err = newRoutingTable(id, 2000)
@@ -110,9 +117,6 @@ func (n *Node) Close() error {
 
 // Run starts the node on the DHT
 func (n *Node) Run() {
-	// Packets onto the network
-	n.packetsOut = make(chan packet, 1024)
-
 	// Create a slab for allocation
 	byteSlab := newSlab(8192, 10)
 
@@ -165,15 +169,22 @@ func (n *Node) makeNeighbours() {
 
 func (n *Node) bootstrap() {
 	n.log.Debug("bootstrapping")
+	for _, rn := range n.routerNodes() {
+		n.findNode(rn, n.id)
+	}
+}
+
+// routerNodes resolves the bootstrap routers
+func (n *Node) routerNodes() (out []*remoteNode) {
 	for _, s := range routers {
 		addr, err := net.ResolveUDPAddr(n.family, s)
 		if err != nil {
 			n.log.Error("failed to parse bootstrap address", "error", err)
 			continue
 		}
-		rn := &remoteNode{addr: addr}
-		n.findNode(rn, n.id)
+		out = append(out, &remoteNode{addr: addr})
 	}
+	return out
 }
 
 func (n *Node) packetWriter() {
@@ -217,10 +228,11 @@ func (n *Node) ping(rn *remoteNode) {
 	})
 }
 
-func (n *Node) sendQuery(rn *remoteNode, qType string, a map[string]interface{}) error {
+// sendQuery queues a query, returning the transaction ID
+func (n *Node) sendQuery(rn *remoteNode, qType string, a map[string]interface{}) (string, error) {
 	// Stop if sending to self
 	if rn.id.Equal(n.id) {
-		return nil
+		return "", nil
 	}
 
 	t := krpc.NewTransactionID()
@@ -228,14 +240,14 @@ func (n *Node) sendQuery(rn *remoteNode, qType string, a map[string]interface{})
 	data := krpc.MakeQuery(t, qType, a)
 	b, err := bencode.Encode(data)
 	if err != nil {
-		return err
+		return "", err
 	}
 	//fmt.Printf("sending %s to %s\n", qType, rn.String())
 	n.packetsOut <- packet{
 		data:  b,
 		raddr: rn.addr,
 	}
-	return nil
+	return t, nil
 }
 
 // Parse a KRPC packet into a message
@@ -347,6 +359,12 @@ func (n *Node) handleResponse(addr net.Addr, m map[string]interface{}) error {
 
 	rn := &remoteNode{addr: addr, id: *ih}
 
+	if t, err := krpc.GetString(m, "t"); err == nil {
+		if l := n.lookupByTransaction(t); l != nil {
+			n.onGetPeersResponse(l, *rn, r)
+		}
+	}
+
 	nodes, err := krpc.GetString(r, "nodes")
 	// find_nodes/get_peers response with nodes
 	if err == nil {
@@ -356,17 +374,9 @@ func (n *Node) handleResponse(addr net.Addr, m map[string]interface{}) error {
 		return nil
 	}
 
-	values, err := krpc.GetList(r, "values")
-	// get_peers response
-	if err == nil {
+	// get_peers response, the peers are collected by the lookup
+	if _, err = krpc.GetList(r, "values"); err == nil {
 		n.log.Debug("get_peers response", "source", rn)
-		for _, v := range values {
-			addr := krpc.DecodeCompactNodeAddr(v.(string))
-			n.log.Debug("unhandled get_peer request", "addres", addr)
-
-			// TODO new peer needs to be matched to previous get_peers request
-			// n.peersManager.Insert(ih, p)
-		}
 		n.rTable.add(rn)
 	}
 	return nil
@@ -391,19 +401,31 @@ func (n *Node) handleError(addr net.Addr, m map[string]interface{}) error {
 
 // Process another node's response to a find_node query.
 func (n *Node) processFindNodeResults(rn remoteNode, nodeList string) {
+	nodes, err := n.decodeNodes(nodeList)
+	if err != nil {
+		n.log.Error("node list is wrong length", "length", len(nodeList))
+		n.blacklist.Add(rn.addr.String(), true)
+		return
+	}
+
+	//fmt.Printf("%s sent %d nodes\n", rn.address.String(), len(nodes))
+
+	for _, rn := range nodes {
+		n.rTable.add(rn)
+	}
+}
+
+// decodeNodes parses a compact node list
+func (n *Node) decodeNodes(nodeList string) (out []*remoteNode, err error) {
 	nodeLength := krpc.IPv4NodeAddrLen
 	if n.family == "udp6" {
 		nodeLength = krpc.IPv6NodeAddrLen
 	}
 
 	if len(nodeList)%nodeLength != 0 {
-		n.log.Error("node list is wrong length", "length", len(nodeList))
-		n.blacklist.Add(rn.addr.String(), true)
-		return
+		return nil, fmt.Errorf("node list is wrong length %d", len(nodeList))
 	}
 
-	//fmt.Printf("%s sent %d nodes\n", rn.address.String(), len(nodeList)/nodeLength)
-
 	// We got a byte array in groups of 26 or 38
 	for i := 0; i < len(nodeList); i += nodeLength {
 		id := nodeList[i : i+models.InfohashLength]
@@ -421,7 +443,7 @@ func (n *Node) processFindNodeResults(rn remoteNode, nodeList string) {
 			continue
 		}
 
-		rn := &remoteNode{addr: addr, id: *ih}
-		n.rTable.add(rn)
+		out = append(out, &remoteNode{addr: addr, id: *ih})
 	}
+	return out, nil
 }
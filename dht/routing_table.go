@@ -68,7 +68,7 @@ func (pq *priorityQueue) Pop() interface{} {
 
 func (k *routingTable) add(rn *remoteNode) {
 	// Check IP and ports are valid and not self
-	if !rn.id.Valid() || rn.id.Equal(k.id) {
+	if len(rn.id) != models.InfohashLength || rn.id.Equal(k.id) {
 		return
 	}
 
@@ -97,6 +97,8 @@ func (k *routingTable) add(rn *remoteNode) {
 }
 
 func (k *routingTable) get(n int) (out []*remoteNode) {
+	k.Lock()
+	defer k.Unlock()
 	if n == 0 {
 		n = len(k.items)
 	}
@@ -15,6 +15,7 @@ require (
 	github.com/satori/go.uuid v1.2.0 // indirect
 	github.com/shopspring/decimal v1.2.0 // indirect
 	golang.org/x/net v0.0.0-20180330215511-b68f30494add // indirect
+	golang.org/x/text v0.13.0
 	golang.org/x/time v0.0.0-20180314180208-26559e0f760e
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
 	src.userspace.com.au/go-bencode v0.3.1
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+)
+
+// Backoff determines when failed metadata fetches are retried
+type Backoff struct {
+	// Base is the delay after the first failure
+	Base time.Duration
+	// Max caps the delay between attempts
+	Max time.Duration
+	// MaxAttempts before an infohash is considered unfetchable
+	MaxAttempts int
+}
+
+// Delay returns the wait before the next attempt after n failed attempts
+func (b Backoff) Delay(n int) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	d := b.Base
+	for i := 1; i < n; i++ {
+		d *= 2
+		if b.Max > 0 && d >= b.Max {
+			return b.Max
+		}
+	}
+	if b.Max > 0 && d > b.Max {
+		return b.Max
+	}
+	return d
+}
+
+// Exhausted reports whether no more attempts should be made after n
+// failed attempts
+func (b Backoff) Exhausted(n int) bool {
+	return b.MaxAttempts > 0 && n >= b.MaxAttempts
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: time.Minute, Max: 10 * time.Minute, MaxAttempts: 5}
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if d := b.Delay(tt.attempts); d != tt.delay {
+			t.Errorf("Delay(%d) => %s, expected %s", tt.attempts, d, tt.delay)
+		}
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	b := Backoff{Base: time.Minute, MaxAttempts: 3}
+	if b.Exhausted(2) {
+		t.Errorf("Exhausted(2) should be false")
+	}
+	if !b.Exhausted(3) {
+		t.Errorf("Exhausted(3) should be true")
+	}
+	if (Backoff{}).Exhausted(100) {
+		t.Errorf("zero MaxAttempts should never be exhausted")
+	}
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Client identifies the software a peer is running
+type Client struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// ClientCount is the number of peers seen running a client
+type ClientCount struct {
+	Client string `json:"client"`
+	Peers  int    `json:"peers"`
+}
+
+// String implements fmt.Stringer
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Azureus style client codes
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BF": "Bitflu",
+	"BI": "BiglyBT",
+	"BN": "Baidu Netdisk",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"KT": "KTorrent",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"LW": "LimeWire",
+	"MG": "MediaGet",
+	"PI": "PicoTorrent",
+	"QD": "QQDownload",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+}
+
+// Shadow style client codes
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+// ParsePeerID decodes the client from an Azureus, Shadow or Mainline style
+// peer ID
+func ParsePeerID(id []byte) (Client, bool) {
+	if len(id) != 20 {
+		return Client{}, false
+	}
+	if c, ok := parseAzureus(id); ok {
+		return c, true
+	}
+	if c, ok := parseMainline(id); ok {
+		return c, true
+	}
+	return parseShadow(id)
+}
+
+// parseAzureus decodes '-' + two character code + four version characters +
+// '-', eg. -qB4250-
+func parseAzureus(id []byte) (Client, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return Client{}, false
+	}
+	code := string(id[1:3])
+	for _, b := range id[1:7] {
+		if !isAlphanumeric(b) {
+			return Client{}, false
+		}
+	}
+	name, ok := azureusClients[code]
+	if !ok {
+		name = code
+	}
+
+	parts := make([]string, 4)
+	for i, b := range id[3:7] {
+		parts[i] = string(b)
+	}
+	// Trailing zeros are rarely significant
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// parseMainline decodes 'M' + version numbers separated by '-', eg. M7-4-3--
+func parseMainline(id []byte) (Client, bool) {
+	if id[0] != 'M' {
+		return Client{}, false
+	}
+	parts := strings.SplitN(string(id[1:8]), "-", 4)
+	if len(parts) < 4 {
+		return Client{}, false
+	}
+	for _, p := range parts[:3] {
+		if _, err := strconv.Atoi(p); err != nil {
+			return Client{}, false
+		}
+	}
+	return Client{Name: "Mainline", Version: strings.Join(parts[:3], ".")}, true
+}
+
+// parseShadow decodes a code character + up to five version characters
+// followed by '---', eg. S58B-----
+func parseShadow(id []byte) (Client, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok {
+		return Client{}, false
+	}
+	var parts []string
+	i := 1
+	for ; i < 6 && id[i] != '-'; i++ {
+		v := shadowVersion(id[i])
+		if v < 0 {
+			return Client{}, false
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+	if len(parts) == 0 || string(id[i:i+3]) != "---" {
+		return Client{}, false
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// shadowVersion maps a version character to its number
+func shadowVersion(b byte) int {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0')
+	case b >= 'A' && b <= 'Z':
+		return int(b-'A') + 10
+	case b >= 'a' && b <= 'z':
+		return int(b-'a') + 36
+	case b == '.':
+		return 62
+	}
+	return -1
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z')
+}
+
+// ClientFromAgent splits an extension handshake 'v' value into the client
+// name and version, eg. "Transmission 2.94"
+func ClientFromAgent(v string) Client {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndexAny(v, " /"); i > 0 && i < len(v)-1 && v[i+1] >= '0' && v[i+1] <= '9' {
+		return Client{Name: v[:i], Version: v[i+1:]}
+	}
+	return Client{Name: v}
+}
+
+// MatchClient checks if the client or agent matches any of the names, which
+// are compared case insensitively against the start of each
+func MatchClient(c Client, agent string, names []string) bool {
+	for _, n := range names {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n == "" {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(c.Name), n) || strings.HasPrefix(strings.ToLower(agent), n) {
+			return true
+		}
+	}
+	return false
+}
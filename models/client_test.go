@@ -0,0 +1,59 @@
+package models
+
+import "testing"
+
+func TestParsePeerID(t *testing.T) {
+	tests := []struct {
+		id     string
+		client Client
+		ok     bool
+	}{
+		{"-qB4250-abcdefghijkl", Client{"qBittorrent", "4.2.5"}, true},
+		{"-TR2940-abcdefghijkl", Client{"Transmission", "2.9.4"}, true},
+		{"-UT355W-abcdefghijkl", Client{"µTorrent", "3.5.5.W"}, true},
+		{"-AZ5000-abcdefghijkl", Client{"Vuze", "5.0"}, true},
+		{"-ZZ1234-abcdefghijkl", Client{"ZZ", "1.2.3.4"}, true},
+		{"M7-4-3--abcdefghijkl", Client{"Mainline", "7.4.3"}, true},
+		{"S58B-----abcdefghijk", Client{"Shadow", "5.8.11"}, true},
+		{"T03I-----abcdefghijk", Client{"BitTornado", "0.3.18"}, true},
+		{"abcdefghijklmnopqrst", Client{}, false},
+		{"-qB4250", Client{}, false},
+		{"-q!4250-abcdefghijkl", Client{}, false},
+	}
+	for _, tt := range tests {
+		c, ok := ParsePeerID([]byte(tt.id))
+		if ok != tt.ok || c != tt.client {
+			t.Errorf("ParsePeerID(%q) => %+v, %t, expected %+v, %t", tt.id, c, ok, tt.client, tt.ok)
+		}
+	}
+}
+
+func TestClientFromAgent(t *testing.T) {
+	tests := []struct {
+		v      string
+		client Client
+	}{
+		{"Transmission 2.94", Client{"Transmission", "2.94"}},
+		{"libtorrent/1.2.3.0", Client{"libtorrent", "1.2.3.0"}},
+		{"BitTorrent Web", Client{"BitTorrent Web", ""}},
+		{"Deluge", Client{"Deluge", ""}},
+	}
+	for _, tt := range tests {
+		if c := ClientFromAgent(tt.v); c != tt.client {
+			t.Errorf("ClientFromAgent(%q) => %+v, expected %+v", tt.v, c, tt.client)
+		}
+	}
+}
+
+func TestMatchClient(t *testing.T) {
+	c := Client{"Xunlei", "0.0.1.2"}
+	if !MatchClient(c, "", []string{"deluge", "xunlei"}) {
+		t.Errorf("MatchClient should match client name")
+	}
+	if !MatchClient(Client{}, "FakeMonitor 1.0", []string{"fakemonitor"}) {
+		t.Errorf("MatchClient should match agent")
+	}
+	if MatchClient(c, "", []string{"", "deluge"}) {
+		t.Errorf("MatchClient should not match")
+	}
+}
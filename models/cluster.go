@@ -0,0 +1,54 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FingerprintMinSize is the smallest file fingerprinted, when a torrent has
+// any file this large. Smaller files are often notes added by each uploader.
+const FingerprintMinSize = 1 << 20
+
+// Fingerprint identifies the content of a torrent by the sizes and normalized
+// paths of its files, or its size and name for a single file. Torrents with
+// the same fingerprint are likely duplicates.
+func Fingerprint(t *Torrent) string {
+	type file struct {
+		path string
+		size int
+	}
+	files := []file{{t.Name, t.Size}}
+	if len(t.Files) > 0 {
+		files = files[:0]
+		large := false
+		for _, f := range t.Files {
+			large = large || f.Size >= FingerprintMinSize
+		}
+		for _, f := range t.Files {
+			if !large || f.Size >= FingerprintMinSize {
+				files = append(files, file{f.Path, f.Size})
+			}
+		}
+	}
+
+	lines := make([]string, len(files))
+	for i, f := range files {
+		lines[i] = fmt.Sprintf("%d\t%s\n", f.size, normalizePath(f.path))
+	}
+	sort.Strings(lines)
+	sum := sha1.Sum([]byte(strings.Join(lines, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizePath keeps the lower case words of each path component, so names
+// differing only by case and separators match
+func normalizePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = strings.Join(Words(part), " ")
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,36 @@
+package models
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	movie := &Torrent{Name: "Some.Movie.2020", Files: []File{
+		{Path: "Some.Movie.2020/Some.Movie.2020.mkv", Size: 2 << 20},
+		{Path: "Some.Movie.2020/readme.txt", Size: 10},
+	}}
+	renamed := &Torrent{Name: "some movie 2020", Files: []File{
+		{Path: "some_movie_2020/SOME MOVIE 2020.MKV", Size: 2 << 20},
+		{Path: "some_movie_2020/info.nfo", Size: 20},
+	}}
+	resized := &Torrent{Name: "Some.Movie.2020", Files: []File{
+		{Path: "Some.Movie.2020/Some.Movie.2020.mkv", Size: 3 << 20},
+	}}
+	small := &Torrent{Name: "small", Files: []File{{Path: "a.txt", Size: 1}}}
+	smaller := &Torrent{Name: "small", Files: []File{{Path: "a.txt", Size: 2}}}
+	single := &Torrent{Name: "Single.File.mkv", Size: 10}
+	singleRenamed := &Torrent{Name: "single file.MKV", Size: 10}
+
+	for _, tt := range []struct {
+		a, b *Torrent
+		same bool
+	}{
+		{movie, renamed, true},
+		{movie, resized, false},
+		{small, smaller, false},
+		{single, singleRenamed, true},
+		{single, movie, false},
+	} {
+		if same := Fingerprint(tt.a) == Fingerprint(tt.b); same != tt.same {
+			t.Errorf("Fingerprint(%s) == Fingerprint(%s) => %t, expected %t", tt.a.Name, tt.b.Name, same, tt.same)
+		}
+	}
+}
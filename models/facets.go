@@ -0,0 +1,126 @@
+package models
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Facets count the torrents matching a search by tag, size, the categories
+// of their file extensions and the month they were first seen
+type Facets struct {
+	Total      int          `json:"total"`
+	Tags       []FacetCount `json:"tags"`
+	Sizes      []FacetCount `json:"sizes"`
+	Extensions []FacetCount `json:"extensions"`
+	FirstSeen  []FacetCount `json:"first_seen"`
+}
+
+// FacetCount is the number of torrents with a value
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// FacetTagsLimit is the most tags counted, the most common first
+const FacetTagsLimit = 20
+
+// SizeBucket holds sizes below Max bytes, the last holds the rest
+type SizeBucket struct {
+	Name string
+	Max  int64
+}
+
+// SizeBuckets are in order of size
+var SizeBuckets = []SizeBucket{
+	{"<100MB", 100 << 20},
+	{"100MB-1GB", 1 << 30},
+	{"1GB-4GB", 4 << 30},
+	{"4GB-16GB", 16 << 30},
+	{">16GB", 0},
+}
+
+// ExtensionCategory groups file extensions
+type ExtensionCategory struct {
+	Name string
+	Exts []string
+}
+
+// ExtensionCategories are checked in order
+var ExtensionCategories = []ExtensionCategory{
+	{"video", []string{"mkv", "mp4", "avi", "m4v", "mov", "wmv", "webm", "mpg", "mpeg", "ts", "flv"}},
+	{"audio", []string{"mp3", "flac", "m4a", "aac", "ogg", "opus", "wav", "wma", "ape"}},
+	{"image", []string{"jpg", "jpeg", "png", "gif", "bmp", "webp", "tif", "tiff"}},
+	{"document", []string{"pdf", "epub", "mobi", "azw3", "djvu", "doc", "docx", "txt", "cbr", "cbz"}},
+	{"archive", []string{"zip", "rar", "7z", "tar", "gz", "bz2", "xz", "iso"}},
+	{"software", []string{"exe", "msi", "dmg", "apk", "deb", "rpm", "bin"}},
+}
+
+// SizeBucketName returns the bucket for a size
+func SizeBucketName(size int64) string {
+	for _, b := range SizeBuckets[:len(SizeBuckets)-1] {
+		if size < b.Max {
+			return b.Name
+		}
+	}
+	return SizeBuckets[len(SizeBuckets)-1].Name
+}
+
+// ExtensionCategoryName returns the category of a file, or "" if unknown
+func ExtensionCategoryName(p string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+	for _, c := range ExtensionCategories {
+		for _, e := range c.Exts {
+			if e == ext {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Add counts a value of a facet, the "total" facet sets the total
+func (f *Facets) Add(facet, value string, count int) {
+	c := FacetCount{value, count}
+	switch facet {
+	case "total":
+		f.Total = count
+	case "tag":
+		f.Tags = append(f.Tags, c)
+	case "size":
+		f.Sizes = append(f.Sizes, c)
+	case "extension":
+		f.Extensions = append(f.Extensions, c)
+	case "first_seen":
+		f.FirstSeen = append(f.FirstSeen, c)
+	}
+}
+
+// Sort orders sizes by bucket, dates from the earliest and the rest by count,
+// keeping the most common tags
+func (f *Facets) Sort() {
+	byCount := func(counts []FacetCount) {
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Count != counts[j].Count {
+				return counts[i].Count > counts[j].Count
+			}
+			return counts[i].Value < counts[j].Value
+		})
+	}
+	byCount(f.Tags)
+	if len(f.Tags) > FacetTagsLimit {
+		f.Tags = f.Tags[:FacetTagsLimit]
+	}
+	byCount(f.Extensions)
+
+	bucket := make(map[string]int)
+	for i, b := range SizeBuckets {
+		bucket[b.Name] = i
+	}
+	sort.Slice(f.Sizes, func(i, j int) bool {
+		return bucket[f.Sizes[i].Value] < bucket[f.Sizes[j].Value]
+	})
+	sort.Slice(f.FirstSeen, func(i, j int) bool {
+		return f.FirstSeen[i].Value < f.FirstSeen[j].Value
+	})
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSizeBucketName(t *testing.T) {
+	tests := map[int64]string{
+		0:         "<100MB",
+		100 << 20: "100MB-1GB",
+		3 << 30:   "1GB-4GB",
+		16 << 30:  ">16GB",
+	}
+	for size, expected := range tests {
+		if b := SizeBucketName(size); b != expected {
+			t.Errorf("SizeBucketName(%d) => %q, expected %q", size, b, expected)
+		}
+	}
+}
+
+func TestExtensionCategoryName(t *testing.T) {
+	tests := map[string]string{
+		"a/movie.MKV": "video",
+		"song.flac":   "audio",
+		"setup.exe":   "software",
+		"README":      "",
+		"a.b/c":       "",
+	}
+	for p, expected := range tests {
+		if c := ExtensionCategoryName(p); c != expected {
+			t.Errorf("ExtensionCategoryName(%q) => %q, expected %q", p, c, expected)
+		}
+	}
+}
+
+func TestFacetsSort(t *testing.T) {
+	var f Facets
+	f.Add("total", "", 4)
+	f.Add("size", ">16GB", 1)
+	f.Add("size", "<100MB", 3)
+	f.Add("first_seen", "2020-02", 1)
+	f.Add("first_seen", "2019-12", 3)
+	for i := 0; i < FacetTagsLimit+5; i++ {
+		f.Add("tag", string(rune('a'+i)), 1)
+	}
+	f.Add("tag", "z", 2)
+	f.Sort()
+
+	if f.Total != 4 {
+		t.Errorf("Total => %d, expected 4", f.Total)
+	}
+	if len(f.Tags) != FacetTagsLimit || f.Tags[0] != (FacetCount{"z", 2}) || f.Tags[1].Value != "a" {
+		t.Errorf("Tags => %v", f.Tags)
+	}
+	if !reflect.DeepEqual(f.Sizes, []FacetCount{{"<100MB", 3}, {">16GB", 1}}) {
+		t.Errorf("Sizes => %v", f.Sizes)
+	}
+	if f.FirstSeen[0].Value != "2019-12" {
+		t.Errorf("FirstSeen => %v", f.FirstSeen)
+	}
+}
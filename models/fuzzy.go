@@ -0,0 +1,58 @@
+package models
+
+import "strings"
+
+// FuzzyThreshold is the least WordSimilarity of a fuzzy match, as the
+// pg_trgm similarity threshold
+const FuzzyThreshold = 0.3
+
+// Words splits text into lower case words of letters and numbers
+func Words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// trigrams adds the trigrams of a word to a set, padded as pg_trgm does with
+// two spaces before and one after
+func trigrams(set map[string]bool, word string) {
+	r := []rune("  " + word + " ")
+	for i := 0; i+3 <= len(r); i++ {
+		set[string(r[i:i+3])] = true
+	}
+}
+
+// WordSimilarity compares the trigrams of a word with those of the closest
+// run of whole words in text, like the strict_word_similarity of pg_trgm.
+// It is from 0 for nothing in common to 1 for a matching word.
+func WordSimilarity(word, text string) float64 {
+	want := make(map[string]bool)
+	for _, w := range Words(word) {
+		trigrams(want, w)
+	}
+	if len(want) == 0 {
+		return 0
+	}
+
+	words := Words(text)
+	best := 0.0
+	for i := range words {
+		run := make(map[string]bool)
+		for j := i; j < len(words); j++ {
+			trigrams(run, words[j])
+			common := 0
+			for t := range run {
+				if want[t] {
+					common++
+				}
+			}
+			if common == 0 {
+				break
+			}
+			if sim := float64(common) / float64(len(want)+len(run)-common); sim > best {
+				best = sim
+			}
+		}
+	}
+	return best
+}
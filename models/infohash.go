@@ -2,6 +2,7 @@ package models
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -9,19 +10,25 @@ import (
 	"time"
 )
 
-const InfohashLength = 20
+const (
+	// InfohashLength is the length of v1 SHA1 infohashes
+	InfohashLength = 20
+	// InfohashV2Length is the length of v2 SHA256 infohashes
+	InfohashV2Length = 32
+)
 
-// Infohash is a 160 bit (20 byte) value
+// Infohash is a 160 bit (20 byte) v1 or 256 bit (32 byte) v2 value
 type Infohash []byte
 
-// InfohashFromString converts a 40 digit hexadecimal string to an Infohash
+// InfohashFromString converts a 40 or 64 digit hexadecimal string to an
+// Infohash
 func InfohashFromString(s string) (*Infohash, error) {
 	switch len(s) {
-	case 20:
+	case InfohashLength, InfohashV2Length:
 		// Binary string
 		ih := Infohash([]byte(s))
 		return &ih, nil
-	case 40:
+	case InfohashLength * 2, InfohashV2Length * 2:
 		// Hex string
 		b, err := hex.DecodeString(s)
 		if err != nil {
@@ -43,8 +50,28 @@ func (ih Infohash) Bytes() []byte {
 }
 
 func (ih Infohash) Valid() bool {
-	// TODO
-	return len(ih) == 20
+	return len(ih) == InfohashLength || len(ih) == InfohashV2Length
+}
+
+// IsV2 checks for a full length v2 infohash
+func (ih Infohash) IsV2() bool {
+	return len(ih) == InfohashV2Length
+}
+
+// Truncated returns the 20 byte form of the infohash, as v2 infohashes are
+// used on the DHT and in the peer wire protocol
+func (ih Infohash) Truncated() Infohash {
+	if len(ih) > InfohashLength {
+		return ih[:InfohashLength]
+	}
+	return ih
+}
+
+// MetadataInfohashes returns the v1 and v2 infohashes of an info dictionary
+func MetadataInfohashes(md []byte) (v1, v2 Infohash) {
+	h1 := sha1.Sum(md)
+	h2 := sha256.Sum256(md)
+	return Infohash(h1[:]), Infohash(h2[:])
 }
 
 func (ih Infohash) Equal(other Infohash) bool {
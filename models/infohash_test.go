@@ -83,3 +83,46 @@ func TestInfohashDistance(t *testing.T) {
 		}
 	}
 }
+
+func TestInfohashV2(t *testing.T) {
+	hex64 := "6f2b1c6a9b5e4f3d2c1b0a99887766554433221100ffeeddccbbaa9988776655"
+	ih, err := InfohashFromString(hex64)
+	if err != nil {
+		t.Fatalf("InfohashFromString failed with %s", err)
+	}
+	if !ih.Valid() || !ih.IsV2() || ih.String() != hex64 {
+		t.Errorf("expected valid v2 infohash %s, got %s", hex64, ih)
+	}
+	if tr := ih.Truncated(); len(tr) != InfohashLength || tr.String() != hex64[:40] {
+		t.Errorf("Truncated() => %s", tr)
+	}
+
+	v1 := GenInfohash()
+	if v1.IsV2() || !v1.Truncated().Equal(v1) {
+		t.Errorf("v1 infohash should not be changed by Truncated()")
+	}
+	if Infohash(make([]byte, 21)).Valid() {
+		t.Errorf("21 byte infohash should be invalid")
+	}
+}
+
+func TestInfohashMatchesMetadata(t *testing.T) {
+	md := []byte("d4:name4:teste")
+	v1, v2 := MetadataInfohashes(md)
+
+	tests := []struct {
+		ih Infohash
+		ok bool
+	}{
+		{v1, true},
+		{v2, true},
+		{v2.Truncated(), true},
+		{v2[:16], false},
+		{GenInfohash(), false},
+	}
+	for _, tt := range tests {
+		if ok := InfohashMatchesMetadata(tt.ih, md); ok != tt.ok {
+			t.Errorf("InfohashMatchesMetadata(%s) => %t, expected %t", tt.ih, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	btmhPrefix = "urn:btmh:"
+	// Multihash prefix for a 32 byte SHA256 digest
+	sha256Multihash = "1220"
+)
+
+// Magnet is a parsed magnet URI
+type Magnet struct {
+	// Infohash is the v1 infohash, or the truncated v2 infohash for v2 only
+	// magnets, as used on the DHT
+	Infohash Infohash
+	// InfohashV2 is the full v2 infohash if given
+	InfohashV2 Infohash
+	// Name is the display name hint
+	Name string
+	// Size is the exact length hint
+	Size int
+	// Trackers are tracker URLs
+	Trackers []string
+	// Peers are host:port addresses of peers
+	Peers []string
+}
+
+// ParseMagnet parses a magnet URI with a btih or btmh exact topic
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet scheme %q", u.Scheme)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		Peers:    q["x.pe"],
+	}
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, btihPrefix):
+			if m.Infohash, err = parseBtih(xt[len(btihPrefix):]); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(xt, btmhPrefix):
+			if m.InfohashV2, err = parseBtmh(xt[len(btmhPrefix):]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.Infohash == nil {
+		if m.InfohashV2 == nil {
+			return nil, fmt.Errorf("missing infohash")
+		}
+		m.Infohash = m.InfohashV2.Truncated()
+	}
+	if xl := q.Get("xl"); xl != "" {
+		if m.Size, err = strconv.Atoi(xl); err != nil || m.Size < 0 {
+			return nil, fmt.Errorf("invalid length %q", xl)
+		}
+	}
+	return m, nil
+}
+
+// parseBtih decodes a hex or base32 v1 infohash
+func parseBtih(s string) (Infohash, error) {
+	var b []byte
+	var err error
+	switch len(s) {
+	case InfohashLength * 2:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return nil, fmt.Errorf("invalid btih length %d", len(s))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid btih: %s", err)
+	}
+	return Infohash(b), nil
+}
+
+// parseBtmh decodes a hex SHA256 multihash v2 infohash
+func parseBtmh(s string) (Infohash, error) {
+	if !strings.HasPrefix(s, sha256Multihash) || len(s) != len(sha256Multihash)+InfohashV2Length*2 {
+		return nil, fmt.Errorf("unsupported btmh %q", s)
+	}
+	b, err := hex.DecodeString(s[len(sha256Multihash):])
+	if err != nil {
+		return nil, fmt.Errorf("invalid btmh: %s", err)
+	}
+	return Infohash(b), nil
+}
+
+// String implements fmt.Stringer, returning the magnet URI
+func (m Magnet) String() string {
+	var params []string
+	// v2 only magnets have no v1 infohash
+	if !m.Infohash.Equal(m.InfohashV2.Truncated()) {
+		params = append(params, "xt="+btihPrefix+m.Infohash.String())
+	}
+	if m.InfohashV2 != nil {
+		params = append(params, "xt="+btmhPrefix+sha256Multihash+m.InfohashV2.String())
+	}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	if m.Size > 0 {
+		params = append(params, "xl="+strconv.Itoa(m.Size))
+	}
+	for _, tr := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tr))
+	}
+	for _, pe := range m.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(pe))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Magnet builds the magnet URI for the torrent with optional trackers
+func (t *Torrent) Magnet(trackers []string) string {
+	return Magnet{
+		Infohash:   t.Infohash,
+		InfohashV2: t.InfohashV2,
+		Name:       t.Name,
+		Size:       t.Size,
+		Trackers:   trackers,
+	}.String()
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"encoding/base32"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	v1 := "d1c5676ae7ac98e8b19f63565905105e3c4c37a2"
+	v2 := "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	ih1, _ := InfohashFromString(v1)
+	ih2, _ := InfohashFromString(v2)
+
+	tests := []struct {
+		uri      string
+		expected *Magnet
+	}{
+		{
+			"magnet:?xt=urn:btih:" + v1 + "&dn=Some+name&xl=1024&tr=udp%3A%2F%2Fone%3A80&tr=http://two/announce&x.pe=10.0.0.1:6881",
+			&Magnet{
+				Infohash: *ih1,
+				Name:     "Some name",
+				Size:     1024,
+				Trackers: []string{"udp://one:80", "http://two/announce"},
+				Peers:    []string{"10.0.0.1:6881"},
+			},
+		},
+		{
+			"magnet:?xt=urn:btih:" + base32.StdEncoding.EncodeToString(*ih1),
+			&Magnet{Infohash: *ih1},
+		},
+		{
+			"magnet:?xt=urn:btmh:1220" + v2,
+			&Magnet{Infohash: ih2.Truncated(), InfohashV2: *ih2},
+		},
+		{
+			"magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2,
+			&Magnet{Infohash: *ih1, InfohashV2: *ih2},
+		},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseMagnet(tt.uri)
+		if err != nil {
+			t.Errorf("ParseMagnet(%q) failed: %s", tt.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, tt.expected) {
+			t.Errorf("ParseMagnet(%q) => %+v, expected %+v", tt.uri, m, tt.expected)
+		}
+	}
+
+	invalid := []string{
+		"http://example.com/?xt=urn:btih:" + v1,
+		"magnet:?dn=missing",
+		"magnet:?xt=urn:btih:abcd",
+		"magnet:?xt=urn:btmh:1114" + v2,
+		"magnet:?xt=urn:btih:" + v1 + "&xl=-1",
+	}
+	for _, uri := range invalid {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("ParseMagnet(%q) should fail", uri)
+		}
+	}
+}
+
+func TestTorrentMagnet(t *testing.T) {
+	ih1, _ := InfohashFromString("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	ih2, _ := InfohashFromString("caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e")
+
+	tests := []struct {
+		torrent  Torrent
+		trackers []string
+		expected string
+	}{
+		{
+			Torrent{Infohash: *ih1, Name: "a & b", Size: 10},
+			[]string{"udp://one:80"},
+			"magnet:?xt=urn:btih:d1c5676ae7ac98e8b19f63565905105e3c4c37a2&dn=a+%26+b&xl=10&tr=udp%3A%2F%2Fone%3A80",
+		},
+		{
+			Torrent{Infohash: ih2.Truncated(), InfohashV2: *ih2, Name: "v2"},
+			nil,
+			"magnet:?xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e&dn=v2",
+		},
+		{
+			Torrent{Infohash: *ih1, InfohashV2: *ih2, Hybrid: true},
+			nil,
+			"magnet:?xt=urn:btih:d1c5676ae7ac98e8b19f63565905105e3c4c37a2&xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e",
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.torrent.Magnet(tt.trackers)
+		if got != tt.expected {
+			t.Errorf("Magnet() => %q, expected %q", got, tt.expected)
+		}
+		m, err := ParseMagnet(got)
+		if err != nil {
+			t.Errorf("ParseMagnet(%q) failed: %s", got, err)
+			continue
+		}
+		if !m.Infohash.Equal(tt.torrent.Infohash) || !m.InfohashV2.Equal(tt.torrent.InfohashV2) {
+			t.Errorf("round trip of %q => %+v", got, m)
+		}
+	}
+}
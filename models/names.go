@@ -0,0 +1,181 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// legacyEncoding is a candidate for names that are not UTF-8
+type legacyEncoding struct {
+	enc encoding.Encoding
+	// likely reports whether a decoded rune, encoded as b, is common in
+	// text using this encoding
+	likely func(r rune, b []byte) bool
+}
+
+// legacyEncodings are tried in order, earlier ones winning ties
+var legacyEncodings = []legacyEncoding{
+	{japanese.ShiftJIS, func(r rune, b []byte) bool {
+		// Kana other than half width, and JIS level 1 kanji
+		return unicode.Is(unicode.Hiragana, r) ||
+			(unicode.Is(unicode.Katakana, r) && len(b) == 2) ||
+			(unicode.Is(unicode.Han, r) && b[0] >= 0x88 && b[0] <= 0x98)
+	}},
+	{simplifiedchinese.GBK, func(r rune, b []byte) bool {
+		// GB2312 level 1 hanzi
+		return unicode.Is(unicode.Han, r) && b[0] >= 0xb0 && b[0] <= 0xd7
+	}},
+	{traditionalchinese.Big5, func(r rune, b []byte) bool {
+		// Frequently used hanzi
+		return unicode.Is(unicode.Han, r) && b[0] >= 0xa4 && b[0] <= 0xc6
+	}},
+	{korean.EUCKR, func(r rune, b []byte) bool {
+		return unicode.Is(unicode.Hangul, r)
+	}},
+	{charmap.Windows1251, func(r rune, b []byte) bool {
+		return unicode.Is(unicode.Cyrillic, r)
+	}},
+	{charmap.Windows1252, func(r rune, b []byte) bool {
+		return unicode.Is(unicode.Latin, r)
+	}},
+}
+
+// nameDecoder converts names and paths in metadata to UTF-8, recording
+// whether any needed repair
+type nameDecoder struct {
+	// hint is from the encoding field, if known
+	hint     encoding.Encoding
+	repaired bool
+}
+
+func newNameDecoder(info map[string]interface{}) *nameDecoder {
+	d := &nameDecoder{}
+	if e, ok := info["encoding"].(string); ok {
+		if enc, err := htmlindex.Get(strings.TrimSpace(e)); err == nil {
+			d.hint = enc
+		}
+	}
+	return d
+}
+
+// component decodes a name or path component, rejecting those that could
+// escape the torrent's directory
+func (d *nameDecoder) component(s string) (string, error) {
+	out, err := d.decode(s)
+	if err != nil {
+		return "", err
+	}
+	return out, checkComponent(out)
+}
+
+// components decodes a path component, splitting those transcoded from a
+// legacy encoding on the backslashes Windows clients wrote as separators.
+// Backslashes in UTF-8 components are not treated as separators.
+func (d *nameDecoder) components(s string) ([]string, error) {
+	out, err := d.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := []string{out}
+	if !utf8.ValidString(s) {
+		parts = strings.Split(out, `\`)
+	}
+	for _, p := range parts {
+		if err := checkComponent(p); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func checkComponent(s string) error {
+	if s == "" || s == "." || s == ".." || strings.ContainsAny(s, `/\`) {
+		return fmt.Errorf("invalid path component %q", s)
+	}
+	return nil
+}
+
+// decode converts s to UTF-8, rejecting control characters
+func (d *nameDecoder) decode(s string) (string, error) {
+	out := s
+	if !utf8.ValidString(s) {
+		out = d.transcode(s)
+		d.repaired = true
+	}
+	for _, r := range out {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return "", fmt.Errorf("invalid character %U in %q", r, out)
+		}
+	}
+	return out, nil
+}
+
+// transcode uses the encoding field or the most likely legacy encoding,
+// replacing invalid bytes if none fit
+func (d *nameDecoder) transcode(s string) string {
+	if d.hint != nil {
+		if out, ok := decodeString(d.hint, s); ok {
+			return out
+		}
+	}
+
+	best, bestScore := "", 0.0
+	for _, le := range legacyEncodings {
+		out, ok := decodeString(le.enc, s)
+		if !ok {
+			continue
+		}
+		if score := likelihood(le, out); score > bestScore {
+			best, bestScore = out, score
+		}
+	}
+	if best != "" {
+		return best
+	}
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+// decodeString fails if any bytes were invalid in the encoding
+func decodeString(enc encoding.Encoding, s string) (string, bool) {
+	out, err := enc.NewDecoder().String(s)
+	if err != nil || strings.ContainsRune(out, utf8.RuneError) {
+		return "", false
+	}
+	for _, r := range out {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	return out, true
+}
+
+// likelihood is the proportion of non-ASCII runes that are common in the
+// encoding's texts
+func likelihood(le legacyEncoding, s string) float64 {
+	total, likely := 0, 0
+	encoder := le.enc.NewEncoder()
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			continue
+		}
+		total++
+		b, err := encoder.Bytes([]byte(string(r)))
+		if err == nil && len(b) > 0 && le.likely(r, b) {
+			likely++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(likely) / float64(total)
+}
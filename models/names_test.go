@@ -0,0 +1,170 @@
+package models
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"src.userspace.com.au/go-bencode"
+)
+
+func encodeName(t *testing.T, enc encoding.Encoding, s string) string {
+	out, err := enc.NewEncoder().String(s)
+	if err != nil {
+		t.Fatalf("failed to encode %q: %s", s, err)
+	}
+	return out
+}
+
+func TestTorrentFromMetadataNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     map[string]interface{}
+		expected string
+		path     string
+		repaired bool
+	}{
+		{
+			name:     "utf-8",
+			info:     map[string]interface{}{"name": "日本語"},
+			expected: "日本語",
+		},
+		{
+			name:     "shift-jis",
+			info:     map[string]interface{}{"name": encodeName(t, japanese.ShiftJIS, "日本語のファイル")},
+			expected: "日本語のファイル",
+			repaired: true,
+		},
+		{
+			name:     "gbk",
+			info:     map[string]interface{}{"name": encodeName(t, simplifiedchinese.GBK, "中文电影")},
+			expected: "中文电影",
+			repaired: true,
+		},
+		{
+			name:     "cp1251",
+			info:     map[string]interface{}{"name": encodeName(t, charmap.Windows1251, "Привет мир")},
+			expected: "Привет мир",
+			repaired: true,
+		},
+		{
+			name: "encoding field",
+			info: map[string]interface{}{
+				// Would be detected as CP1251
+				"name":     encodeName(t, charmap.Windows1252, "Café"),
+				"encoding": "latin1",
+			},
+			expected: "Café",
+			repaired: true,
+		},
+		{
+			name: "invalid utf-8 variant",
+			info: map[string]interface{}{
+				"name":       "name",
+				"name.utf-8": "bad\xff",
+			},
+			expected: "name",
+		},
+		{
+			name: "path",
+			info: map[string]interface{}{
+				"name": "dir",
+				"files": []interface{}{
+					map[string]interface{}{
+						"length": 1,
+						"path":   []interface{}{"sub", encodeName(t, charmap.Windows1251, "файл.txt")},
+					},
+				},
+			},
+			expected: "dir",
+			path:     "sub/файл.txt",
+			repaired: true,
+		},
+		{
+			name: "windows separators",
+			info: map[string]interface{}{
+				"name": "dir",
+				"files": []interface{}{
+					map[string]interface{}{
+						"length": 1,
+						"path":   []interface{}{encodeName(t, japanese.ShiftJIS, `日本語\ファイル.txt`)},
+					},
+				},
+			},
+			expected: "dir",
+			path:     "日本語/ファイル.txt",
+			repaired: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := tt.info["files"]; !ok {
+				tt.info["length"] = 1
+			}
+			md, err := bencode.EncodeDict(tt.info)
+			if err != nil {
+				t.Fatalf("failed to encode metadata: %s", err)
+			}
+			ih := sha1.Sum(md)
+			tor, err := TorrentFromMetadata(Infohash(ih[:]), md)
+			if err != nil {
+				t.Fatalf("TorrentFromMetadata failed: %s", err)
+			}
+			if tor.Name != tt.expected {
+				t.Errorf("name => %q, expected %q", tor.Name, tt.expected)
+			}
+			if tor.Repaired != tt.repaired {
+				t.Errorf("repaired => %t, expected %t", tor.Repaired, tt.repaired)
+			}
+			if tt.path != "" && (len(tor.Files) != 1 || tor.Files[0].Path != tt.path) {
+				t.Errorf("files => %+v, expected %q", tor.Files, tt.path)
+			}
+		})
+	}
+}
+
+func TestTorrentFromMetadataInvalidNames(t *testing.T) {
+	tests := map[string]map[string]interface{}{
+		"parent name":    {"name": "..", "length": 1},
+		"control name":   {"name": "a\x1bb", "length": 1},
+		"bidi name":      {"name": "exe\u202etxt.scr", "length": 1},
+		"separator name": {"name": "a/b", "length": 1},
+		"parent path": {"name": "dir", "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{"..", "etc", "passwd"}},
+		}},
+		"empty path": {"name": "dir", "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{"a", ""}},
+		}},
+		"separator path": {"name": "dir", "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{`..\..\x`}},
+		}},
+		"transcoded parent path": {"name": "dir", "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{"\x93\xfa\\..\\x"}},
+		}},
+		"control path": {"name": "dir", "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{"a\nb"}},
+		}},
+		"v2 parent path": {"name": "dir", "meta version": 2, "piece length": 4, "file tree": map[string]interface{}{
+			"..": map[string]interface{}{
+				"x": map[string]interface{}{"": map[string]interface{}{"length": 1}},
+			},
+		}},
+	}
+
+	for name, info := range tests {
+		t.Run(name, func(t *testing.T) {
+			md, err := bencode.EncodeDict(info)
+			if err != nil {
+				t.Fatalf("failed to encode metadata: %s", err)
+			}
+			ih := sha1.Sum(md)
+			if _, err = TorrentFromMetadata(Infohash(ih[:]), md); err == nil {
+				t.Errorf("TorrentFromMetadata should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Page sizes and the most matches counted for Results.Total
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+	MaxTotal        = 10000
+)
+
+// ErrInvalidCursor is returned for cursors not from a search with the same
+// ordering
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects a page of search results
+type Page struct {
+	Order Ordering
+	// Size is DefaultPageSize when zero and at most MaxPageSize
+	Size int
+	// Cursor is the Next of the previous page, empty for the first
+	Cursor string
+	// Collapse returns the first match of each cluster of duplicates, with
+	// the number of matching Variants
+	Collapse bool
+}
+
+// Limit returns the page size within its bounds
+func (p Page) Limit() int {
+	switch {
+	case p.Size <= 0:
+		return DefaultPageSize
+	case p.Size > MaxPageSize:
+		return MaxPageSize
+	}
+	return p.Size
+}
+
+// Results are a page of matching torrents
+type Results struct {
+	Torrents []*Torrent `json:"torrents"`
+	// Next continues after the last torrent of a full page
+	Next string `json:"next,omitempty"`
+	// Total counts the matches of every page, up to MaxTotal
+	Total int `json:"total"`
+	// Estimated is set when there are more than MaxTotal matches
+	Estimated bool `json:"total_estimated,omitempty"`
+}
+
+// SetTotal sets the total from a count of at most MaxTotal+1 matches
+func (r *Results) SetTotal(n int) {
+	r.Total, r.Estimated = n, n > MaxTotal
+	if r.Estimated {
+		r.Total = MaxTotal
+	}
+}
+
+// cursor is the order and sort keys of the last result of a page
+type cursor struct {
+	Order Ordering      `json:"o"`
+	Keys  []interface{} `json:"k"`
+}
+
+// EncodeCursor returns an opaque token continuing a search after a result
+// with the given sort keys
+func EncodeCursor(order Ordering, keys []interface{}) string {
+	b, err := json.Marshal(cursor{order, keys})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor returns the n sort keys of a cursor for an ordering. Whole
+// numbers are int64, other numbers float64 and times strings.
+func DecodeCursor(token string, order Ordering, n int) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var c cursor
+	if err = d.Decode(&c); err != nil || c.Order != order || len(c.Keys) != n {
+		return nil, ErrInvalidCursor
+	}
+	for i, k := range c.Keys {
+		switch v := k.(type) {
+		case json.Number:
+			if c.Keys[i], err = v.Int64(); err != nil {
+				if c.Keys[i], err = v.Float64(); err != nil {
+					return nil, ErrInvalidCursor
+				}
+			}
+		case string, nil:
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+	return c.Keys, nil
+}
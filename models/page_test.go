@@ -0,0 +1,54 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageLimit(t *testing.T) {
+	for size, expected := range map[int]int{
+		-1: DefaultPageSize, 0: DefaultPageSize, 10: 10, MaxPageSize + 1: MaxPageSize,
+	} {
+		if l := (Page{Size: size}).Limit(); l != expected {
+			t.Errorf("Limit(%d) => %d, expected %d", size, l, expected)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	keys := []interface{}{int64(-3), 0.25, "2020-01-02 03:04:05", nil, int64(1 << 60)}
+	token := EncodeCursor(OrderSize, keys)
+
+	out, err := DecodeCursor(token, OrderSize, len(keys))
+	if err != nil {
+		t.Fatalf("DecodeCursor failed: %s", err)
+	}
+	if !reflect.DeepEqual(out, keys) {
+		t.Errorf("DecodeCursor => %#v, expected %#v", out, keys)
+	}
+
+	for _, tt := range []struct {
+		token string
+		order Ordering
+		n     int
+	}{
+		{token, OrderDefault, len(keys)},
+		{token, OrderSize, 2},
+		{"!", OrderSize, len(keys)},
+		{EncodeCursor(OrderSize, []interface{}{[]int{1}}), OrderSize, 1},
+	} {
+		if _, err = DecodeCursor(tt.token, tt.order, tt.n); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q, %s, %d) => %v, expected ErrInvalidCursor", tt.token, tt.order, tt.n, err)
+		}
+	}
+}
+
+func TestResultsSetTotal(t *testing.T) {
+	var r Results
+	if r.SetTotal(7); r.Total != 7 || r.Estimated {
+		t.Errorf("SetTotal(7) => %d, %t", r.Total, r.Estimated)
+	}
+	if r.SetTotal(MaxTotal + 1); r.Total != MaxTotal || !r.Estimated {
+		t.Errorf("SetTotal(%d) => %d, %t", MaxTotal+1, r.Total, r.Estimated)
+	}
+}
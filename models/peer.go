@@ -12,6 +12,11 @@ type Peer struct {
 	Infohash Infohash  `db:"infohash"`
 	Created  time.Time `db:"created" json:"created"`
 	Updated  time.Time `db:"updated" json:"updated"`
+
+	// Fingerprint from the BitTorrent handshakes
+	ID     []byte `db:"peer_id" json:"peer_id,omitempty"`
+	Client Client `db:"client" json:"client"`
+	Agent  string `db:"agent" json:"agent,omitempty"`
 }
 
 // String implements fmt.Stringer
@@ -0,0 +1,283 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query is a parsed search query. Every term and filter must match.
+//
+// Words and "quoted phrases" match torrent names or file paths, and are
+// excluded with a leading '-'. The filters are tag:video, ext:mkv, size:>1GB, files:>10 and
+// seen:<7d, where seen compares the time since the last announce. Tags and
+// extensions can also be excluded. With mode:fuzzy the included words match
+// similar words of names. cluster:<id> matches the duplicates in a cluster.
+type Query struct {
+	Terms []QueryTerm
+	Tags  []QueryTerm
+	Exts  []QueryTerm
+	// Size is in bytes
+	Size []Comparison
+	// Files counts single file torrents as one
+	Files []Comparison
+	// Seen is the age of the last announce, in seconds
+	Seen []Comparison
+	// Fuzzy matches words by WordSimilarity
+	Fuzzy bool
+	// Cluster is a Torrent.ClusterID when not zero
+	Cluster int
+}
+
+// QueryTerm is a word, phrase, tag or extension
+type QueryTerm struct {
+	Text    string
+	Exclude bool
+}
+
+// Comparison of a value with Op, one of =, <, <=, > or >=
+type Comparison struct {
+	Op    string
+	Value int64
+}
+
+// Match compares a value
+func (c Comparison) Match(v int64) bool {
+	switch c.Op {
+	case "<":
+		return v < c.Value
+	case "<=":
+		return v <= c.Value
+	case ">":
+		return v > c.Value
+	case ">=":
+		return v >= c.Value
+	}
+	return v == c.Value
+}
+
+// Invert returns the comparison with the operands swapped
+func (c Comparison) Invert() Comparison {
+	switch c.Op {
+	case "<":
+		c.Op = ">"
+	case "<=":
+		c.Op = ">="
+	case ">":
+		c.Op = "<"
+	case ">=":
+		c.Op = "<="
+	}
+	return c
+}
+
+// Empty is true when the query matches nothing
+func (q *Query) Empty() bool {
+	return len(q.Terms)+len(q.Tags)+len(q.Exts)+len(q.Size)+len(q.Files)+len(q.Seen) == 0 &&
+		q.Cluster == 0
+}
+
+// FuzzyWords returns the distinct words of the included terms
+func (q *Query) FuzzyWords() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, t := range IncludedTerms(q.Terms) {
+		for _, w := range Words(t) {
+			if !seen[w] {
+				seen[w] = true
+				out = append(out, w)
+			}
+		}
+	}
+	return out
+}
+
+// IncludedTerms returns the text of the terms not excluded
+func IncludedTerms(terms []QueryTerm) (out []string) {
+	for _, t := range terms {
+		if !t.Exclude {
+			out = append(out, t.Text)
+		}
+	}
+	return out
+}
+
+// ExcludedTerms returns the text of the excluded terms
+func ExcludedTerms(terms []QueryTerm) (out []string) {
+	for _, t := range terms {
+		if t.Exclude {
+			out = append(out, t.Text)
+		}
+	}
+	return out
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+}
+
+var ageUnits = map[string]time.Duration{
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// ParseQuery parses a search query. Unknown filters are searched for as
+// words.
+func ParseQuery(s string) (*Query, error) {
+	q := new(Query)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeftFunc(s, unicode.IsSpace) {
+		exclude := false
+		if s[0] == '-' {
+			exclude = true
+			s = s[1:]
+			// A lone '-' excludes nothing
+			if s == "" || unicode.IsSpace(rune(s[0])) {
+				continue
+			}
+		}
+
+		var token string
+		if token, s = nextToken(s); token == "" {
+			continue
+		}
+
+		field, value := "", token
+		if i := strings.Index(token, ":"); i > 0 && token[0] != '"' {
+			field, value = strings.ToLower(token[:i]), strings.Trim(token[i+1:], `"`)
+		}
+
+		var err error
+		switch field {
+		case "tag":
+			if value = strings.ToLower(value); value == "" {
+				return nil, fmt.Errorf("missing tag")
+			}
+			q.Tags = append(q.Tags, QueryTerm{value, exclude})
+		case "ext":
+			value = strings.ToLower(strings.TrimPrefix(value, "."))
+			if value == "" || strings.Contains(value, "/") {
+				return nil, fmt.Errorf("invalid extension %q", value)
+			}
+			q.Exts = append(q.Exts, QueryTerm{value, exclude})
+		case "mode":
+			switch value = strings.ToLower(value); {
+			case exclude:
+				return nil, fmt.Errorf("mode cannot be excluded")
+			case value == "fuzzy" || value == "exact":
+				q.Fuzzy = value == "fuzzy"
+			default:
+				return nil, fmt.Errorf("invalid mode %q, use exact or fuzzy", value)
+			}
+		case "cluster":
+			if q.Cluster, err = strconv.Atoi(value); err != nil || exclude || q.Cluster < 1 {
+				return nil, fmt.Errorf("invalid cluster %q", value)
+			}
+		case "size", "files", "seen":
+			if exclude {
+				return nil, fmt.Errorf("%s cannot be excluded", field)
+			}
+			var c Comparison
+			if c, err = parseComparison(field, value); err != nil {
+				return nil, err
+			}
+			switch field {
+			case "size":
+				q.Size = append(q.Size, c)
+			case "files":
+				q.Files = append(q.Files, c)
+			case "seen":
+				q.Seen = append(q.Seen, c)
+			}
+		default:
+			token = strings.Trim(token, `"`)
+			if strings.IndexFunc(token, isWordRune) >= 0 {
+				q.Terms = append(q.Terms, QueryTerm{token, exclude})
+			}
+		}
+	}
+	return q, nil
+}
+
+// nextToken splits a quoted phrase, a word or a filter from the start of s.
+// Filter values may be quoted.
+func nextToken(s string) (string, string) {
+	if s[0] == '"' {
+		if i := strings.IndexByte(s[1:], '"'); i >= 0 {
+			return s[:i+2], s[i+2:]
+		}
+		return s, ""
+	}
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		end = len(s)
+	}
+	if i := strings.Index(s[:end], `:"`); i >= 0 {
+		end = len(s)
+		if j := strings.IndexByte(s[i+2:], '"'); j >= 0 {
+			end = i + j + 3
+		}
+	}
+	return s[:end], s[end:]
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// parseComparison parses an optional operator and a value with units
+func parseComparison(field, s string) (c Comparison, err error) {
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(s, op) {
+			c.Op, s = op, s[len(op):]
+			break
+		}
+	}
+	if c.Op == "" {
+		if field != "files" {
+			return c, fmt.Errorf("%s needs a comparison operator", field)
+		}
+		c.Op = "="
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(s[i:])
+
+	switch field {
+	case "size":
+		n, err := strconv.ParseFloat(number, 64)
+		mult, ok := sizeUnits[unit]
+		if err != nil || !ok || n*float64(mult) >= math.MaxInt64 {
+			return c, fmt.Errorf("invalid size %q", s)
+		}
+		c.Value = int64(n * float64(mult))
+	case "files":
+		if c.Value, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return c, fmt.Errorf("invalid file count %q", s)
+		}
+	case "seen":
+		n, err := strconv.ParseInt(number, 10, 64)
+		mult, ok := ageUnits[unit]
+		if err != nil || !ok {
+			return c, fmt.Errorf("invalid age %q, use h, d, w or y", s)
+		}
+		// Ages are compared as durations
+		if n > int64(math.MaxInt64/mult) {
+			return c, fmt.Errorf("age %q is too long", s)
+		}
+		c.Value = n * int64(mult/time.Second)
+	}
+	return c, nil
+}
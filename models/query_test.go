@@ -0,0 +1,82 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Query
+	}{
+		{"", Query{}},
+		{"ubuntu  desktop", Query{Terms: []QueryTerm{{"ubuntu", false}, {"desktop", false}}}},
+		{`"big buck" -bunny -"cut scene"`, Query{Terms: []QueryTerm{
+			{"big buck", false}, {"bunny", true}, {"cut scene", true},
+		}}},
+		{`re:zero - !!`, Query{Terms: []QueryTerm{{"re:zero", false}}}},
+		{"-", Query{}},
+		{"foo -", Query{Terms: []QueryTerm{{"foo", false}}}},
+		{"- -\t-", Query{}},
+		{`tag:Video -tag:"tv shows" ext:.MKV -ext:exe`, Query{
+			Tags: []QueryTerm{{"video", false}, {"tv shows", true}},
+			Exts: []QueryTerm{{"mkv", false}, {"exe", true}},
+		}},
+		{"size:>1GB size:<=1.5g files:>10 files:3", Query{
+			Size:  []Comparison{{">", 1 << 30}, {"<=", 3 << 29}},
+			Files: []Comparison{{">", 10}, {"=", 3}},
+		}},
+		{"seen:<7d seen:>=2h", Query{Seen: []Comparison{{"<", 7 * 86400}, {">=", 7200}}}},
+		{"ubunut mode:Fuzzy", Query{Terms: []QueryTerm{{"ubunut", false}}, Fuzzy: true}},
+		{"cluster:12", Query{Cluster: 12}},
+	}
+
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.in)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %s", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(*q, tt.expected) {
+			t.Errorf("ParseQuery(%q) => %+v, expected %+v", tt.in, *q, tt.expected)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, in := range []string{
+		"size:1GB", "size:>1PB", "size:>big", "files:>many", "seen:<7m",
+		"-size:>1GB", "tag:", "ext:", "ext:a/b", "mode:loose", "-mode:fuzzy",
+		"cluster:0", "cluster:x", "-cluster:1",
+		"seen:<99999999999999y", "seen:>9223372036854775807h", "size:>9999999999TB",
+	} {
+		if _, err := ParseQuery(in); err == nil {
+			t.Errorf("ParseQuery(%q) should fail", in)
+		}
+	}
+}
+
+func TestFuzzyWords(t *testing.T) {
+	q, err := ParseQuery(`Some.Show "show s01" -other mode:fuzzy`)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %s", err)
+	}
+	expected := []string{"some", "show", "s01"}
+	if words := q.FuzzyWords(); !reflect.DeepEqual(words, expected) {
+		t.Errorf("FuzzyWords() => %v, expected %v", words, expected)
+	}
+}
+
+func TestComparison(t *testing.T) {
+	c := Comparison{"<", 10}
+	if !c.Match(9) || c.Match(10) {
+		t.Errorf("%v should only match below 10", c)
+	}
+	if i := c.Invert(); i.Op != ">" || !i.Match(11) {
+		t.Errorf("Invert() => %v", i)
+	}
+	if c = (Comparison{"=", 3}); !c.Invert().Match(3) {
+		t.Errorf("inverted equality should match")
+	}
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MinSimilarity is the least Similarity of similar torrents
+const MinSimilarity = 0.3
+
+// SimilarTorrent is a torrent and its Similarity to another
+type SimilarTorrent struct {
+	*Torrent
+	Similarity float64 `json:"similarity"`
+}
+
+// releaseWords describe a release rather than its content
+var releaseWords = map[string]bool{
+	"480p": true, "576p": true, "720p": true, "1080p": true, "2160p": true, "4k": true,
+	"x264": true, "x265": true, "h264": true, "h265": true, "hevc": true, "avc": true,
+	"xvid": true, "divx": true, "10bit": true, "8bit": true, "hdr": true,
+	"web": true, "webrip": true, "webdl": true, "dl": true, "hdtv": true, "bluray": true,
+	"brrip": true, "bdrip": true, "dvdrip": true, "hdrip": true, "remux": true,
+	"aac": true, "ac3": true, "dts": true, "proper": true, "repack": true, "internal": true,
+}
+
+func init() {
+	for _, c := range ExtensionCategories {
+		for _, ext := range c.Exts {
+			releaseWords[ext] = true
+		}
+	}
+}
+
+// NameTokens are the distinct words of a name without release details such
+// as resolutions, codecs and file extensions
+func NameTokens(name string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, w := range Words(name) {
+		if !releaseWords[w] && !seen[w] {
+			seen[w] = true
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// fileKeys are the lower case base names and sizes of the files of a torrent,
+// or its name and size for a single file
+func fileKeys(t *Torrent) map[string]bool {
+	out := make(map[string]bool)
+	if len(t.Files) == 0 {
+		out[fmt.Sprintf("%s:%d", strings.ToLower(t.Name), t.Size)] = true
+	}
+	for _, f := range t.Files {
+		out[fmt.Sprintf("%s:%d", strings.ToLower(path.Base(f.Path)), f.Size)] = true
+	}
+	return out
+}
+
+// Similarity averages the overlap of the name tokens and of the files of two
+// torrents, from 0 for nothing in common to 1
+func Similarity(a, b *Torrent) float64 {
+	tokens := func(t *Torrent) map[string]bool {
+		out := make(map[string]bool)
+		for _, w := range NameTokens(t.Name) {
+			out[w] = true
+		}
+		return out
+	}
+	return (jaccard(tokens(a), tokens(b)) + jaccard(fileKeys(a), fileKeys(b))) / 2
+}
+
+// jaccard is the size of the intersection of two sets over their union
+func jaccard(a, b map[string]bool) float64 {
+	common := 0
+	for k := range a {
+		if b[k] {
+			common++
+		}
+	}
+	if union := len(a) + len(b) - common; union > 0 {
+		return float64(common) / float64(union)
+	}
+	return 0
+}
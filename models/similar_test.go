@@ -0,0 +1,57 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWordSimilarity(t *testing.T) {
+	tests := []struct {
+		word, text string
+		min, max   float64
+	}{
+		{"show", "Some.Show.S01E02.720p.x264", 1, 1},
+		{"ubunut", "ubuntu-20.04-desktop", FuzzyThreshold, 0.5},
+		{"desktp", "ubuntu-20.04-desktop", FuzzyThreshold, 0.9},
+		{"bunny", "ubuntu-20.04-desktop", 0, FuzzyThreshold},
+		{"", "anything", 0, 0},
+	}
+	for _, tt := range tests {
+		if sim := WordSimilarity(tt.word, tt.text); sim < tt.min || sim > tt.max {
+			t.Errorf("WordSimilarity(%q, %q) => %f, expected %f to %f", tt.word, tt.text, sim, tt.min, tt.max)
+		}
+	}
+}
+
+func TestNameTokens(t *testing.T) {
+	expected := []string{"some", "show", "s01e02"}
+	if tokens := NameTokens("Some.Show.S01E02.720p.x264.Show.mkv"); !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("NameTokens() => %v, expected %v", tokens, expected)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	a := &Torrent{Name: "Some.Show.S01E02.720p", Files: []File{
+		{Path: "Some.Show.S01E02.720p/episode.mkv", Size: 1000},
+		{Path: "Some.Show.S01E02.720p/sample.mkv", Size: 100},
+	}}
+	b := &Torrent{Name: "Some Show S01E02 1080p", Files: []File{
+		{Path: "episode.mkv", Size: 2000},
+		{Path: "sample.mkv", Size: 100},
+	}}
+	single := &Torrent{Name: "other.mkv", Size: 1000}
+
+	for _, tt := range []struct {
+		a, b     *Torrent
+		expected float64
+	}{
+		{a, a, 1},
+		{a, b, (1 + 1.0/3) / 2},
+		{a, single, 0},
+		{single, single, 1},
+	} {
+		if sim := Similarity(tt.a, tt.b); sim != tt.expected {
+			t.Errorf("Similarity(%s, %s) => %f, expected %f", tt.a.Name, tt.b.Name, sim, tt.expected)
+		}
+	}
+}
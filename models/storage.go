@@ -1,28 +1,83 @@
 package models
 
-import ()
+import (
+	"context"
+	"errors"
+	"time"
+)
 
-type migratable interface {
-	MigrateSchema() error
-}
+// ErrNotFound is returned when a lookup matches nothing
+var ErrNotFound = errors.New("not found")
 
-type torrentSearcher interface {
-	TorrentsByHash(hash Infohash) (*Torrent, error)
-	TorrentsByName(query string, offset, limit int) ([]*Torrent, error)
-	TorrentsByTags(tags []string, offset, limit int) ([]*Torrent, error)
+// Store is implemented by each storage backend. Every operation is abandoned
+// when its context is cancelled.
+type Store interface {
+	PeerStore
+	TorrentStore
+	InfohashStore
+	MetadataStore
+	SearchStore
+	ClientStore
+	MaintenanceStore
+	Close() error
 }
 
+// PeerStore records peers announcing infohashes
 type PeerStore interface {
-	SavePeer(*Peer) error
-	RemovePeer(*Peer) error
+	// SavePeer queues the infohash for a metadata fetch from the peer
+	SavePeer(context.Context, *Peer) error
+	// SaveAnnounce only counts an announce of an indexed infohash
+	SaveAnnounce(context.Context, *Peer) error
+	RemovePeer(context.Context, *Peer) error
+	SavePeerClient(context.Context, *Peer) error
 }
 
+// TorrentStore records the results of metadata fetches
 type TorrentStore interface {
-	SaveTorrent(*Torrent) error
-	RemoveTorrent(*Torrent) error
-	RemovePeer(*Peer) error
+	SaveTorrent(context.Context, *Torrent) error
+	RemoveTorrent(context.Context, *Torrent) error
+	FetchFailed(context.Context, *Peer, error, Backoff) error
+	SaveTag(context.Context, string) (int, error)
+}
+
+// MetadataStore looks up indexed torrents
+type MetadataStore interface {
+	TorrentByHash(context.Context, Infohash) (*Torrent, error)
+	TorrentMetadata(context.Context, Infohash) ([]byte, error)
+}
+
+// SearchStore finds indexed torrents a page at a time
+type SearchStore interface {
+	TorrentsByName(ctx context.Context, query string, page Page) (*Results, error)
+	TorrentsByTag(ctx context.Context, tag string, page Page) (*Results, error)
+	// TorrentFacets counts every torrent matching a query
+	TorrentFacets(ctx context.Context, query string) (*Facets, error)
+	// SimilarTorrents returns the torrents most like an indexed one, at
+	// least MinSimilarity and the most similar first
+	SimilarTorrents(ctx context.Context, ih Infohash, limit int) ([]SimilarTorrent, error)
 }
 
+type ClientStore interface {
+	ClientCounts(ctx context.Context, limit int) ([]ClientCount, error)
+}
+
+// InfohashStore provides infohashes to fetch and those already indexed
 type InfohashStore interface {
-	PendingInfohashes(int) ([]*Peer, error)
+	PendingInfohashes(context.Context, int) ([]*Peer, error)
+	PeersByInfohash(context.Context, Infohash, int) ([]*Peer, error)
+	IndexedInfohashes(context.Context, func(Infohash) error) error
+}
+
+type MaintenanceStore interface {
+	RemoveStalePeers(ctx context.Context, before time.Time) (int64, error)
+	RemoveOrphans(ctx context.Context, before time.Time) (int64, error)
+	RemoveAnnounceBuckets(ctx context.Context, period string, before time.Time) (int64, error)
+	// RemoveAnnounceIPs forgets the IPs that have not announced a torrent
+	// since before, so SeenIPs counts the distinct IPs announcing since
+	// then
+	RemoveAnnounceIPs(ctx context.Context, before time.Time) (int64, error)
+	// ClusterTorrents assigns clusters to up to limit torrents saved before
+	// clustering, returning how many it assigned
+	ClusterTorrents(ctx context.Context, limit int) (int64, error)
+	Optimize(context.Context) error
 }
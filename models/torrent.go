@@ -1,12 +1,12 @@
 package models
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"src.userspace.com.au/dhtsearch/krpc"
 	"src.userspace.com.au/go-bencode"
@@ -14,14 +14,95 @@ import (
 
 // Data for persistent storage
 type Torrent struct {
-	ID       int       `json:"-"`
-	Infohash Infohash  `json:"infohash"`
-	Name     string    `json:"name"`
-	Files    []File    `json:"files" db:"-"`
-	Size     int       `json:"size"`
-	Updated  time.Time `json:"updated"`
-	Created  time.Time `json:"created"`
-	Tags     []string  `json:"tags" db:"-"`
+	ID        int       `json:"-"`
+	Infohash  Infohash  `json:"infohash"`
+	Name      string    `json:"name"`
+	Files     []File    `json:"files" db:"-"`
+	Size      int       `json:"size"`
+	Updated   time.Time `json:"updated"`
+	Created   time.Time `json:"created"`
+	Tags      []string  `json:"tags" db:"-"`
+	Announces int       `json:"announces"`
+	SeenIPs   int       `json:"seen_ips" db:"seen_ips"`
+	FirstSeen time.Time `json:"first_seen" db:"first_seen"`
+	LastSeen  time.Time `json:"last_seen" db:"last_seen"`
+	// Metadata is the raw bencoded info dictionary
+	Metadata []byte `json:"-" db:"-"`
+
+	PieceLength int    `json:"piece_length" db:"piece_length"`
+	Pieces      int    `json:"pieces"`
+	Private     bool   `json:"private"`
+	Source      string `json:"source,omitempty"`
+	// MetaVersion is 2 for BEP 52 torrents
+	MetaVersion int `json:"meta_version" db:"meta_version"`
+	// Hybrid torrents have both v1 and v2 metadata
+	Hybrid bool `json:"hybrid"`
+	// InfohashV2 is the full SHA256 infohash of v2 and hybrid torrents
+	InfohashV2 Infohash `json:"infohash_v2,omitempty" db:"infohash_v2"`
+	// Repaired is set when names were not valid UTF-8 and were transcoded
+	Repaired bool `json:"repaired"`
+	// Highlights are the files matching the words of a search
+	Highlights []Highlight `json:"highlights,omitempty" db:"-"`
+	// ClusterID groups torrents with the same Fingerprint
+	ClusterID int `json:"cluster_id,omitempty" db:"cluster_id"`
+	// Variants counts the matches in the cluster of a collapsed search
+	Variants int `json:"variants,omitempty" db:"-"`
+}
+
+// Highlight marks the words matched in a file path
+type Highlight struct {
+	Path string `json:"path"`
+	// Matches are the start and end byte offsets of each matched word
+	Matches [][2]int `json:"matches"`
+}
+
+// Ordering of torrent search results
+type Ordering int
+
+const (
+	// OrderDefault orders by last update
+	OrderDefault Ordering = iota
+	// OrderPopular orders by distinct announcing IPs and announce count
+	OrderPopular
+	// OrderTrending orders by announces within the last day
+	OrderTrending
+	// OrderRecent orders by the last announce
+	OrderRecent
+	// OrderRelevance ranks name matches above file matches, and is
+	// OrderDefault without search words
+	OrderRelevance
+	// OrderSize orders by total size, the largest first
+	OrderSize
+	// OrderCreated orders by when the torrent was indexed
+	OrderCreated
+)
+
+var orderingNames = map[Ordering]string{
+	OrderDefault:   "default",
+	OrderPopular:   "popular",
+	OrderTrending:  "trending",
+	OrderRecent:    "recent",
+	OrderRelevance: "relevance",
+	OrderSize:      "size",
+	OrderCreated:   "created",
+}
+
+// String implements fmt.Stringer
+func (o Ordering) String() string {
+	return orderingNames[o]
+}
+
+// ParseOrdering converts a name to an Ordering
+func ParseOrdering(s string) (Ordering, error) {
+	if s == "" {
+		return OrderDefault, nil
+	}
+	for o, name := range orderingNames {
+		if name == s {
+			return o, nil
+		}
+	}
+	return OrderDefault, fmt.Errorf("invalid ordering %q", s)
 }
 
 type File struct {
@@ -29,11 +110,21 @@ type File struct {
 	Path      string `json:"path"`
 	Size      int    `json:"size"`
 	TorrentID int    `json:"torrent_id" db:"torrent_id"`
+	// Attributes from BEP 47, eg. 'x' for executable
+	Attributes string `json:"attributes,omitempty"`
 }
 
+// InfohashMatchesMetadata checks the infohash is the SHA1 of the metadata, or
+// for v2 torrents the full or truncated SHA256
 func InfohashMatchesMetadata(ih Infohash, md []byte) bool {
-	info := sha1.Sum(md)
-	return bytes.Equal([]byte(ih), info[:])
+	v1, v2 := MetadataInfohashes(md)
+	switch len(ih) {
+	case InfohashLength:
+		return ih.Equal(v1) || ih.Equal(v2.Truncated())
+	case InfohashV2Length:
+		return ih.Equal(v2)
+	}
+	return false
 }
 
 func TorrentFromMetadata(ih Infohash, md []byte) (*Torrent, error) {
@@ -45,49 +136,211 @@ func TorrentFromMetadata(ih Infohash, md []byte) (*Torrent, error) {
 		return nil, err
 	}
 
+	names := newNameDecoder(info)
+
 	// Get the directory or advisory filename
-	name, err := krpc.GetString(info, "name")
+	name, err := getUTF8String(info, "name")
 	if err != nil {
 		return nil, err
 	}
+	if name, err = names.component(name); err != nil {
+		return nil, err
+	}
 
 	bt := Torrent{
-		Infohash: ih,
-		Name:     name,
+		Infohash:    ih,
+		Name:        name,
+		Metadata:    md,
+		MetaVersion: 1,
+	}
+	bt.PieceLength, _ = krpc.GetInt(info, "piece length")
+	if pieces, err := krpc.GetString(info, "pieces"); err == nil {
+		bt.Pieces = len(pieces) / sha1.Size
+	}
+	if private, err := krpc.GetInt(info, "private"); err == nil {
+		bt.Private = private == 1
+	}
+	bt.Source, _ = krpc.GetString(info, "source")
+	if v, err := krpc.GetInt(info, "meta version"); err == nil {
+		bt.MetaVersion = v
+	}
+
+	v1Files, filesErr := krpc.GetList(info, "files")
+	v1Length, lengthErr := krpc.GetInt(info, "length")
+	hasV1 := filesErr == nil || lengthErr == nil
+
+	if tree, err := krpc.GetMap(info, "file tree"); err == nil && bt.MetaVersion >= 2 {
+		// Prefer the v2 tree, it has no padding files
+		bt.Hybrid = hasV1
+		v1, v2 := MetadataInfohashes(md)
+		bt.InfohashV2 = v2
+		if bt.Hybrid {
+			// Hybrids are known by their v1 infohash whichever they
+			// were fetched with
+			bt.Infohash = v1
+		} else {
+			bt.Infohash = v2.Truncated()
+		}
+		files, err := filesFromTree(tree, nil, names)
+		if err != nil {
+			return nil, err
+		}
+		v2Pieces := 0
+		for _, f := range files {
+			bt.Size += f.Size
+			if bt.PieceLength > 0 {
+				v2Pieces += (f.Size + bt.PieceLength - 1) / bt.PieceLength
+			}
+		}
+		if !bt.Hybrid {
+			bt.Pieces = v2Pieces
+		}
+		// Single file torrents are a tree of one file named after the torrent
+		if len(files) != 1 || files[0].Path != name {
+			bt.Files = files
+		}
+		bt.Repaired = names.repaired
+		return &bt, nil
 	}
 
-	if files, err := krpc.GetList(info, "files"); err == nil {
+	if filesErr == nil {
 		// Multiple file mode
-		bt.Files = make([]File, len(files))
+		bt.Files = make([]File, 0, len(v1Files))
 
 		// Files is a list of dicts
-		for i, item := range files {
-			file := item.(map[string]interface{})
+		for _, item := range v1Files {
+			file, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid file")
+			}
 
 			// Paths is a list of strings
-			paths := file["path"].([]interface{})
-			path := make([]string, len(paths))
-			for j, p := range paths {
-				path[j] = p.(string)
+			raw, err := getUTF8Path(file)
+			if err != nil {
+				return nil, err
+			}
+			path := make([]string, 0, len(raw))
+			for _, c := range raw {
+				parts, err := names.components(c)
+				if err != nil {
+					return nil, err
+				}
+				path = append(path, parts...)
 			}
 
 			fSize, err := krpc.GetInt(file, "length")
 			if err != nil {
 				return nil, err
 			}
-			bt.Files[i] = File{
-				// Assume Unix path sep?
-				Path: strings.Join(path[:], string(os.PathSeparator)),
-				Size: fSize,
+			attr, _ := krpc.GetString(file, "attr")
+			if isPadding(attr, path) {
+				continue
 			}
+			bt.Files = append(bt.Files, File{
+				Path:       strings.Join(path, "/"),
+				Size:       fSize,
+				Attributes: attr,
+			})
 			// Ensure the torrent size totals all files'
 			bt.Size = bt.Size + fSize
 		}
-	} else if length, err := krpc.GetInt(info, "length"); err == nil {
+	} else if lengthErr == nil {
 		// Single file mode
-		bt.Size = length
+		bt.Size = v1Length
 	} else {
 		return nil, fmt.Errorf("found neither length or files")
 	}
+	bt.Repaired = names.repaired
 	return &bt, nil
 }
+
+// filesFromTree flattens a BEP 52 file tree, where each file is a path of
+// dicts ending in an empty key holding the length
+func filesFromTree(tree map[string]interface{}, prefix []string, names *nameDecoder) ([]File, error) {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var files []File
+	for _, k := range keys {
+		node, ok := tree[k].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid file tree")
+		}
+		if k == "" {
+			if len(prefix) == 0 {
+				return nil, fmt.Errorf("invalid file tree")
+			}
+			size, err := krpc.GetInt(node, "length")
+			if err != nil {
+				return nil, err
+			}
+			attr, _ := krpc.GetString(node, "attr")
+			files = append(files, File{
+				Path:       strings.Join(prefix, "/"),
+				Size:       size,
+				Attributes: attr,
+			})
+			continue
+		}
+		components, err := names.components(k)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := filesFromTree(node, append(prefix[:len(prefix):len(prefix)], components...), names)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// getUTF8String prefers the '.utf-8' variant of a key if it is valid
+func getUTF8String(data map[string]interface{}, key string) (string, error) {
+	if s, err := krpc.GetString(data, key+".utf-8"); err == nil && utf8.ValidString(s) {
+		return s, nil
+	}
+	return krpc.GetString(data, key)
+}
+
+// getUTF8Path prefers the 'path.utf-8' list of a file if it is valid
+func getUTF8Path(file map[string]interface{}) ([]string, error) {
+	var invalid []string
+	for _, key := range []string{"path.utf-8", "path"} {
+		list, err := krpc.GetList(file, key)
+		if err != nil {
+			continue
+		}
+		path := make([]string, len(list))
+		valid := true
+		for i, p := range list {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid file path")
+			}
+			path[i] = s
+			valid = valid && utf8.ValidString(s)
+		}
+		if valid {
+			return path, nil
+		}
+		if invalid == nil {
+			invalid = path
+		}
+	}
+	if invalid == nil {
+		return nil, fmt.Errorf("missing file path")
+	}
+	return invalid, nil
+}
+
+// isPadding detects BEP 47 and older BitComet style padding files
+func isPadding(attr string, path []string) bool {
+	if strings.Contains(attr, "p") {
+		return true
+	}
+	return len(path) > 0 && strings.HasPrefix(path[len(path)-1], "_____padding_file_")
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"src.userspace.com.au/dhtsearch/krpc"
+	"src.userspace.com.au/go-bencode"
+)
+
+func TestTorrentFile(t *testing.T) {
+	md, err := bencode.EncodeDict(map[string]interface{}{
+		"name":         "test.txt",
+		"length":       5,
+		"piece length": 16384,
+		"pieces":       "01234567890123456789",
+	})
+	if err != nil {
+		t.Fatalf("failed to encode metadata: %s", err)
+	}
+	sum := sha1.Sum(md)
+	tor, err := TorrentFromMetadata(Infohash(sum[:]), md)
+	if err != nil {
+		t.Fatalf("TorrentFromMetadata failed: %s", err)
+	}
+
+	b, err := tor.TorrentFile([]string{"udp://one", "udp://two"})
+	if err != nil {
+		t.Fatalf("TorrentFile failed: %s", err)
+	}
+	if !bytes.HasSuffix(b, append(append([]byte("4:info"), md...), 'e')) {
+		t.Errorf("info dict not kept verbatim")
+	}
+	dict, _, err := bencode.DecodeDict(b, 0)
+	if err != nil {
+		t.Fatalf("failed to decode torrent file: %s", err)
+	}
+	if a, _ := krpc.GetString(dict, "announce"); a != "udp://one" {
+		t.Errorf("announce => %q", a)
+	}
+	if l, _ := krpc.GetList(dict, "announce-list"); len(l) != 2 {
+		t.Errorf("announce-list => %v", l)
+	}
+
+	b, err = tor.TorrentFile(nil)
+	if err != nil {
+		t.Fatalf("TorrentFile failed: %s", err)
+	}
+	if bytes.Contains(b, []byte("announce")) {
+		t.Errorf("announce without trackers")
+	}
+
+	tor.Metadata = md[1:]
+	if _, err = tor.TorrentFile(nil); err == nil {
+		t.Errorf("TorrentFile should fail for mismatched metadata")
+	}
+}
+
+func TestTorrentFileName(t *testing.T) {
+	tor := Torrent{Name: `a/b\c: "d"`}
+	if n := tor.TorrentFileName(); n != "a_b_c_ _d_.torrent" {
+		t.Errorf("TorrentFileName => %q", n)
+	}
+}
+
+func TestTorrentFromMetadata(t *testing.T) {
+	v1Files := []interface{}{
+		map[string]interface{}{
+			"length":     3,
+			"path":       []interface{}{"dir", "a.txt"},
+			"path.utf-8": []interface{}{"dir", "ä.txt"},
+		},
+		map[string]interface{}{
+			"length": 5,
+			"path":   []interface{}{".pad", "5"},
+			"attr":   "p",
+		},
+		map[string]interface{}{
+			"length": 7,
+			"path":   []interface{}{"run.sh"},
+			"attr":   "x",
+		},
+	}
+	tree := map[string]interface{}{
+		"dir": map[string]interface{}{
+			"ä.txt": map[string]interface{}{
+				"": map[string]interface{}{"length": 3, "pieces root": "r"},
+			},
+		},
+		"run.sh": map[string]interface{}{
+			"": map[string]interface{}{"length": 7, "attr": "x"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		info        map[string]interface{}
+		size        int
+		files       []File
+		pieces      int
+		metaVersion int
+		hybrid      bool
+	}{
+		{
+			name: "v1",
+			info: map[string]interface{}{
+				"name": "test", "name.utf-8": "tëst", "piece length": 4,
+				"pieces": "0123456789012345678901234567890123456789",
+				"files":  v1Files, "private": 1, "source": "tracker",
+			},
+			size: 10,
+			files: []File{
+				{Path: "dir/ä.txt", Size: 3},
+				{Path: "run.sh", Size: 7, Attributes: "x"},
+			},
+			pieces:      2,
+			metaVersion: 1,
+		},
+		{
+			name: "v2",
+			info: map[string]interface{}{
+				"name": "tëst", "piece length": 4, "meta version": 2,
+				"file tree": tree,
+			},
+			size: 10,
+			files: []File{
+				{Path: "dir/ä.txt", Size: 3},
+				{Path: "run.sh", Size: 7, Attributes: "x"},
+			},
+			pieces:      3,
+			metaVersion: 2,
+		},
+		{
+			name: "hybrid",
+			info: map[string]interface{}{
+				"name": "tëst", "piece length": 4, "meta version": 2,
+				"pieces": "0123456789012345678901234567890123456789",
+				"files":  v1Files, "file tree": tree,
+			},
+			size: 10,
+			files: []File{
+				{Path: "dir/ä.txt", Size: 3},
+				{Path: "run.sh", Size: 7, Attributes: "x"},
+			},
+			pieces:      2,
+			metaVersion: 2,
+			hybrid:      true,
+		},
+		{
+			name: "v2 single file",
+			info: map[string]interface{}{
+				"name": "tëst", "piece length": 4, "meta version": 2,
+				"file tree": map[string]interface{}{
+					"tëst": map[string]interface{}{
+						"": map[string]interface{}{"length": 9},
+					},
+				},
+			},
+			size:        9,
+			pieces:      3,
+			metaVersion: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := bencode.EncodeDict(tt.info)
+			if err != nil {
+				t.Fatalf("failed to encode metadata: %s", err)
+			}
+			ih := sha1.Sum(md)
+			if tt.metaVersion == 2 && !tt.hybrid {
+				v2 := sha256.Sum256(md)
+				copy(ih[:], v2[:])
+			}
+			tor, err := TorrentFromMetadata(Infohash(ih[:]), md)
+			if err != nil {
+				t.Fatalf("TorrentFromMetadata failed: %s", err)
+			}
+			if tor.Name != "tëst" {
+				t.Errorf("name => %q", tor.Name)
+			}
+			if tor.Size != tt.size || tor.Pieces != tt.pieces || tor.PieceLength != 4 {
+				t.Errorf("size, pieces, piece length => %d, %d, %d", tor.Size, tor.Pieces, tor.PieceLength)
+			}
+			if tor.MetaVersion != tt.metaVersion || tor.Hybrid != tt.hybrid {
+				t.Errorf("meta version, hybrid => %d, %t", tor.MetaVersion, tor.Hybrid)
+			}
+			if len(tor.Files) != len(tt.files) {
+				t.Fatalf("files => %+v, expected %+v", tor.Files, tt.files)
+			}
+			for i, f := range tt.files {
+				if tor.Files[i] != f {
+					t.Errorf("file %d => %+v, expected %+v", i, tor.Files[i], f)
+				}
+			}
+		})
+	}
+
+	md, _ := bencode.EncodeDict(map[string]interface{}{
+		"name": "x", "length": 1, "private": 1, "source": "src",
+	})
+	ih := sha1.Sum(md)
+	tor, err := TorrentFromMetadata(Infohash(ih[:]), md)
+	if err != nil {
+		t.Fatalf("TorrentFromMetadata failed: %s", err)
+	}
+	if !tor.Private || tor.Source != "src" {
+		t.Errorf("private, source => %t, %q", tor.Private, tor.Source)
+	}
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+
+	"src.userspace.com.au/go-bencode"
+)
+
+// TorrentFile builds a .torrent file from the stored info dictionary,
+// announcing to the trackers if given
+func (t *Torrent) TorrentFile(trackers []string) ([]byte, error) {
+	if len(t.Metadata) == 0 {
+		return nil, errors.New("no metadata")
+	}
+	if !InfohashMatchesMetadata(t.Infohash, t.Metadata) {
+		return nil, errors.New("infohash does not match metadata")
+	}
+
+	// Keys must be sorted and the info dict kept verbatim to preserve the
+	// infohash
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	if len(trackers) > 0 {
+		tiers := make([]interface{}, len(trackers))
+		for i, tr := range trackers {
+			tiers[i] = []interface{}{tr}
+		}
+		for _, kv := range []struct {
+			k string
+			v interface{}
+		}{
+			{"announce", trackers[0]},
+			{"announce-list", tiers},
+		} {
+			k, _ := bencode.Encode(kv.k)
+			v, err := bencode.Encode(kv.v)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(k)
+			buf.Write(v)
+		}
+	}
+	buf.WriteString("10:created by9:dhtsearch")
+	buf.WriteString("4:info")
+	buf.Write(t.Metadata)
+	buf.WriteByte('e')
+	return buf.Bytes(), nil
+}
+
+// TorrentFileName is a safe name to save the torrent file as
+func (t *Torrent) TorrentFileName() string {
+	name := []rune(t.Name)
+	for i, r := range name {
+		if r < ' ' || bytes.ContainsRune([]byte(`/\:*?"<>|`), r) {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return t.Infohash.String() + ".torrent"
+	}
+	return string(name) + ".torrent"
+}
@@ -0,0 +1,454 @@
+package utp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// outPacket is a sent packet awaiting acknowledgement
+type outPacket struct {
+	p       *packet
+	sent    time.Time
+	retries int
+}
+
+// Conn is a uTP connection implementing net.Conn
+type Conn struct {
+	sock    net.PacketConn
+	raddr   net.Addr
+	recvID  uint16
+	sendID  uint16
+	onClose func()
+
+	incoming chan *packet
+	done     chan struct{}
+
+	mu       sync.Mutex
+	changed  chan struct{}
+	state    connState
+	err      error
+	closed   bool
+	seq      uint16
+	ack      uint16
+	inflight []*outPacket
+	peerWnd  uint32
+	// Timestamp difference to return to the peer
+	replyMicro uint32
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	recvBuf    []byte
+	reorder    map[uint16]*packet
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(sock net.PacketConn, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		sock:     sock,
+		raddr:    raddr,
+		recvID:   recvID,
+		sendID:   sendID,
+		incoming: make(chan *packet, maxInflight),
+		done:     make(chan struct{}),
+		changed:  make(chan struct{}),
+		peerWnd:  recvWindow,
+		rto:      initialRTO,
+		reorder:  make(map[uint16]*packet),
+	}
+	go c.loop()
+	return c
+}
+
+// connect sends a SYN and waits for the reply
+func (c *Conn) connect(deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq = 1
+	c.sendPacket(stSyn, nil)
+	for c.state == stateSynSent {
+		if err := c.wait(deadline); err != nil {
+			c.closed = true
+			c.fail(err)
+			return err
+		}
+	}
+	return c.err
+}
+
+// accept completes the handshake for an incoming SYN
+func (c *Conn) accept(syn *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq = randomUint16()
+	c.ack = syn.seq
+	c.state = stateConnected
+	c.sendState()
+	c.notify()
+}
+
+// deliver queues an incoming packet for the connection
+func (c *Conn) deliver(p *packet) {
+	select {
+	case c.incoming <- p:
+	case <-c.done:
+	}
+}
+
+func (c *Conn) loop() {
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case p := <-c.incoming:
+			c.handle(p)
+		case <-t.C:
+			c.tick()
+		}
+
+		c.mu.Lock()
+		finished := c.state == stateClosed ||
+			(c.closed && c.state == stateConnected && len(c.inflight) == 0)
+		if finished {
+			c.state = stateClosed
+			c.notify()
+		}
+		c.mu.Unlock()
+
+		if finished {
+			close(c.done)
+			if c.onClose != nil {
+				c.onClose()
+			}
+			return
+		}
+	}
+}
+
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.notify()
+
+	now := time.Now()
+	c.peerWnd = p.wnd
+	c.replyMicro = micros(now) - p.ts
+
+	switch p.typ {
+	case stReset:
+		c.fail(ErrReset)
+		return
+	case stSyn:
+		// Our reply was lost
+		if c.state == stateConnected {
+			c.sendState()
+		}
+		return
+	}
+
+	if c.state == stateSynSent {
+		c.state = stateConnected
+		c.ack = p.seq - 1
+	}
+	c.processAck(p.ack, now)
+
+	if p.typ == stState {
+		return
+	}
+	if !seqLess(c.ack, p.seq) || p.seq-c.ack > maxReorder {
+		// Duplicate or too far ahead
+		c.sendState()
+		return
+	}
+	c.reorder[p.seq] = p
+	for {
+		next, ok := c.reorder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.ack++
+		if next.typ == stFin {
+			c.eof = true
+			break
+		}
+		c.recvBuf = append(c.recvBuf, next.payload...)
+	}
+	c.sendState()
+}
+
+// processAck removes acknowledged packets, updating the round trip time
+func (c *Conn) processAck(ack uint16, now time.Time) {
+	n := 0
+	for _, op := range c.inflight {
+		if seqLess(ack, op.p.seq) {
+			break
+		}
+		if op.retries == 0 {
+			c.updateRTT(now.Sub(op.sent))
+		}
+		n++
+	}
+	c.inflight = c.inflight[n:]
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// tick retransmits timed out packets
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, op := range c.inflight {
+		timeout := c.rto << uint(op.retries)
+		if timeout > maxRTO {
+			timeout = maxRTO
+		}
+		if now.Sub(op.sent) < timeout {
+			continue
+		}
+		if op.retries >= maxRetries {
+			c.fail(ErrTimeout)
+			c.notify()
+			return
+		}
+		op.retries++
+		op.sent = now
+		c.send(op.p)
+	}
+}
+
+// sendPacket sends a packet that consumes a sequence number
+func (c *Conn) sendPacket(typ uint8, payload []byte) {
+	p := &packet{
+		header:  header{typ: typ, seq: c.seq},
+		payload: append([]byte(nil), payload...),
+	}
+	c.seq++
+	c.inflight = append(c.inflight, &outPacket{p: p, sent: time.Now()})
+	c.send(p)
+}
+
+func (c *Conn) sendState() {
+	c.send(&packet{header: header{typ: stState, seq: c.seq}})
+}
+
+func (c *Conn) send(p *packet) {
+	p.connID = c.sendID
+	if p.typ == stSyn {
+		p.connID = c.recvID
+	}
+	p.ts = micros(time.Now())
+	p.tsDiff = c.replyMicro
+	p.ack = c.ack
+	p.wnd = 0
+	if len(c.recvBuf) < recvWindow {
+		p.wnd = uint32(recvWindow - len(c.recvBuf))
+	}
+	c.sock.WriteTo(p.marshal(), c.raddr)
+}
+
+// fail records the first terminal error
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+}
+
+// notify wakes any waiting readers and writers
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases the lock until the state changes or the deadline passes
+func (c *Conn) wait(deadline time.Time) error {
+	ch := c.changed
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	}
+}
+
+// canSend checks the send window has room for another packet
+func (c *Conn) canSend() bool {
+	if len(c.inflight) >= maxInflight {
+		return false
+	}
+	wnd := int(c.peerWnd)
+	if wnd < maxPayload {
+		wnd = maxPayload
+	}
+	size := 0
+	for _, op := range c.inflight {
+		size += len(op.p.payload)
+	}
+	return size+maxPayload <= wnd
+}
+
+// Read implements net.Conn
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if len(c.recvBuf) > 0 {
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			if len(c.recvBuf) == 0 {
+				c.recvBuf = nil
+			}
+			return n, nil
+		}
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, ErrClosed
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write implements net.Conn
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		for {
+			switch {
+			case c.err != nil:
+				return written, c.err
+			case c.closed:
+				return written, ErrClosed
+			}
+			if c.state == stateConnected && c.canSend() {
+				break
+			}
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+		}
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		c.sendPacket(stData, b[:n])
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close sends a FIN, the connection lingers until it is acknowledged
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.state == stateConnected {
+		c.sendPacket(stFin, nil)
+	} else {
+		c.state = stateClosed
+	}
+	c.notify()
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
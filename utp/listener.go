@@ -0,0 +1,127 @@
+package utp
+
+import (
+	"net"
+	"sync"
+)
+
+// Backlog of connections waiting to be accepted
+const acceptBacklog = 32
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Listener accepts uTP connections on a UDP socket
+type Listener struct {
+	sock   net.PacketConn
+	accept chan *Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+}
+
+// Listen announces on the local UDP address
+func Listen(address string) (*Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		sock:   sock,
+		accept: make(chan *Conn, acceptBacklog),
+		done:   make(chan struct{}),
+		conns:  make(map[connKey]*Conn),
+	}
+	go l.read()
+	return l, nil
+}
+
+func (l *Listener) read() {
+	b := make([]byte, 65536)
+	for {
+		n, from, err := l.sock.ReadFrom(b)
+		if err != nil {
+			l.Close()
+			return
+		}
+		p, err := parsePacket(b[:n])
+		if err != nil {
+			continue
+		}
+
+		key := connKey{from.String(), p.connID}
+		if p.typ == stSyn {
+			// Replies use the next connection ID
+			key.id++
+		}
+		l.mu.Lock()
+		c, ok := l.conns[key]
+		if !ok && p.typ == stSyn {
+			c = l.newConn(key, from, p)
+		}
+		l.mu.Unlock()
+
+		switch {
+		case ok:
+			c.deliver(p)
+		case c == nil && p.typ != stReset:
+			// Unknown connection
+			reset := &packet{header: header{typ: stReset, connID: p.connID, ack: p.seq}}
+			l.sock.WriteTo(reset.marshal(), from)
+		}
+	}
+}
+
+// newConn creates a connection for a SYN, must be called with the lock held
+func (l *Listener) newConn(key connKey, from net.Addr, syn *packet) *Conn {
+	c := newConn(l.sock, from, key.id, syn.connID)
+	c.onClose = func() {
+		l.mu.Lock()
+		delete(l.conns, key)
+		l.mu.Unlock()
+	}
+
+	select {
+	case l.accept <- c:
+	default:
+		// Backlog full, refuse the connection
+		c.Close()
+		return nil
+	}
+	l.conns[key] = c
+	c.accept(syn)
+	return c
+}
+
+// Accept waits for and returns the next connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops listening, existing connections will fail
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.sock.Close()
+	})
+	return err
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
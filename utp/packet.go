@@ -0,0 +1,91 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types
+const (
+	stData uint8 = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+const (
+	version    = 1
+	headerSize = 20
+)
+
+var errInvalidPacket = errors.New("utp: invalid packet")
+
+type header struct {
+	typ    uint8
+	connID uint16
+	ts     uint32
+	tsDiff uint32
+	wnd    uint32
+	seq    uint16
+	ack    uint16
+}
+
+type packet struct {
+	header
+	payload []byte
+}
+
+// marshal encodes the packet without extensions
+func (p *packet) marshal() []byte {
+	b := make([]byte, headerSize+len(p.payload))
+	b[0] = p.typ<<4 | version
+	binary.BigEndian.PutUint16(b[2:], p.connID)
+	binary.BigEndian.PutUint32(b[4:], p.ts)
+	binary.BigEndian.PutUint32(b[8:], p.tsDiff)
+	binary.BigEndian.PutUint32(b[12:], p.wnd)
+	binary.BigEndian.PutUint16(b[16:], p.seq)
+	binary.BigEndian.PutUint16(b[18:], p.ack)
+	copy(b[headerSize:], p.payload)
+	return b
+}
+
+// parsePacket decodes a packet, skipping any extensions
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return nil, errInvalidPacket
+	}
+	p := &packet{header: header{
+		typ:    b[0] >> 4,
+		connID: binary.BigEndian.Uint16(b[2:]),
+		ts:     binary.BigEndian.Uint32(b[4:]),
+		tsDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:    binary.BigEndian.Uint32(b[12:]),
+		seq:    binary.BigEndian.Uint16(b[16:]),
+		ack:    binary.BigEndian.Uint16(b[18:]),
+	}}
+
+	off := headerSize
+	for ext := b[1]; ext != 0; {
+		if len(b) < off+2 {
+			return nil, errInvalidPacket
+		}
+		ext = b[off]
+		off += 2 + int(b[off+1])
+		if off > len(b) {
+			return nil, errInvalidPacket
+		}
+	}
+	p.payload = append([]byte(nil), b[off:]...)
+	return p, nil
+}
+
+// seqLess compares sequence numbers allowing for wrapping
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func micros(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Microsecond))
+}
@@ -0,0 +1,90 @@
+// Package utp implements the Micro Transport Protocol (BEP 29).
+//
+// Connections provide reliable, ordered delivery over UDP with a fixed
+// congestion window. This is enough for fetching metadata from peers that are
+// only reachable over uTP, it is not tuned for bulk transfers.
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// Largest payload, keeping packets under common MTUs
+	maxPayload = 1200
+	// Most unacknowledged packets in flight
+	maxInflight = 64
+	// Most packets buffered ahead of the next expected
+	maxReorder = 1024
+	// Receive window advertised to peers
+	recvWindow = 1 << 20
+	// Retransmission timeouts
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 8 * time.Second
+	// Retransmissions before giving up
+	maxRetries = 6
+	// Interval between retransmission checks
+	tickInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrClosed is returned when using a closed connection or listener
+	ErrClosed = errors.New("utp: use of closed connection")
+	// ErrReset is returned when the peer resets the connection
+	ErrReset = errors.New("utp: connection reset by peer")
+	// ErrTimeout is returned when a deadline passes or the peer stops
+	// responding
+	ErrTimeout error = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "utp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// DialTimeout connects to the uTP peer at address
+func DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "utp", Err: err}
+	}
+	sock, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+	}
+
+	recvID := randomUint16()
+	c := newConn(sock, raddr, recvID, recvID+1)
+	c.onClose = func() { sock.Close() }
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, _, err := sock.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			p, err := parsePacket(b[:n])
+			if err != nil || p.connID != recvID {
+				continue
+			}
+			c.deliver(p)
+		}
+	}()
+
+	if err = c.connect(time.Now().Add(timeout)); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+	}
+	return c, nil
+}
+
+func randomUint16() uint16 {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,251 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := &packet{
+		header: header{
+			typ: stData, connID: 1234, ts: 1, tsDiff: 2, wnd: 3, seq: 65535, ack: 7,
+		},
+		payload: []byte("payload"),
+	}
+	got, err := parsePacket(p.marshal())
+	if err != nil {
+		t.Fatalf("parsePacket failed: %s", err)
+	}
+	if got.header != p.header || !bytes.Equal(got.payload, p.payload) {
+		t.Errorf("parsePacket => %+v, expected %+v", got, p)
+	}
+
+	// Selective ack extension followed by payload
+	b := p.marshal()
+	b[1] = 1
+	b = append(b[:headerSize], append([]byte{0, 4, 1, 2, 3, 4}, p.payload...)...)
+	if got, err = parsePacket(b); err != nil || !bytes.Equal(got.payload, p.payload) {
+		t.Errorf("parsePacket with extension => %v, %v", got, err)
+	}
+
+	for _, b := range [][]byte{
+		{0x41},
+		append([]byte{0x42}, make([]byte, 19)...),
+		append([]byte{0x01, 1}, make([]byte, 19)...),
+	} {
+		if _, err := parsePacket(b); err == nil {
+			t.Errorf("parsePacket(%x) should fail", b)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		out  bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{65535, 0, true},
+		{0, 65535, false},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.out {
+			t.Errorf("seqLess(%d, %d) => %t, expected %t", tt.a, tt.b, got, tt.out)
+		}
+	}
+}
+
+// lossyProxy relays packets between one client and a server, dropping some
+type lossyProxy struct {
+	client   net.PacketConn
+	upstream net.PacketConn
+	server   net.Addr
+	drop     float64
+
+	mu   sync.Mutex
+	peer net.Addr
+	rnd  *rand.Rand
+}
+
+func newLossyProxy(t *testing.T, server net.Addr, drop float64) *lossyProxy {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	lp := &lossyProxy{
+		client:   client,
+		upstream: upstream,
+		server:   server,
+		drop:     drop,
+		rnd:      rand.New(rand.NewSource(1)),
+	}
+	go lp.relay(client, func(from net.Addr) net.Addr {
+		lp.mu.Lock()
+		defer lp.mu.Unlock()
+		lp.peer = from
+		return server
+	}, upstream)
+	go lp.relay(upstream, func(net.Addr) net.Addr {
+		lp.mu.Lock()
+		defer lp.mu.Unlock()
+		return lp.peer
+	}, client)
+	return lp
+}
+
+func (lp *lossyProxy) relay(in net.PacketConn, to func(net.Addr) net.Addr, out net.PacketConn) {
+	b := make([]byte, 65536)
+	for {
+		n, from, err := in.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		lp.mu.Lock()
+		drop := lp.rnd.Float64() < lp.drop
+		lp.mu.Unlock()
+		if !drop {
+			out.WriteTo(b[:n], to(from))
+		}
+	}
+}
+
+func (lp *lossyProxy) Close() {
+	lp.client.Close()
+	lp.upstream.Close()
+}
+
+func echoServer(t *testing.T) *Listener {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func testEcho(t *testing.T, addr string, size int) {
+	c, err := DialTimeout(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout failed: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		errs <- err
+	}()
+
+	got := make([]byte, size)
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed data does not match")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+	testEcho(t, l.Addr().String(), 200*1024)
+}
+
+func TestEchoWithLoss(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+	lp := newLossyProxy(t, l.Addr(), 0.1)
+	defer lp.Close()
+	testEcho(t, lp.client.LocalAddr().String(), 50*1024)
+}
+
+func TestCloseSendsEOF(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("bye"))
+		c.Close()
+	}()
+
+	c, err := DialTimeout(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout failed: %s", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if string(got) != "bye" {
+		t.Errorf("read %q, expected bye", got)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Nothing answers on this socket
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer sock.Close()
+
+	_, err = DialTimeout(sock.LocalAddr().String(), 200*time.Millisecond)
+	oe, ok := err.(*net.OpError)
+	if !ok || oe.Op != "dial" || !oe.Timeout() {
+		t.Errorf("DialTimeout => %v, expected dial timeout", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+
+	c, err := DialTimeout(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout failed: %s", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = c.Read(make([]byte, 1)); err != ErrTimeout {
+		t.Errorf("Read => %v, expected timeout", err)
+	}
+}